@@ -0,0 +1,473 @@
+/*
+Copyright (C) 2016 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+// Package analysis recovers the structure of a CHIP8 program from its
+// binary image. The code is found by following the control flow from the
+// start address, so everything that is not reached is treated as data.
+// The coverage of a run of the program can be used to find the code that
+// static analysis misses.
+package analysis
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/andreas-jonsson/chip8/chip8"
+	"github.com/andreas-jonsson/chip8/chip8/asm"
+)
+
+type (
+	// Block is a basic block, the instructions in [Start, End). Blocks end
+	// at jumps, skips, calls and returns. Succs are the blocks control may
+	// continue with, Call is the target of a call ending the block or -1.
+	Block struct {
+		Start, End int
+		Succs      []int
+		Call       int
+	}
+
+	// CallSite is a call at PC to the subroutine at Target.
+	CallSite struct {
+		PC, Target int
+	}
+
+	// Function is the code reached from an entry point without following
+	// calls. The main program is the function at the start address.
+	// Returns is set if an rts is reached and Halts if the code stops in
+	// halt or a jump to itself.
+	Function struct {
+		Entry   int
+		Blocks  []*Block
+		Calls   []CallSite
+		Callers []int
+		Returns bool
+		Halts   bool
+	}
+
+	// JumpTable is a jump0 at PC to Base plus v0 and the targets found for
+	// it, Targets is empty if they could not be found.
+	JumpTable struct {
+		PC, Base int
+		Targets  []int
+	}
+
+	// Program is an analyzed program.
+	Program struct {
+		Target     string
+		Memory     []byte
+		Start, End int
+
+		Blocks     []*Block
+		Funcs      []*Function
+		JumpTables []*JumpTable
+
+		// Invalid holds the reached addresses with invalid opcodes and
+		// Outside the addresses reached outside of the program.
+		Invalid []int
+		Outside []int
+
+		// DataRefs are the addresses loaded into the index register.
+		DataRefs []int
+
+		// Coverage is the coverage the program was analyzed with, or nil.
+		// Entries are the executed addresses that are not reached from
+		// the start address, which the analysis continued from.
+		Coverage *chip8.Coverage
+		Entries  []int
+
+		insts  map[int]bool
+		tables map[int]*JumpTable
+		blocks map[int]*Block
+		funcs  map[int]*Function
+	}
+)
+
+// Analyze analyzes image loaded at start in the memory of target.
+func Analyze(image []byte, start int, target string) (*Program, error) {
+	return AnalyzeCoverage(image, start, target, nil)
+}
+
+// AnalyzeCoverage is Analyze with the coverage of a run of the program.
+// Every executed address is taken as code, and the control flow is not
+// followed into bytes that were only read or written as data.
+func AnalyzeCoverage(image []byte, start int, target string, coverage *chip8.Coverage) (*Program, error) {
+	size := asm.MemorySize(target)
+	if size == 0 {
+		return nil, fmt.Errorf("unknown target '%s'", target)
+	}
+	if start < 0 || start+len(image) > size {
+		return nil, fmt.Errorf("program does not fit in the %d bytes of memory of %s", size, target)
+	}
+
+	p := &Program{
+		Target:   target,
+		Memory:   make([]byte, size),
+		Start:    start,
+		End:      start + len(image),
+		Coverage: coverage,
+		insts:    make(map[int]bool),
+		tables:   make(map[int]*JumpTable),
+		blocks:   make(map[int]*Block),
+		funcs:    make(map[int]*Function),
+	}
+	copy(p.Memory[start:], image)
+
+	p.discover()
+	p.buildBlocks()
+	p.buildFunctions()
+	return p, nil
+}
+
+// Opcode returns the word at pc.
+func (p *Program) Opcode(pc int) uint16 {
+	return uint16(p.Memory[pc])<<8 | uint16(p.Memory[(pc+1)%len(p.Memory)])
+}
+
+// Size returns the size of the instruction at pc, loadil takes 4 bytes on
+// XO-CHIP.
+func (p *Program) Size(pc int) int {
+	if p.Target == "xochip" && p.Opcode(pc) == 0xF000 {
+		return 4
+	}
+	return 2
+}
+
+// Instruction returns the instruction at pc.
+func (p *Program) Instruction(pc int) (asm.Instruction, bool) {
+	return asm.Decode(p.Opcode(pc))
+}
+
+// IsInstruction reports whether an instruction at pc is reached.
+func (p *Program) IsInstruction(pc int) bool {
+	return p.insts[pc]
+}
+
+// Instructions returns the addresses of all reached instructions in order.
+func (p *Program) Instructions() []int {
+	var addrs []int
+	for pc := range p.insts {
+		addrs = append(addrs, pc)
+	}
+	sort.Ints(addrs)
+	return addrs
+}
+
+// IsCode reports whether addr is part of a reached instruction.
+func (p *Program) IsCode(addr int) bool {
+	return p.CodeAt(addr) >= 0
+}
+
+// CodeAt returns the address of the reached instruction covering addr, or
+// -1.
+func (p *Program) CodeAt(addr int) int {
+	for pc := addr; pc >= addr-3; pc-- {
+		if p.insts[pc] && addr < pc+p.Size(pc) {
+			return pc
+		}
+	}
+	return -1
+}
+
+// Executed reports whether addr was executed in the coverage.
+func (p *Program) Executed(addr int) bool {
+	return p.Coverage != nil && addr < len(p.Coverage.Executed) && p.Coverage.Executed[addr] > 0
+}
+
+// isData reports whether addr was accessed as data but not executed in the
+// coverage.
+func (p *Program) isData(addr int) bool {
+	if p.Coverage == nil || addr >= len(p.Coverage.Executed) || p.Executed(addr) {
+		return false
+	}
+	return p.Coverage.Read[addr] > 0 || p.Coverage.Written[addr] > 0
+}
+
+// Block returns the block starting at pc, or nil.
+func (p *Program) Block(pc int) *Block {
+	return p.blocks[pc]
+}
+
+// Func returns the function with entry point pc, or nil.
+func (p *Program) Func(pc int) *Function {
+	return p.funcs[pc]
+}
+
+// JumpTable returns the jump table of the jump0 at pc, or nil.
+func (p *Program) JumpTable(pc int) *JumpTable {
+	return p.tables[pc]
+}
+
+func (p *Program) inImage(pc int) bool {
+	return pc >= p.Start && pc+1 < p.End
+}
+
+// Successors returns the instructions that may follow pc, not counting
+// the target of a call which is returned as call, or -1. Targets of jump0
+// are taken from its jump table.
+func (p *Program) Successors(pc int) (next []int, call int) {
+	op := p.Opcode(pc)
+	if _, ok := asm.Decode(op); !ok {
+		return nil, -1
+	}
+
+	after := pc + p.Size(pc)
+	switch {
+	case op == 0x00EE, op == 0x00FD:
+		return nil, -1
+	case op&0xF000 == 0x1000:
+		if int(op&0xFFF) == pc {
+			return nil, -1
+		}
+		return []int{int(op & 0xFFF)}, -1
+	case op&0xF000 == 0x2000:
+		return []int{after}, int(op & 0xFFF)
+	case op&0xF000 == 0xB000:
+		if t, ok := p.tables[pc]; ok {
+			return t.Targets, -1
+		}
+		return nil, -1
+	case IsSkip(op):
+		if p.inImage(after) {
+			return []int{after, after + p.Size(after)}, -1
+		}
+		return []int{after, after + 2}, -1
+	}
+	return []int{after}, -1
+}
+
+// IsSkip reports whether op is a conditional skip.
+func IsSkip(op uint16) bool {
+	switch op & 0xF000 {
+	case 0x3000, 0x4000:
+		return true
+	case 0x5000, 0x9000:
+		return op&0xF == 0
+	case 0xE000:
+		return op&0xFF == 0x9E || op&0xFF == 0xA1
+	}
+	return false
+}
+
+// endsBlock reports whether the instruction at pc transfers control.
+func (p *Program) endsBlock(pc int) bool {
+	op := p.Opcode(pc)
+	switch op & 0xF000 {
+	case 0x1000, 0x2000, 0xB000:
+		return true
+	}
+	return op == 0x00EE || op == 0x00FD || IsSkip(op)
+}
+
+// discover finds the reached instructions.
+func (p *Program) discover() {
+	invalid := make(map[int]bool)
+	outside := make(map[int]bool)
+	refs := make(map[int]bool)
+
+	p.follow([]int{p.Start}, invalid, outside, refs)
+
+	// Continue with the executed addresses that were not reached.
+	for addr := p.Start; addr < p.End; addr++ {
+		if p.Executed(addr) && !p.IsCode(addr) && !invalid[addr] && !outside[addr] {
+			p.Entries = append(p.Entries, addr)
+			p.follow([]int{addr}, invalid, outside, refs)
+		}
+	}
+
+	p.Invalid = sortedKeys(invalid)
+	p.Outside = sortedKeys(outside)
+	p.DataRefs = sortedKeys(refs)
+	sort.Slice(p.JumpTables, func(i, j int) bool {
+		return p.JumpTables[i].PC < p.JumpTables[j].PC
+	})
+}
+
+// follow adds the instructions reached from work.
+func (p *Program) follow(work []int, invalid, outside, refs map[int]bool) {
+	for len(work) > 0 {
+		pc := work[len(work)-1]
+		work = work[:len(work)-1]
+		if p.insts[pc] || invalid[pc] || outside[pc] {
+			continue
+		}
+		if !p.inImage(pc) {
+			outside[pc] = true
+			continue
+		}
+		if p.isData(pc) || p.isData(pc+1) {
+			continue
+		}
+
+		op := p.Opcode(pc)
+		if _, ok := asm.Decode(op); !ok {
+			invalid[pc] = true
+			continue
+		}
+		p.insts[pc] = true
+
+		switch {
+		case op&0xF000 == 0xA000:
+			refs[int(op&0xFFF)] = true
+		case op == 0xF000 && p.Size(pc) == 4:
+			refs[int(p.Opcode(pc+2))] = true
+		case op&0xF000 == 0xB000:
+			t := p.jumpTable(pc)
+			p.tables[pc] = t
+			p.JumpTables = append(p.JumpTables, t)
+		}
+
+		next, call := p.Successors(pc)
+		if call >= 0 {
+			work = append(work, call)
+		}
+		work = append(work, next...)
+	}
+}
+
+// leaders returns the addresses where blocks start.
+func (p *Program) leaders() map[int]bool {
+	leaders := map[int]bool{p.Start: true}
+	for pc := range p.insts {
+		if !p.endsBlock(pc) {
+			continue
+		}
+		next, call := p.Successors(pc)
+		for _, n := range next {
+			leaders[n] = true
+		}
+		if call >= 0 {
+			leaders[call] = true
+		}
+	}
+	return leaders
+}
+
+func (p *Program) buildBlocks() {
+	leaders := p.leaders()
+	for _, pc := range p.Instructions() {
+		if b := p.blockOf(pc); b != nil && !leaders[pc] {
+			continue
+		}
+
+		b := &Block{Start: pc, Call: -1}
+		for {
+			end := pc + p.Size(pc)
+			if p.endsBlock(pc) || !p.insts[end] || leaders[end] {
+				b.End = end
+				break
+			}
+			pc = end
+		}
+
+		next, call := p.Successors(pc)
+		for _, n := range next {
+			if p.insts[n] {
+				b.Succs = append(b.Succs, n)
+			}
+		}
+		b.Call = call
+		p.Blocks = append(p.Blocks, b)
+		p.blocks[b.Start] = b
+	}
+}
+
+// blockOf returns the last block starting before pc if it covers pc.
+func (p *Program) blockOf(pc int) *Block {
+	if len(p.Blocks) == 0 {
+		return nil
+	}
+	if b := p.Blocks[len(p.Blocks)-1]; pc >= b.Start && pc < b.End {
+		return b
+	}
+	return nil
+}
+
+func (p *Program) buildFunctions() {
+	entries := []int{p.Start}
+	for len(entries) > 0 {
+		entry := entries[0]
+		entries = entries[1:]
+		if _, ok := p.funcs[entry]; ok || p.blocks[entry] == nil {
+			continue
+		}
+
+		fn := &Function{Entry: entry}
+		p.funcs[entry] = fn
+		p.Funcs = append(p.Funcs, fn)
+
+		seen := make(map[int]bool)
+		work := []int{entry}
+		for len(work) > 0 {
+			b := p.blocks[work[len(work)-1]]
+			work = work[:len(work)-1]
+			if b == nil || seen[b.Start] {
+				continue
+			}
+			seen[b.Start] = true
+			fn.Blocks = append(fn.Blocks, b)
+
+			last := p.Last(b)
+			op := p.Opcode(last)
+			switch {
+			case op == 0x00EE:
+				fn.Returns = true
+			case op == 0x00FD, op&0xF000 == 0x1000 && int(op&0xFFF) == last:
+				fn.Halts = true
+			}
+			if b.Call >= 0 {
+				fn.Calls = append(fn.Calls, CallSite{last, b.Call})
+				entries = append(entries, b.Call)
+			}
+			work = append(work, b.Succs...)
+		}
+		sort.Slice(fn.Blocks, func(i, j int) bool {
+			return fn.Blocks[i].Start < fn.Blocks[j].Start
+		})
+	}
+
+	for _, fn := range p.Funcs {
+		for _, c := range fn.Calls {
+			if callee := p.funcs[c.Target]; callee != nil {
+				callee.Callers = append(callee.Callers, c.PC)
+			}
+		}
+	}
+	for _, fn := range p.Funcs {
+		sort.Ints(fn.Callers)
+	}
+	sort.Slice(p.Funcs, func(i, j int) bool {
+		return p.Funcs[i].Entry < p.Funcs[j].Entry
+	})
+}
+
+// Last returns the address of the last instruction in b.
+func (p *Program) Last(b *Block) int {
+	pc := b.Start
+	for next := pc + p.Size(pc); next < b.End; next += p.Size(next) {
+		pc = next
+	}
+	return pc
+}
+
+func sortedKeys(m map[int]bool) []int {
+	var keys []int
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Ints(keys)
+	return keys
+}
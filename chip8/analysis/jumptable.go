@@ -0,0 +1,150 @@
+/*
+Copyright (C) 2016 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package analysis
+
+// The targets of 'jump0 nnn' depend on v0 and are guessed from the code
+// leading up to it:
+//
+//   - If v0 is loaded with a constant, that is the only target.
+//   - Otherwise the table at nnn is assumed to be a list of jumps, one for
+//     every even value of v0. The table ends at the first word that is not
+//     a jump, or at the largest value v0 can have if it was masked with
+//     'and' or set by 'rand', and then possibly doubled. If v0 is not
+//     limited a single jump is not taken as a table.
+//
+// If neither applies the targets are unknown. SCHIP's use of vX instead of
+// v0 is not considered.
+
+const maxBacktrack = 16
+
+// jumpTable guesses the targets of the jump0 at pc.
+func (p *Program) jumpTable(pc int) *JumpTable {
+	base := int(p.Opcode(pc) & 0xFFF)
+	t := &JumpTable{PC: pc, Base: base}
+
+	value, limit := p.v0Range(pc)
+	if value >= 0 {
+		t.Targets = []int{base + value}
+		return t
+	}
+
+	for offset := 0; offset <= limit; offset += 2 {
+		addr := base + offset
+		if !p.inImage(addr) || p.Opcode(addr)&0xF000 != 0x1000 {
+			break
+		}
+		t.Targets = append(t.Targets, addr)
+	}
+	if len(t.Targets) == 1 && limit == 0xFF {
+		t.Targets = nil
+	}
+	return t
+}
+
+// v0Range runs the straight line code before pc and returns the value of
+// v0 if it is constant, or else -1 and the largest value it can have.
+func (p *Program) v0Range(pc int) (value, limit int) {
+	start := pc
+	for n := 0; n < maxBacktrack && p.insts[start-2] && !p.endsBlock(start-2); n++ {
+		start -= 2
+	}
+
+	var (
+		consts = make(map[uint16]int)
+		v0     = -1
+	)
+	limit = 0xFF
+
+	for addr := start; addr < pc; addr += 2 {
+		op := p.Opcode(addr)
+		x, y, nn := (op>>8)&0xF, (op>>4)&0xF, int(op&0xFF)
+		switch {
+		case op&0xF000 == 0x6000:
+			consts[x] = nn
+			if x == 0 {
+				v0, limit = nn, nn
+			}
+		case op&0xF000 == 0xC000 && x == 0:
+			delete(consts, 0)
+			v0, limit = -1, nn
+		case op&0xF00F == 0x8002 && x == 0:
+			c, ok := consts[y]
+			switch {
+			case ok && v0 >= 0:
+				v0 &= c
+				limit = v0
+				consts[0] = v0
+			case ok:
+				limit &= c
+			}
+			delete(consts, 0xF)
+		case op == 0x8004, op&0xFF0F == 0x800E:
+			// v0 doubled, as done to index a table of 2 byte jumps.
+			if v0 >= 0 {
+				v0 = v0 * 2 & 0xFF
+				consts[0] = v0
+			}
+			if limit = limit * 2; limit > 0xFF {
+				limit = 0xFF
+			}
+			delete(consts, 0xF)
+		default:
+			regs := written(op)
+			for r := uint16(0); r < 16; r++ {
+				if regs&(1<<r) != 0 {
+					delete(consts, r)
+				}
+			}
+			if regs&1 != 0 {
+				v0, limit = -1, 0xFF
+			}
+		}
+	}
+	return v0, limit
+}
+
+// written returns the registers op writes as a bit mask.
+func written(op uint16) uint16 {
+	x, y := (op>>8)&0xF, (op>>4)&0xF
+	switch op & 0xF000 {
+	case 0x6000, 0x7000, 0xC000:
+		return 1 << x
+	case 0x8000:
+		if op&0xF == 0 {
+			return 1 << x
+		}
+		return 1<<x | 1<<0xF
+	case 0xD000:
+		return 1 << 0xF
+	case 0x5000:
+		if op&0xF == 3 {
+			if x > y {
+				x, y = y, x
+			}
+			return (1<<(y+1) - 1) &^ (1<<x - 1)
+		}
+	case 0xF000:
+		switch op & 0xFF {
+		case 0x07, 0x0A:
+			return 1 << x
+		case 0x65, 0x85:
+			return 1<<(x+1) - 1
+		}
+	}
+	return 0
+}
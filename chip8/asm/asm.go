@@ -0,0 +1,245 @@
+/*
+Copyright (C) 2016 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+// Package asm implements the CHIP8 assembler used by cmd/asm. The source
+// syntax is described in cmd/asm/README.md.
+package asm
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sort"
+	"strings"
+
+	"github.com/andreas-jonsson/chip8/chip8"
+)
+
+// Options controls how a program is assembled.
+type Options struct {
+	// IncludeDirs are searched for files used with include and incbin
+	// after the directory of the including file.
+	IncludeDirs []string
+
+	// Chipper selects the CHIPPER compatible syntax.
+	Chipper bool
+
+	// Optimize runs the peephole optimizer. A summary of the changes is
+	// written to Log, if set.
+	Optimize bool
+	Log      io.Writer
+
+	// Object produces a relocatable object file for the linker.
+	Object bool
+}
+
+// Program is an assembled program. No output should be written if
+// NumErrors reports any errors.
+type Program struct {
+	// Diagnostics are sorted by file, line and column.
+	Diagnostics []Diagnostic
+
+	// Object is the object file when assembled with Options.Object.
+	Object *chip8.Object
+
+	asm *assembler
+}
+
+// Position is a position in a source file, line and column start at 1.
+type Position struct {
+	File         string
+	Line, Column int
+}
+
+// SymbolInfo is a label or constant defined in the source, Refs are the
+// places it is used.
+type SymbolInfo struct {
+	Name  string
+	Value int
+	Label bool
+	Pos   Position
+	Refs  []Position
+}
+
+// AssembleFile assembles the source file fileName. The error is only set
+// if a file could not be read, problems in the source are reported as
+// diagnostics.
+func AssembleFile(fileName string, opts Options) (*Program, error) {
+	src, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+	return Assemble(fileName, src, opts)
+}
+
+// Assemble assembles src as if it was read from the file fileName.
+func Assemble(fileName string, src []byte, opts Options) (*Program, error) {
+	asm, err := assemble(fileName, src, opts, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if opts.Optimize && asm.numErrors() == 0 {
+		if asm, err = optimizeProgram(fileName, src, opts, asm); err != nil {
+			return nil, err
+		}
+	}
+
+	prog := &Program{asm: asm}
+	if opts.Object && asm.numErrors() == 0 {
+		prog.Object = asm.objectFile()
+	}
+	sortDiagnostics(asm.diags)
+	prog.Diagnostics = asm.diags
+	return prog, nil
+}
+
+func assemble(fileName string, src []byte, opts Options, edits map[int]edit) (*assembler, error) {
+	asm := newAssembler(opts.IncludeDirs)
+	asm.chipper = opts.Chipper
+	asm.object = opts.Object
+	asm.edits = edits
+	if err := asm.assembleReader(fileName, bytes.NewReader(src)); err != nil {
+		return nil, err
+	}
+	asm.patchProgram()
+	asm.checkLayout()
+	return asm, nil
+}
+
+// optimizeProgram assembles the program again with the optimizer edits and
+// returns the result, or asm if that fails.
+func optimizeProgram(fileName string, src []byte, opts Options, asm *assembler) (*assembler, error) {
+	log := opts.Log
+	if log == nil {
+		log = ioutil.Discard
+	}
+
+	edits, stats := asm.optimize()
+	if len(edits) == 0 {
+		stats.write(log, 0)
+		return asm, nil
+	}
+
+	opt, err := assemble(fileName, src, opts, edits)
+	if err != nil {
+		return nil, err
+	}
+	if opt.editMismatch || len(opt.insts) != len(asm.insts) || opt.numErrors() > 0 {
+		fmt.Fprintln(log, "optimizer: the second pass differs from the first, program left unoptimized")
+		return asm, nil
+	}
+
+	stats.write(log, asm.dataSize()-opt.dataSize())
+	return opt, nil
+}
+
+// NumErrors returns the number of error diagnostics.
+func (p *Program) NumErrors() int {
+	return p.asm.numErrors()
+}
+
+// Start returns the load address of the program.
+func (p *Program) Start() int {
+	return p.asm.startAddr
+}
+
+// Size returns the number of bytes written, not counting gaps and reserved
+// memory.
+func (p *Program) Size() int {
+	return p.asm.dataSize()
+}
+
+// Image returns the program as loaded at the start address and its source
+// map.
+func (p *Program) Image() ([]byte, *chip8.SourceMap) {
+	program, source := p.asm.image()
+	return program, sourceMap(p.asm.startAddr, source)
+}
+
+// Symbols returns all labels sorted by address.
+func (p *Program) Symbols() chip8.Symbols {
+	return p.asm.symbolTable()
+}
+
+// WriteListing writes every source line with its address and encoded bytes.
+func (p *Program) WriteListing(writer io.Writer) error {
+	return p.asm.writeListing(writer)
+}
+
+// WriteMemoryMap writes the range, size and origin of every region of the
+// program and the free memory.
+func (p *Program) WriteMemoryMap(writer io.Writer) {
+	p.asm.writeMemoryMap(writer)
+}
+
+// SymbolInfo returns the labels and constants defined in the source sorted
+// by name. Symbols generated by the assembler are not included.
+func (p *Program) SymbolInfo() []SymbolInfo {
+	toPosition := func(pos position) Position {
+		return Position{pos.file, pos.line, pos.col}
+	}
+
+	refs := make(map[string][]Position)
+	for pos, name := range p.asm.refs {
+		refs[name] = append(refs[name], toPosition(pos))
+	}
+
+	var symbols []SymbolInfo
+	for name, sym := range p.asm.symbols {
+		if strings.HasPrefix(name, "$") || sym.pos.file == "" {
+			continue
+		}
+
+		info := SymbolInfo{Name: name, Label: sym.lable, Pos: toPosition(sym.pos), Refs: refs[name]}
+		if sym.resolved {
+			info.Value = sym.value
+		}
+		sort.Slice(info.Refs, func(i, j int) bool {
+			a, b := info.Refs[i], info.Refs[j]
+			if a.File != b.File {
+				return a.File < b.File
+			}
+			if a.Line != b.Line {
+				return a.Line < b.Line
+			}
+			return a.Column < b.Column
+		})
+		symbols = append(symbols, info)
+	}
+
+	sort.Slice(symbols, func(i, j int) bool {
+		return symbols[i].Name < symbols[j].Name
+	})
+	return symbols
+}
+
+// Target returns the name of the target platform.
+func (p *Program) Target() string {
+	return p.asm.platform.name
+}
+
+// Code returns the addresses of the instructions in the program, data
+// written with directives is not included.
+func (p *Program) Code() []int {
+	var addrs []int
+	for _, inst := range p.asm.insts {
+		addrs = append(addrs, inst.addr)
+	}
+	return addrs
+}
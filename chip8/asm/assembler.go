@@ -0,0 +1,735 @@
+/*
+Copyright (C) 2016 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package asm
+
+import (
+	"fmt"
+	"sort"
+)
+
+const programStart = 0x200
+
+type (
+	patchInfo struct {
+		addr        int
+		size        int
+		bits, shift uint
+		expr        expr
+	}
+
+	symbol struct {
+		value     int
+		expr      expr
+		resolved  bool
+		resolving bool
+		lable     bool
+		reloc     bool
+		imported  bool
+		pos       position
+	}
+
+	assembler struct {
+		file string
+		line int
+		col  int
+		addr int
+
+		sections  []*section
+		current   *section
+		startAddr int
+		platform  *platform
+
+		patches []patchInfo
+		symbols map[string]*symbol
+		refs    map[position]string
+		diags   []Diagnostic
+
+		conds         []conditional
+		macros        map[string]*macro
+		recording     *macro
+		context       []expansion
+		origin        []position
+		numExpansions int
+
+		files        []string
+		includePaths []string
+
+		charmap map[rune]int
+
+		blocks    []block
+		numBlocks int
+
+		insts        []instInfo
+		edits        map[int]edit
+		editMismatch bool
+
+		object   bool
+		absolute bool
+		maxAlign int
+		relocs   []patchInfo
+		exports  map[string]position
+		inField  bool
+
+		chipper   bool
+		noAlign   bool
+		unaligned []*symbol
+
+		listing []*listEntry
+		entry   *listEntry
+	}
+)
+
+func newAssembler(includePaths []string) *assembler {
+	return &assembler{
+		includePaths: includePaths,
+		addr:         programStart,
+		startAddr:    programStart,
+		platform:     findPlatform(defaultPlatform),
+		symbols:      make(map[string]*symbol),
+		refs:         make(map[position]string),
+		macros:       make(map[string]*macro),
+	}
+}
+
+func (asm *assembler) pos(col int) position {
+	return position{asm.file, asm.line, col}
+}
+
+func (asm *assembler) report(severity string, pos position, format string, a ...interface{}) {
+	d := Diagnostic{
+		File:     pos.file,
+		Line:     pos.line,
+		Column:   pos.col,
+		Severity: severity,
+		Message:  fmt.Sprintf(format, a...),
+	}
+
+	if n := len(asm.context); n > 0 {
+		exp := asm.context[n-1]
+		d.Message += fmt.Sprintf(" (in macro '%s' expanded at %v)", exp.name, exp.pos)
+	}
+
+	// The same bad constant can be reached from many operands.
+	for _, prev := range asm.diags {
+		if prev == d {
+			return
+		}
+	}
+	asm.diags = append(asm.diags, d)
+}
+
+func (asm *assembler) errorf(col int, format string, a ...interface{}) {
+	asm.report(SeverityError, asm.pos(col), format, a...)
+}
+
+func (asm *assembler) reportError(err error) {
+	switch err := err.(type) {
+	case *syntaxError:
+		asm.errorf(err.col, "%s", err.msg)
+	case *undefinedError:
+		asm.report(SeverityError, err.pos, "%v", err)
+	case *evalError:
+		asm.report(SeverityError, err.pos, "%s", err.msg)
+	default:
+		asm.errorf(1, "%v", err)
+	}
+}
+
+func (asm *assembler) numErrors() int {
+	n := 0
+	for _, d := range asm.diags {
+		if d.Severity == SeverityError {
+			n++
+		}
+	}
+	return n
+}
+
+func (asm *assembler) define(name string, pos position, sym *symbol) {
+	if isRegister(name) {
+		asm.report(SeverityError, pos, "register name %s cannot be used as a symbol", name)
+		return
+	}
+	if isLocalLable(name) && len(asm.context) == 0 {
+		asm.report(SeverityError, pos, "local label '%s' outside of macro", name)
+		return
+	}
+
+	if prev, ok := asm.symbols[name]; ok {
+		kind := "symbol"
+		if prev.lable {
+			kind = "label"
+		}
+		asm.report(SeverityError, pos, "%s '%s' defined twice, previous definition at %v", kind, name, prev.pos)
+		return
+	}
+
+	sym.pos = pos
+	asm.symbols[name] = sym
+}
+
+func (asm *assembler) lookup(e *exprSymbol) (int, error) {
+	sym, ok := asm.symbols[e.name]
+	if !ok {
+		return 0, &undefinedError{e.pos, e.name}
+	}
+	if sym.imported && !(asm.object && asm.inField) {
+		if asm.object {
+			return 0, &evalError{e.pos, fmt.Sprintf("imported symbol '%s' can only be used in operands", e.name)}
+		}
+		return 0, &evalError{e.pos, fmt.Sprintf("imported symbol '%s' is resolved by the linker, assemble with -c", e.name)}
+	}
+
+	if !sym.resolved {
+		if sym.resolving {
+			return 0, &evalError{e.pos, fmt.Sprintf("circular definition of '%s'", e.name)}
+		}
+
+		sym.resolving = true
+		v, err := asm.eval(sym.expr)
+		sym.resolving = false
+
+		if err != nil {
+			return 0, err
+		}
+		sym.value, sym.resolved = v, true
+	}
+	return sym.value, nil
+}
+
+func (asm *assembler) checkLen(mnemonic token, args []expr, n int) bool {
+	if len(args) == n {
+		return true
+	}
+
+	pos := asm.pos(mnemonic.col)
+	if len(args) > n {
+		pos = args[n].position()
+	}
+	asm.report(SeverityError, pos, "'%s' expects %d operand(s), got %d", mnemonic.text, n, len(args))
+	return false
+}
+
+func (asm *assembler) fit(value int, bits uint, pos position) uint16 {
+	if value >= 1<<bits || value < -(1<<(bits-1)) {
+		asm.report(SeverityError, pos, "immediate %d does not fit in %d bits", value, bits)
+	}
+	return uint16(value) & (1<<bits - 1)
+}
+
+// field evaluates e into a bits wide field starting at bit shift of the
+// size byte wide value written next. Expressions referencing symbols that
+// are not yet defined are patched once the whole program has been read.
+func (asm *assembler) field(e expr, bits, shift uint, size int) uint16 {
+	if name, ok := registerOf(e); ok {
+		asm.report(SeverityError, e.position(), "expected immediate value, got register %s", name)
+		return 0
+	}
+
+	if asm.object {
+		asm.relocs = append(asm.relocs, patchInfo{asm.addr, size, bits, shift, e})
+	}
+
+	asm.inField = true
+	v, err := asm.eval(e)
+	asm.inField = false
+	if err != nil {
+		if _, ok := err.(*undefinedError); ok {
+			asm.patches = append(asm.patches, patchInfo{asm.addr, size, bits, shift, e})
+		} else {
+			asm.reportError(err)
+		}
+		return 0
+	}
+	return asm.fit(v, bits, e.position()) << shift
+}
+
+func (asm *assembler) immediate(e expr, bits uint, size int) uint16 {
+	return asm.field(e, bits, 0, size)
+}
+
+func (asm *assembler) register(e expr) uint16 {
+	if name, ok := registerOf(e); ok {
+		n := name[1] - '0'
+		if n > 9 {
+			n = name[1] - 'a' + 10
+		}
+		return uint16(n)
+	}
+
+	if sym, ok := e.(*exprSymbol); ok && len(sym.name) > 1 && sym.name[0] == 'v' {
+		asm.report(SeverityError, e.position(), "register %s out of range", sym.name)
+	} else {
+		asm.report(SeverityError, e.position(), "expected register")
+	}
+	return 0
+}
+
+func (asm *assembler) writeUint8(value byte) {
+	if asm.current == nil {
+		asm.current = &section{start: asm.addr, pos: asm.pos(1), reloc: !asm.absolute}
+		asm.sections = append(asm.sections, asm.current)
+	}
+
+	asm.unaligned = nil
+	asm.current.data = append(asm.current.data, value)
+	asm.current.source = append(asm.current.source, sourceInfo{asm.pos(asm.col), asm.origin})
+	if asm.entry != nil {
+		asm.entry.bytes = append(asm.entry.bytes, asm.addr)
+	}
+	asm.addr++
+}
+
+func (asm *assembler) writeUint16(value uint16) {
+	asm.writeUint8(byte(value >> 8))
+	asm.writeUint8(byte(value))
+}
+
+func (asm *assembler) writeOpcode(mnemonic token, args []expr) {
+	asm.checkSupported(mnemonic)
+	asm.encodeOpcode(mnemonic.text, mnemonic, args)
+}
+
+// encodeOpcode writes the instruction name, problems with the operands are
+// reported at mnemonic.
+func (asm *assembler) encodeOpcode(name string, mnemonic token, args []expr) {
+	if !asm.applyEdit(&name, mnemonic, &args) {
+		return
+	}
+
+	switch name {
+	case "scr":
+		var n uint16
+		if asm.checkLen(mnemonic, args, 1) {
+			n = asm.immediate(args[0], 4, 2)
+		}
+		asm.writeUint16(0xC0 | n)
+	case "clr":
+		asm.checkLen(mnemonic, args, 0)
+		asm.writeUint16(0xE0)
+	case "rts":
+		asm.checkLen(mnemonic, args, 0)
+		asm.writeUint16(0xEE)
+	case "scrr":
+		asm.checkLen(mnemonic, args, 0)
+		asm.writeUint16(0xFB)
+	case "scrl":
+		asm.checkLen(mnemonic, args, 0)
+		asm.writeUint16(0xFC)
+	case "halt":
+		asm.checkLen(mnemonic, args, 0)
+		asm.writeUint16(0xFD)
+	case "low":
+		asm.checkLen(mnemonic, args, 0)
+		asm.writeUint16(0xFE)
+	case "high":
+		asm.checkLen(mnemonic, args, 0)
+		asm.writeUint16(0xFF)
+	case "scru":
+		var n uint16
+		if asm.checkLen(mnemonic, args, 1) {
+			n = asm.immediate(args[0], 4, 2)
+		}
+		asm.writeUint16(0xD0 | n)
+	case "freq", "reset", "color":
+		var inst uint16
+		switch name {
+		case "freq":
+			inst = 0x100
+		case "reset":
+			inst = 0x101
+		case "color":
+			inst = 0x102
+		}
+
+		asm.checkLen(mnemonic, args, 0)
+		asm.writeUint16(inst)
+	case "audio":
+		asm.checkLen(mnemonic, args, 0)
+		asm.writeUint16(0xF002)
+	case "plane":
+		inst := uint16(0xF001)
+		if asm.checkLen(mnemonic, args, 1) {
+			inst |= asm.field(args[0], 4, 8, 2)
+		}
+		asm.writeUint16(inst)
+	case "loadil":
+		asm.writeUint16(0xF000)
+
+		var n uint16
+		if asm.checkLen(mnemonic, args, 1) {
+			n = asm.immediate(args[0], 16, 2)
+		}
+		asm.writeUint16(n)
+	case "jump", "call", "loadi", "jump0", "sys":
+		var inst uint16
+		switch name {
+		case "jump":
+			inst = 0x1000
+		case "call":
+			inst = 0x2000
+		case "loadi":
+			inst = 0xA000
+		case "jump0":
+			inst = 0xB000
+		case "sys":
+			inst = 0x0000
+		default:
+			panic(nil)
+		}
+
+		if asm.checkLen(mnemonic, args, 1) {
+			inst |= asm.immediate(args[0], 12, 2)
+		}
+
+		asm.writeUint16(inst)
+	case "ske", "skne", "load", "add", "rand":
+		var inst uint16
+		switch name {
+		case "ske":
+			inst = 0x3000
+		case "skne":
+			inst = 0x4000
+		case "load":
+			inst = 0x6000
+		case "add":
+			inst = 0x7000
+		case "rand":
+			inst = 0xC000
+		default:
+			panic(nil)
+		}
+
+		if asm.checkLen(mnemonic, args, 2) {
+			reg := asm.register(args[0])
+			n := asm.immediate(args[1], 8, 2)
+			inst |= (reg << 8) | n
+		}
+
+		asm.writeUint16(inst)
+	case "skre", "move", "or", "and", "xor", "addr", "sub", "subr", "sknre", "storr", "readr":
+		var inst uint16
+		switch name {
+		case "skre":
+			inst = 0x5000
+		case "move":
+			inst = 0x8000
+		case "or":
+			inst = 0x8001
+		case "and":
+			inst = 0x8002
+		case "xor":
+			inst = 0x8003
+		case "addr":
+			inst = 0x8004
+		case "sub":
+			inst = 0x8005
+		case "subr":
+			inst = 0x8007
+		case "sknre":
+			inst = 0x9000
+		case "storr":
+			inst = 0x5002
+		case "readr":
+			inst = 0x5003
+		default:
+			panic(nil)
+		}
+
+		if asm.checkLen(mnemonic, args, 2) {
+			reg0 := asm.register(args[0])
+			reg1 := asm.register(args[1])
+			inst |= (reg0 << 8) | (reg1 << 4)
+		}
+
+		asm.writeUint16(inst)
+	case "shr", "shl", "skp", "sknp", "moved", "keyd", "loadd", "loads", "addi", "ldspr", "bcd", "stor", "read", "ldhspr", "storf", "readf", "pitch":
+		var inst uint16
+		switch name {
+		case "shr":
+			inst = 0x8006
+		case "shl":
+			inst = 0x800E
+		case "skp":
+			inst = 0xE09E
+		case "sknp":
+			inst = 0xE0A1
+		case "moved":
+			inst = 0xF007
+		case "keyd":
+			inst = 0xF00A
+		case "loadd":
+			inst = 0xF015
+		case "loads":
+			inst = 0xF018
+		case "addi":
+			inst = 0xF01E
+		case "ldspr":
+			inst = 0xF029
+		case "bcd":
+			inst = 0xF033
+		case "stor":
+			inst = 0xF055
+		case "read":
+			inst = 0xF065
+		case "ldhspr":
+			inst = 0xF030
+		case "storf":
+			inst = 0xF075
+		case "readf":
+			inst = 0xF085
+		case "pitch":
+			inst = 0xF03A
+		}
+
+		if asm.checkLen(mnemonic, args, 1) {
+			inst |= asm.register(args[0]) << 8
+		}
+
+		asm.writeUint16(inst)
+	case "draw":
+		inst := uint16(0xD000)
+		if asm.checkLen(mnemonic, args, 3) {
+			reg0 := asm.register(args[0])
+			reg1 := asm.register(args[1])
+			n := asm.immediate(args[2], 4, 2)
+			inst |= (reg0 << 8) | (reg1 << 4) | n
+		}
+
+		asm.writeUint16(inst)
+	default:
+		asm.errorf(mnemonic.col, "unknown mnemonic '%s'", mnemonic.text)
+		asm.writeUint16(0)
+	}
+}
+
+// skipOpcode keeps the layout intact for a line that could not be parsed.
+func (asm *assembler) skipOpcode() {
+	asm.writeUint16(0)
+}
+
+func (asm *assembler) saveLable(tok token) {
+	sym := &symbol{
+		value:    asm.addr,
+		resolved: true,
+		lable:    true,
+		reloc:    !asm.absolute,
+	}
+	asm.define(tok.text, asm.pos(tok.col), sym)
+	if asm.chipper {
+		asm.unaligned = append(asm.unaligned, sym)
+	}
+}
+
+func (asm *assembler) saveConstant(name token, p *parser) {
+	var e expr = &exprNumber{asm.pos(name.col), 1}
+	if !p.done() {
+		var err error
+		if e, err = p.parseExpr(); err != nil {
+			asm.reportError(err)
+			return
+		}
+		if !p.done() {
+			asm.errorf(p.peek().col, "unexpected '%s' after expression", p.peek().text)
+			return
+		}
+	}
+	asm.define(name.text, asm.pos(name.col), &symbol{expr: e})
+}
+
+func (asm *assembler) assembleLine(line string) {
+	entry := &listEntry{pos: asm.pos(1), text: line, addr: asm.addr}
+	asm.listing = append(asm.listing, entry)
+
+	parent := asm.entry
+	asm.entry = entry
+	defer func() { asm.entry = parent }()
+
+	if asm.recording != nil {
+		asm.recordLine(line)
+		return
+	}
+
+	tokens, err := asm.lex(line)
+	if err != nil {
+		if !asm.skipping() {
+			asm.reportError(err)
+		}
+		return
+	}
+	asm.assembleTokens(tokens)
+}
+
+func (asm *assembler) assembleTokens(tokens []token) {
+	p := &parser{file: asm.file, line: asm.line, tokens: tokens}
+	if p.done() || asm.conditional(p) {
+		return
+	}
+
+	if len(tokens) > 1 && tokens[0].kind == tokIdent && tokens[1].kind == tokPunct && tokens[1].text == ":" {
+		asm.saveLable(tokens[0])
+		if p.index = 2; p.done() {
+			return
+		}
+	}
+
+	first := tokens[p.index]
+	if first.kind != tokIdent {
+		asm.errorf(first.col, "expected mnemonic, got '%s'", first.text)
+		return
+	}
+	p.index++
+	asm.col = first.col
+
+	if m, ok := asm.macros[first.text]; ok {
+		asm.expandMacro(m, first, p)
+		return
+	}
+	if asm.chipper {
+		asm.assembleChipper(first, p)
+		return
+	}
+	if asm.controlFlow(first, p) {
+		return
+	}
+	if asm.layoutDirective(first, p) {
+		return
+	}
+
+	switch {
+	case first.text == "macro":
+		asm.defineMacro(first, p)
+		return
+	case first.text == "." || first.text == "..":
+		size := 1
+		if first.text == ".." {
+			size = 2
+		}
+		asm.writeData(first, p, size)
+		return
+	case first.text == "sprite":
+		asm.writeSprite(first, p)
+		return
+	case first.text == "charmap":
+		asm.defineCharmap(first, p)
+		return
+	case first.text == "include":
+		asm.include(first, p)
+		return
+	case first.text == "incbin":
+		asm.incbin(first, p)
+		return
+	case first.text == "endm":
+		asm.errorf(first.col, "'endm' without 'macro'")
+		return
+	case first.text == "define":
+		name := p.peek()
+		if name == nil || name.kind != tokIdent {
+			asm.errorf(first.col, "'define' expects a symbol name")
+			return
+		}
+		p.index++
+		asm.saveConstant(*name, p)
+		return
+	case first.text == "import" || first.text == "export":
+		asm.linkDirective(first, p)
+		return
+	case !p.done() && p.peek().kind == tokIdent && p.peek().text == "equ":
+		p.index++
+		if p.done() {
+			asm.errorf(p.endCol(), "'equ' expects an expression")
+			return
+		}
+		asm.saveConstant(first, p)
+		return
+	}
+
+	args, err := p.parseOperands()
+	if err != nil {
+		asm.reportError(err)
+		asm.skipOpcode()
+		return
+	}
+	asm.writeOpcode(first, args)
+}
+
+// endOfFile reports blocks left open at the end of a source file.
+func (asm *assembler) endOfFile(numConds, numBlocks int) {
+	if m := asm.recording; m != nil {
+		asm.report(SeverityError, m.pos, "macro '%s' is missing 'endm'", m.name)
+		asm.recording = nil
+	}
+
+	for _, cond := range asm.conds[numConds:] {
+		asm.report(SeverityError, cond.pos, "'if' is missing 'endif'")
+	}
+	asm.conds = asm.conds[:numConds]
+
+	// Close open blocks so their generated labels are not reported as undefined.
+	for _, b := range asm.blocks[numBlocks:] {
+		if b.kind == "if" {
+			asm.report(SeverityError, b.pos, "'if' is missing 'end'")
+			if !b.seenElse {
+				asm.defineBlockLable(b.lable(".else"), 1)
+			}
+		} else {
+			asm.report(SeverityError, b.pos, "'loop' is missing 'again'")
+		}
+		asm.defineBlockLable(b.lable(".end"), 1)
+	}
+	asm.blocks = asm.blocks[:numBlocks]
+}
+
+func (asm *assembler) patchProgram() {
+	// Everything evaluated here ends up in an operand.
+	asm.inField = true
+	defer func() { asm.inField = false }()
+
+	// Report broken constants at their definition even if they are never used.
+	names := make([]string, 0, len(asm.symbols))
+	for name := range asm.symbols {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		sym := asm.symbols[name]
+		if sym.imported {
+			continue
+		}
+		if _, err := asm.lookup(&exprSymbol{sym.pos, name}); err != nil {
+			asm.reportError(err)
+		}
+	}
+
+	for _, info := range asm.patches {
+		v, err := asm.eval(info.expr)
+		if err != nil {
+			asm.reportError(err)
+			continue
+		}
+
+		n := asm.fit(v, info.bits, info.expr.position()) << info.shift
+		if info.size == 1 {
+			*asm.byteAt(info.addr) |= byte(n)
+		} else {
+			*asm.byteAt(info.addr) |= byte(n >> 8)
+			*asm.byteAt(info.addr + 1) |= byte(n)
+		}
+	}
+}
@@ -0,0 +1,395 @@
+/*
+Copyright (C) 2016 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package asm
+
+import (
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// CHIPPER is case insensitive, all identifiers are lowercased by the lexer
+// so they match the native directives and registers.
+var chipperAliases = map[string]string{
+	"ifund": "ifndef",
+}
+
+func isChipperIdentStart(c byte) bool {
+	return c == '_' || unicode.IsLetter(rune(c))
+}
+
+func isChipperIdentChar(c byte) bool {
+	return isChipperIdentStart(c) || unicode.IsDigit(rune(c))
+}
+
+// lexChipperNumber reads decimal, #hex, $binary and @octal numbers. Binary
+// numbers may use '.' for zeros, as in sprite data.
+func lexChipperNumber(s string, col int) (token, error) {
+	var (
+		n   uint64
+		err error
+	)
+
+	switch s[0] {
+	case '#':
+		n, err = strconv.ParseUint(s[1:], 16, 32)
+	case '$':
+		n, err = strconv.ParseUint(strings.Replace(s[1:], ".", "0", -1), 2, 32)
+	case '@':
+		n, err = strconv.ParseUint(s[1:], 8, 32)
+	default:
+		n, err = strconv.ParseUint(s, 10, 32)
+	}
+
+	if err != nil {
+		if ne, ok := err.(*strconv.NumError); ok && ne.Err == strconv.ErrRange {
+			return token{}, syntaxErrorf(col, "number %s is too large", s)
+		}
+		return token{}, syntaxErrorf(col, "invalid number '%s'", s)
+	}
+	return token{tokNumber, s, int(n), col}, nil
+}
+
+// lexChipper splits a line of CHIPPER source into tokens. '[i]' is
+// returned as a single identifier.
+func lexChipper(line string) ([]token, error) {
+	var tokens []token
+
+	for i := 0; i < len(line); {
+		c := line[i]
+		col := i + 1
+
+		switch {
+		case c == ';':
+			return tokens, nil
+		case unicode.IsSpace(rune(c)):
+			i++
+		case isChipperIdentStart(c):
+			start := i
+			for i < len(line) && isChipperIdentChar(line[i]) {
+				i++
+			}
+
+			text := strings.ToLower(line[start:i])
+			if alias, ok := chipperAliases[text]; ok {
+				text = alias
+			}
+			tokens = append(tokens, token{tokIdent, text, 0, col})
+		case unicode.IsDigit(rune(c)) || (strings.IndexByte("#$@", c) >= 0 && i+1 < len(line) && (isChipperIdentChar(line[i+1]) || line[i+1] == '.')):
+			start := i
+			for i++; i < len(line) && (isChipperIdentChar(line[i]) || line[i] == '.'); i++ {
+			}
+
+			tok, err := lexChipperNumber(line[start:i], col)
+			if err != nil {
+				return tokens, err
+			}
+			tokens = append(tokens, tok)
+		case c == '\'' || c == '"':
+			var s []byte
+			for i++; ; i++ {
+				if i >= len(line) {
+					return tokens, syntaxErrorf(col, "unterminated string")
+				}
+				if line[i] == c {
+					// A doubled quote stands for the quote itself.
+					if i+1 < len(line) && line[i+1] == c {
+						i++
+					} else {
+						break
+					}
+				}
+				s = append(s, line[i])
+			}
+			tokens = append(tokens, token{tokString, string(s), 0, col})
+			i++
+		case strings.HasPrefix(strings.ToLower(line[i:]), "[i]"):
+			tokens = append(tokens, token{tokIdent, "[i]", 0, col})
+			i += 3
+		case strings.HasPrefix(line[i:], "<<") || strings.HasPrefix(line[i:], ">>"):
+			tokens = append(tokens, token{tokPunct, line[i : i+2], 0, col})
+			i += 2
+		case strings.IndexByte("+-*/&|~(),:=", c) >= 0:
+			tokens = append(tokens, token{tokPunct, line[i : i+1], 0, col})
+			i++
+		default:
+			return tokens, syntaxErrorf(col, "unexpected character '%c'", c)
+		}
+	}
+
+	return tokens, nil
+}
+
+// chipperOperand returns the name of a register or one of the special
+// operands of LD and ADD.
+func chipperOperand(e expr) string {
+	sym, ok := e.(*exprSymbol)
+	if !ok {
+		return ""
+	}
+
+	switch sym.name {
+	case "i", "[i]", "dt", "st", "k", "f", "hf", "b", "r":
+		return sym.name
+	}
+	if isRegister(sym.name) {
+		return "v"
+	}
+	return ""
+}
+
+// assembleChipper handles a line of CHIPPER source after any label.
+func (asm *assembler) assembleChipper(first token, p *parser) {
+	if next := p.peek(); next != nil && (next.text == "equ" || (next.kind == tokPunct && next.text == "=")) {
+		p.index++
+		if p.done() {
+			asm.errorf(p.endCol(), "'%s' expects an expression", next.text)
+			return
+		}
+		asm.saveConstant(first, p)
+		return
+	}
+
+	switch first.text {
+	case "db", "da":
+		asm.writeData(first, p, 1)
+	case "dw":
+		asm.writeData(first, p, 2)
+	case "ds":
+		asm.reserve(first, p)
+	case "org":
+		asm.layoutDirective(first, p)
+	case "include":
+		asm.include(first, p)
+	case "define":
+		name := p.peek()
+		if name == nil || name.kind != tokIdent || len(p.tokens)-p.index != 1 {
+			asm.errorf(first.col, "'define' expects a name")
+			return
+		}
+		asm.saveConstant(*name, &parser{})
+	case "undef":
+		name := p.peek()
+		if name == nil || name.kind != tokIdent || len(p.tokens)-p.index != 1 {
+			asm.errorf(first.col, "'undef' expects a name")
+			return
+		}
+		if sym, ok := asm.symbols[name.text]; ok && !sym.lable {
+			delete(asm.symbols, name.text)
+		}
+	case "align":
+		switch arg := p.peek(); {
+		case arg != nil && arg.text == "on" && len(p.tokens)-p.index == 1:
+			asm.noAlign = false
+		case arg != nil && arg.text == "off" && len(p.tokens)-p.index == 1:
+			asm.noAlign = true
+		default:
+			asm.errorf(first.col, "'align' expects ON or OFF")
+		}
+	case "option":
+		asm.chipperOption(first, p)
+	case "end", "xref":
+	default:
+		asm.writeChipperOpcode(first, p)
+	}
+}
+
+func (asm *assembler) chipperOption(directive token, p *parser) {
+	name := p.peek()
+	if name == nil || name.kind != tokIdent || len(p.tokens)-p.index != 1 {
+		asm.errorf(directive.col, "'option' expects an option name")
+		return
+	}
+
+	var target string
+	switch name.text {
+	case "chip8":
+		target = "chip8"
+	case "schip10", "schip11":
+		target = "schip"
+	case "binary":
+		return
+	case "string", "hpasc", "hphead":
+		asm.report(SeverityWarning, asm.pos(name.col), "option '%s' is ignored, the output is always binary", name.text)
+		return
+	default:
+		asm.errorf(name.col, "unknown option '%s'", name.text)
+		return
+	}
+
+	if len(asm.sections) > 0 {
+		asm.errorf(directive.col, "'option %s' must come before any code or data", name.text)
+		return
+	}
+	asm.platform = findPlatform(target)
+}
+
+var chipperMnemonics = map[string]bool{
+	"add": true, "and": true, "call": true, "cls": true, "drw": true, "exit": true, "high": true,
+	"jp": true, "ld": true, "low": true, "or": true, "ret": true, "rnd": true, "scd": true,
+	"scl": true, "scr": true, "se": true, "shl": true, "shr": true, "sknp": true, "skp": true,
+	"sne": true, "sub": true, "subn": true, "sys": true, "xor": true,
+}
+
+// chipperOpcode maps a CHIPPER instruction to the native mnemonic with the
+// same encoding. The operand kinds of LD, ADD, SE, SNE and JP select it.
+func chipperOpcode(mnemonic string, args []expr) (string, []expr) {
+	kinds := make([]string, len(args))
+	for i, e := range args {
+		kinds[i] = chipperOperand(e)
+	}
+	form := mnemonic + " " + strings.Join(kinds, ",")
+
+	switch mnemonic {
+	case "cls":
+		return "clr", args
+	case "ret":
+		return "rts", args
+	case "exit":
+		return "halt", args
+	case "low", "high", "call", "sys", "or", "and", "xor", "sub", "shr", "shl", "skp", "sknp":
+		return mnemonic, args
+	case "scd":
+		return "scr", args
+	case "scr":
+		return "scrr", args
+	case "scl":
+		return "scrl", args
+	case "drw":
+		return "draw", args
+	case "rnd":
+		return "rand", args
+	case "subn":
+		return "subr", args
+	case "jp":
+		if form == "jp v," {
+			if sym := args[0].(*exprSymbol); sym.name == "v0" {
+				return "jump0", args[1:]
+			}
+			return "", nil
+		}
+		return "jump", args
+	case "se", "sne":
+		if form == mnemonic+" v,v" {
+			return map[string]string{"se": "skre", "sne": "sknre"}[mnemonic], args
+		}
+		return map[string]string{"se": "ske", "sne": "skne"}[mnemonic], args
+	case "add":
+		switch form {
+		case "add v,v":
+			return "addr", args
+		case "add i,v":
+			return "addi", args[1:]
+		}
+		return "add", args
+	case "ld":
+		switch form {
+		case "ld v,v":
+			return "move", args
+		case "ld v,dt":
+			return "moved", args[:1]
+		case "ld v,k":
+			return "keyd", args[:1]
+		case "ld v,[i]":
+			return "read", args[:1]
+		case "ld v,r":
+			return "readf", args[:1]
+		case "ld dt,v":
+			return "loadd", args[1:]
+		case "ld st,v":
+			return "loads", args[1:]
+		case "ld f,v":
+			return "ldspr", args[1:]
+		case "ld hf,v":
+			return "ldhspr", args[1:]
+		case "ld b,v":
+			return "bcd", args[1:]
+		case "ld [i],v":
+			return "stor", args[1:]
+		case "ld r,v":
+			return "storf", args[1:]
+		}
+		if len(args) == 2 && kinds[0] == "i" && kinds[1] == "" {
+			return "loadi", args[1:]
+		}
+		if len(args) == 2 && kinds[0] == "v" && kinds[1] == "" {
+			return "load", args
+		}
+		return "", nil
+	}
+	return "", nil
+}
+
+// alignInstruction pads instructions to even addresses unless 'ALIGN OFF'
+// is in effect. Labels defined right before the padding are moved along.
+func (asm *assembler) alignInstruction() {
+	if asm.noAlign || asm.addr%2 == 0 {
+		return
+	}
+
+	lables := asm.unaligned
+	asm.writeUint8(0)
+	for _, sym := range lables {
+		sym.value++
+	}
+}
+
+func (asm *assembler) writeChipperOpcode(mnemonic token, p *parser) {
+	if !chipperMnemonics[mnemonic.text] {
+		asm.errorf(mnemonic.col, "unknown mnemonic '%s'", mnemonic.text)
+		asm.skipOpcode()
+		return
+	}
+
+	args, err := p.parseOperands()
+	if err != nil {
+		asm.reportError(err)
+		asm.skipOpcode()
+		return
+	}
+
+	asm.alignInstruction()
+
+	switch mnemonic.text {
+	case "shr", "shl":
+		// The second register is optional and defaults to v0.
+		if len(args) == 1 {
+			break
+		}
+
+		inst := uint16(0x8006)
+		if mnemonic.text == "shl" {
+			inst = 0x800E
+		}
+		if asm.checkLen(mnemonic, args, 2) {
+			inst |= asm.register(args[0])<<8 | asm.register(args[1])<<4
+		}
+		asm.writeUint16(inst)
+		return
+	}
+
+	name, native := chipperOpcode(mnemonic.text, args)
+	if name == "" {
+		asm.errorf(mnemonic.col, "invalid operands for '%s'", mnemonic.text)
+		asm.skipOpcode()
+		return
+	}
+
+	asm.checkFeature(mnemonicFeatures[name], mnemonic)
+	asm.encodeOpcode(name, mnemonic, native)
+}
@@ -0,0 +1,132 @@
+/*
+Copyright (C) 2016 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package asm
+
+type conditional struct {
+	pos      position
+	active   bool
+	taken    bool
+	seenElse bool
+	skipped  bool
+	blocks   int
+}
+
+func (asm *assembler) skipping() bool {
+	n := len(asm.conds)
+	return n > 0 && !asm.conds[n-1].active
+}
+
+func (asm *assembler) evalCondition(directive token, p *parser) bool {
+	if p.done() {
+		asm.errorf(directive.col, "'%s' expects an expression", directive.text)
+		return false
+	}
+
+	if directive.text == "ifdef" || directive.text == "ifndef" {
+		name := p.peek()
+		if name.kind != tokIdent || len(p.tokens)-p.index != 1 {
+			asm.errorf(name.col, "'%s' expects a symbol name", directive.text)
+			return false
+		}
+
+		_, ok := asm.symbols[name.text]
+		if _, isMacro := asm.macros[name.text]; isMacro {
+			ok = true
+		}
+		return ok == (directive.text == "ifdef")
+	}
+
+	e, err := p.parseExpr()
+	if err != nil {
+		asm.reportError(err)
+		return false
+	}
+	if !p.done() {
+		asm.errorf(p.peek().col, "unexpected '%s' after expression", p.peek().text)
+		return false
+	}
+
+	v, err := asm.eval(e)
+	if err != nil {
+		if ue, ok := err.(*undefinedError); ok {
+			asm.report(SeverityError, ue.pos, "condition uses '%s' before it is defined", ue.name)
+		} else {
+			asm.reportError(err)
+		}
+		return false
+	}
+	return v != 0
+}
+
+// conditional handles if/ifdef/ifndef/else/endif and reports whether the
+// line was consumed, either as a directive or because it is skipped.
+func (asm *assembler) conditional(p *parser) bool {
+	first := p.peek()
+	if first.kind != tokIdent {
+		return asm.skipping()
+	}
+
+	// 'if ... then' and 'else' may also belong to control flow blocks.
+	if kw := asm.blockKeyword(p.tokens); kw != "" {
+		if asm.skipping() {
+			if asm.skipBlock(kw) {
+				return true
+			}
+		} else if kw != "else" || asm.inBlock() {
+			return false
+		}
+	}
+
+	switch first.text {
+	case "if", "ifdef", "ifndef":
+		p.index++
+		cond := conditional{pos: asm.pos(first.col)}
+		if asm.skipping() {
+			cond.skipped = true
+		} else {
+			cond.active = asm.evalCondition(*first, p)
+			cond.taken = cond.active
+		}
+		asm.conds = append(asm.conds, cond)
+	case "else", "endif":
+		n := len(asm.conds)
+		if n == 0 {
+			asm.errorf(first.col, "'%s' without 'if'", first.text)
+			return true
+		}
+		if len(p.tokens) > p.index+1 {
+			asm.errorf(p.tokens[p.index+1].col, "unexpected '%s' after '%s'", p.tokens[p.index+1].text, first.text)
+		}
+
+		if first.text == "endif" {
+			asm.conds = asm.conds[:n-1]
+			return true
+		}
+
+		cond := &asm.conds[n-1]
+		if cond.seenElse {
+			asm.errorf(first.col, "duplicate 'else', 'if' at %v", cond.pos)
+		}
+		cond.seenElse = true
+		cond.active = !cond.skipped && !cond.taken
+		cond.taken = true
+	default:
+		return asm.skipping()
+	}
+	return true
+}
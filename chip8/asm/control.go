@@ -0,0 +1,247 @@
+/*
+Copyright (C) 2016 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package asm
+
+import "fmt"
+
+// block is an open 'if ... then' or 'loop' block. numConds is the
+// conditional assembly depth it was opened at, it tells an 'else' of the
+// block apart from an 'else' of conditional assembly.
+type block struct {
+	kind     string
+	id       int
+	pos      position
+	seenElse bool
+	numConds int
+}
+
+// Generated labels start with '$' so they can not clash with user symbols.
+func (b *block) lable(suffix string) string {
+	return fmt.Sprintf("$%s%d%s", b.kind, b.id, suffix)
+}
+
+// blockKeyword returns the control flow keyword starting a line, if any.
+// 'if' only counts when the line ends with 'then'.
+func (asm *assembler) blockKeyword(tokens []token) string {
+	if asm.chipper {
+		return ""
+	}
+	if len(tokens) > 1 && tokens[0].kind == tokIdent && tokens[1].kind == tokPunct && tokens[1].text == ":" {
+		tokens = tokens[2:]
+	}
+	if len(tokens) == 0 || tokens[0].kind != tokIdent {
+		return ""
+	}
+
+	switch kw := tokens[0].text; kw {
+	case "if":
+		if last := tokens[len(tokens)-1]; last.kind == tokIdent && last.text == "then" {
+			return kw
+		}
+	case "else", "end", "loop", "again":
+		return kw
+	}
+	return ""
+}
+
+// skipBlock tracks blocks in code skipped by conditional assembly and
+// reports whether the line belongs to one of them.
+func (asm *assembler) skipBlock(kw string) bool {
+	cond := &asm.conds[len(asm.conds)-1]
+	switch kw {
+	case "if", "loop":
+		cond.blocks++
+	case "end", "again":
+		if cond.blocks > 0 {
+			cond.blocks--
+		}
+	case "else":
+		return cond.blocks > 0
+	}
+	return true
+}
+
+// inBlock reports whether a control flow block is the innermost open block.
+func (asm *assembler) inBlock() bool {
+	n := len(asm.blocks)
+	return n > 0 && asm.blocks[n-1].numConds == len(asm.conds)
+}
+
+func (asm *assembler) defineBlockLable(name string, col int) {
+	asm.define(name, asm.pos(col), &symbol{value: asm.addr, resolved: true, reloc: !asm.absolute})
+}
+
+func (asm *assembler) writeJump(col int, target string) {
+	asm.writeOpcode(token{tokIdent, "jump", 0, col}, []expr{&exprSymbol{asm.pos(col), target}})
+}
+
+// parseCondition reads 'vx == n', 'vx != n', 'vx == vy', 'vx != vy',
+// 'key vx' or '!key vx' and returns the skip instruction that skips the
+// next instruction when the condition holds.
+func (asm *assembler) parseCondition(p *parser) (string, []expr, error) {
+	if p.done() {
+		return "", nil, syntaxErrorf(p.endCol(), "expected condition")
+	}
+
+	if tok := p.peek(); tok.kind == tokIdent && tok.text == "key" || tok.kind == tokPunct && tok.text == "!" {
+		mnemonic := "skp"
+		if tok.text == "!" {
+			p.index++
+			if key := p.peek(); key == nil || key.kind != tokIdent || key.text != "key" {
+				return "", nil, syntaxErrorf(tok.col, "expected 'key' after '!'")
+			}
+			mnemonic = "sknp"
+		}
+		p.index++
+
+		x, err := p.parseExpr()
+		if err != nil {
+			return "", nil, err
+		}
+		return mnemonic, []expr{x}, nil
+	}
+
+	x, err := p.parseExpr()
+	if err != nil {
+		return "", nil, err
+	}
+
+	op := p.peek()
+	if op == nil || op.kind != tokPunct || (op.text != "==" && op.text != "!=") {
+		if op == nil {
+			return "", nil, syntaxErrorf(p.endCol(), "expected '==' or '!='")
+		}
+		return "", nil, syntaxErrorf(op.col, "expected '==' or '!=', got '%s'", op.text)
+	}
+	p.index++
+
+	y, err := p.parseExpr()
+	if err != nil {
+		return "", nil, err
+	}
+	if !p.done() {
+		return "", nil, syntaxErrorf(p.peek().col, "unexpected '%s' after condition", p.peek().text)
+	}
+
+	_, isReg := registerOf(y)
+	switch {
+	case op.text == "==" && isReg:
+		return "skre", []expr{x, y}, nil
+	case op.text == "==":
+		return "ske", []expr{x, y}, nil
+	case isReg:
+		return "sknre", []expr{x, y}, nil
+	default:
+		return "skne", []expr{x, y}, nil
+	}
+}
+
+// writeCondition writes a skip over a jump to target that is taken when
+// the condition on the rest of the line does not hold.
+func (asm *assembler) writeCondition(kw token, p *parser, target string) {
+	mnemonic, args, err := asm.parseCondition(p)
+	if err != nil {
+		asm.reportError(err)
+		asm.skipOpcode()
+	} else {
+		asm.writeOpcode(token{tokIdent, mnemonic, 0, kw.col}, args)
+	}
+	asm.writeJump(kw.col, target)
+}
+
+// controlFlow expands if/else/end and loop/while/again blocks into skip
+// instructions and jumps to generated labels and reports whether kw was
+// one of them.
+func (asm *assembler) controlFlow(kw token, p *parser) bool {
+	var top *block
+	if n := len(asm.blocks); n > 0 {
+		top = &asm.blocks[n-1]
+	}
+
+	switch kw.text {
+	case "if":
+		if asm.blockKeyword(p.tokens[p.index-1:]) != "if" {
+			return false
+		}
+
+		asm.numBlocks++
+		b := block{kind: "if", id: asm.numBlocks, pos: asm.pos(kw.col), numConds: len(asm.conds)}
+		asm.blocks = append(asm.blocks, b)
+
+		cond := &parser{file: p.file, line: p.line, tokens: p.tokens[p.index : len(p.tokens)-1]}
+		asm.writeCondition(kw, cond, b.lable(".else"))
+	case "else":
+		if top == nil || top.kind != "if" {
+			asm.errorf(kw.col, "'else' without 'if'")
+			return true
+		}
+		if top.seenElse {
+			asm.errorf(kw.col, "duplicate 'else', 'if' at %v", top.pos)
+			return true
+		}
+
+		top.seenElse = true
+		asm.writeJump(kw.col, top.lable(".end"))
+		asm.defineBlockLable(top.lable(".else"), kw.col)
+	case "end":
+		if top == nil || top.kind != "if" {
+			asm.errorf(kw.col, "'end' without 'if'")
+			return true
+		}
+
+		if !top.seenElse {
+			asm.defineBlockLable(top.lable(".else"), kw.col)
+		}
+		asm.defineBlockLable(top.lable(".end"), kw.col)
+		asm.blocks = asm.blocks[:len(asm.blocks)-1]
+	case "loop":
+		asm.numBlocks++
+		b := block{kind: "loop", id: asm.numBlocks, pos: asm.pos(kw.col), numConds: len(asm.conds)}
+		asm.blocks = append(asm.blocks, b)
+		asm.defineBlockLable(b.lable(""), kw.col)
+	case "while":
+		var loop *block
+		for i := len(asm.blocks) - 1; i >= 0; i-- {
+			if asm.blocks[i].kind == "loop" {
+				loop = &asm.blocks[i]
+				break
+			}
+		}
+		if loop == nil {
+			asm.errorf(kw.col, "'while' without 'loop'")
+			return true
+		}
+		asm.writeCondition(kw, p, loop.lable(".end"))
+	case "again":
+		if top == nil || top.kind != "loop" {
+			asm.errorf(kw.col, "'again' without 'loop'")
+			return true
+		}
+
+		asm.writeJump(kw.col, top.lable(""))
+		asm.defineBlockLable(top.lable(".end"), kw.col)
+		asm.blocks = asm.blocks[:len(asm.blocks)-1]
+	default:
+		return false
+	}
+
+	if kw.text != "if" && kw.text != "while" && !p.done() {
+		asm.errorf(p.peek().col, "unexpected '%s' after '%s'", p.peek().text, kw.text)
+	}
+	return true
+}
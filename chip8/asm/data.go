@@ -0,0 +1,197 @@
+/*
+Copyright (C) 2016 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package asm
+
+import "strings"
+
+type dataItem struct {
+	str  *token
+	expr expr
+}
+
+// dataItems reads a list of expressions and strings separated by
+// whitespace or an optional comma.
+func (p *parser) dataItems() ([]dataItem, error) {
+	var items []dataItem
+	for !p.done() {
+		if tok := p.peek(); tok.kind == tokString {
+			p.index++
+			items = append(items, dataItem{str: tok})
+		} else {
+			x, err := p.parseExpr()
+			if err != nil {
+				return nil, err
+			}
+			items = append(items, dataItem{expr: x})
+		}
+
+		if p.peekPunct(",") {
+			p.index++
+			if p.done() {
+				return nil, syntaxErrorf(p.endCol(), "expected expression after ','")
+			}
+		}
+	}
+	return items, nil
+}
+
+func (asm *assembler) mapChar(c rune, col int) int {
+	if asm.charmap == nil {
+		if c > 0xFF {
+			asm.errorf(col, "character '%c' does not fit in a byte", c)
+			return 0
+		}
+		return int(c)
+	}
+
+	v, ok := asm.charmap[c]
+	if !ok {
+		asm.errorf(col, "character '%c' is not in the charmap", c)
+	}
+	return v
+}
+
+// writeData handles the '.' (byte) and '..' (word) directives, size is the
+// number of bytes per item.
+func (asm *assembler) writeData(directive token, p *parser, size int) {
+	items, err := p.dataItems()
+	if err != nil {
+		asm.reportError(err)
+		return
+	}
+	if len(items) == 0 {
+		asm.errorf(directive.col, "'%s' expects at least 1 operand", directive.text)
+		return
+	}
+
+	bits := uint(8 * size)
+
+	write := func(n uint16) {
+		if size == 1 {
+			asm.writeUint8(byte(n))
+		} else {
+			asm.writeUint16(n)
+		}
+	}
+
+	for _, item := range items {
+		if item.str == nil {
+			write(asm.immediate(item.expr, bits, size))
+			continue
+		}
+
+		for _, c := range item.str.text {
+			v := asm.mapChar(c, item.str.col)
+			write(asm.fit(v, bits, asm.pos(item.str.col)))
+		}
+	}
+}
+
+// defineCharmap handles 'charmap "chars" [, start [, step]]'. The n:th
+// character of the string is stored as start + n * step by '.' and '..'.
+func (asm *assembler) defineCharmap(directive token, p *parser) {
+	items, err := p.dataItems()
+	if err != nil {
+		asm.reportError(err)
+		return
+	}
+
+	if len(items) == 0 {
+		asm.charmap = nil
+		return
+	}
+	if items[0].str == nil || len(items) > 3 {
+		asm.errorf(directive.col, "'charmap' expects a string, start and step")
+		return
+	}
+
+	params := []int{0, 1}
+	for i, item := range items[1:] {
+		if item.str != nil {
+			asm.errorf(item.str.col, "expected expression, got string")
+			return
+		}
+
+		v, err := asm.eval(item.expr)
+		if err != nil {
+			asm.reportError(err)
+			return
+		}
+		params[i] = v
+	}
+
+	asm.charmap = make(map[rune]int)
+	n := 0
+	for _, c := range items[0].str.text {
+		asm.charmap[c] = params[0] + n*params[1]
+		n++
+	}
+}
+
+// writeSprite handles the 'sprite' directive. Every string is one row of
+// 8 or 16 pixels where '#', 'X', '*' and '1' are set and '.', '_', '0'
+// and ' ' are clear.
+func (asm *assembler) writeSprite(directive token, p *parser) {
+	width := 0
+	for !p.done() {
+		tok := p.peek()
+		if tok.kind != tokString {
+			asm.errorf(tok.col, "expected sprite row in quotes, got '%s'", tok.text)
+			return
+		}
+		p.index++
+
+		row := tok.text
+		if len(row) != 8 && len(row) != 16 {
+			asm.errorf(tok.col, "sprite row must be 8 or 16 pixels wide, got %d", len(row))
+			return
+		}
+		if width != 0 && len(row) != width {
+			asm.errorf(tok.col, "sprite row is %d pixels wide, expected %d", len(row), width)
+			return
+		}
+		width = len(row)
+
+		var bits uint16
+		for i, c := range row {
+			bits <<= 1
+			switch {
+			case strings.ContainsRune("#X*1", c):
+				bits |= 1
+			case strings.ContainsRune("._0 ", c):
+			default:
+				asm.errorf(tok.col+1+i, "invalid sprite pixel '%c'", c)
+				return
+			}
+		}
+
+		if width == 8 {
+			asm.writeUint8(byte(bits))
+		} else {
+			asm.writeUint16(bits)
+		}
+
+		if p.peekPunct(",") {
+			p.index++
+		}
+	}
+
+	if width == 0 {
+		asm.errorf(directive.col, "'sprite' expects at least 1 row")
+	}
+}
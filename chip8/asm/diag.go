@@ -0,0 +1,94 @@
+/*
+Copyright (C) 2016 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package asm
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+)
+
+// Diagnostic severities.
+const (
+	SeverityError   = "error"
+	SeverityWarning = "warning"
+)
+
+type (
+	position struct {
+		file      string
+		line, col int
+	}
+
+	// Diagnostic is an error or warning at a position in the source.
+	Diagnostic struct {
+		File     string `json:"file"`
+		Line     int    `json:"line"`
+		Column   int    `json:"column"`
+		Severity string `json:"severity"`
+		Message  string `json:"message"`
+	}
+)
+
+func (pos position) String() string {
+	return fmt.Sprintf("%s:%d:%d", pos.file, pos.line, pos.col)
+}
+
+func (d Diagnostic) String() string {
+	return fmt.Sprintf("%s:%d:%d: %s: %s", d.File, d.Line, d.Column, d.Severity, d.Message)
+}
+
+// sortDiagnostics orders diags by file, line and column. Problems found
+// after the source is read, like undefined symbols, are reported last.
+func sortDiagnostics(diags []Diagnostic) {
+	sort.SliceStable(diags, func(i, j int) bool {
+		a, b := diags[i], diags[j]
+		switch {
+		case a.File != b.File:
+			return a.File < b.File
+		case a.Line != b.Line:
+			return a.Line < b.Line
+		}
+		return a.Column < b.Column
+	})
+}
+
+// WriteDiagnostics writes diags in format, either "gcc" for one
+// 'file:line:col: severity: message' line per diagnostic or "json" for an
+// array of objects.
+func WriteDiagnostics(writer io.Writer, format string, diags []Diagnostic) error {
+	switch format {
+	case "gcc":
+		for _, d := range diags {
+			if _, err := fmt.Fprintln(writer, d); err != nil {
+				return err
+			}
+		}
+		return nil
+	case "json":
+		if diags == nil {
+			diags = []Diagnostic{}
+		}
+		enc := json.NewEncoder(writer)
+		enc.SetIndent("", "  ")
+		return enc.Encode(diags)
+	default:
+		return fmt.Errorf("unknown diagnostics format '%s'", format)
+	}
+}
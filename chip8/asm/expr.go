@@ -0,0 +1,333 @@
+/*
+Copyright (C) 2016 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package asm
+
+import "fmt"
+
+type (
+	expr interface {
+		position() position
+	}
+
+	exprNumber struct {
+		pos   position
+		value int
+	}
+
+	exprSymbol struct {
+		pos  position
+		name string
+	}
+
+	exprUnary struct {
+		pos position
+		op  string
+		x   expr
+	}
+
+	exprBinary struct {
+		pos  position
+		op   string
+		x, y expr
+	}
+
+	exprCall struct {
+		pos position
+		fn  string
+		arg expr
+	}
+
+	parser struct {
+		file   string
+		line   int
+		tokens []token
+		index  int
+	}
+
+	undefinedError struct {
+		pos  position
+		name string
+	}
+
+	evalError struct {
+		pos position
+		msg string
+	}
+)
+
+var binaryPrecedence = map[string]int{
+	"|":  1,
+	"&":  2,
+	"<<": 3,
+	">>": 3,
+	"+":  4,
+	"-":  4,
+	"*":  5,
+	"/":  5,
+}
+
+func (e *exprNumber) position() position { return e.pos }
+func (e *exprSymbol) position() position { return e.pos }
+func (e *exprUnary) position() position  { return e.pos }
+func (e *exprBinary) position() position { return e.pos }
+func (e *exprCall) position() position   { return e.pos }
+
+func (err *undefinedError) Error() string {
+	return fmt.Sprintf("undefined symbol '%s'", err.name)
+}
+
+func (err *evalError) Error() string {
+	return err.msg
+}
+
+func registerOf(e expr) (string, bool) {
+	if sym, ok := e.(*exprSymbol); ok && isRegister(sym.name) {
+		return sym.name, true
+	}
+	return "", false
+}
+
+func (p *parser) pos(col int) position {
+	return position{p.file, p.line, col}
+}
+
+func (p *parser) done() bool {
+	return p.index >= len(p.tokens)
+}
+
+func (p *parser) peek() *token {
+	if p.done() {
+		return nil
+	}
+	return &p.tokens[p.index]
+}
+
+func (p *parser) peekPunct(s string) bool {
+	tok := p.peek()
+	return tok != nil && tok.kind == tokPunct && tok.text == s
+}
+
+func (p *parser) endCol() int {
+	if n := len(p.tokens); n > 0 {
+		last := p.tokens[n-1]
+		return last.col + len(last.text)
+	}
+	return 1
+}
+
+func (p *parser) expect(s string) error {
+	if !p.peekPunct(s) {
+		if tok := p.peek(); tok != nil {
+			return syntaxErrorf(tok.col, "expected '%s', got '%s'", s, tok.text)
+		}
+		return syntaxErrorf(p.endCol(), "expected '%s'", s)
+	}
+	p.index++
+	return nil
+}
+
+func (p *parser) parsePrimary() (expr, error) {
+	tok := p.peek()
+	if tok == nil {
+		return nil, syntaxErrorf(p.endCol(), "expected expression")
+	}
+	p.index++
+
+	switch tok.kind {
+	case tokNumber:
+		return &exprNumber{p.pos(tok.col), tok.value}, nil
+	case tokIdent:
+		if (tok.text == "lo" || tok.text == "hi") && p.peekPunct("(") {
+			p.index++
+			arg, err := p.parseExpr()
+			if err != nil {
+				return nil, err
+			}
+			if err := p.expect(")"); err != nil {
+				return nil, err
+			}
+			return &exprCall{p.pos(tok.col), tok.text, arg}, nil
+		}
+		return &exprSymbol{p.pos(tok.col), tok.text}, nil
+	case tokPunct:
+		switch tok.text {
+		case "(":
+			x, err := p.parseExpr()
+			if err != nil {
+				return nil, err
+			}
+			if err := p.expect(")"); err != nil {
+				return nil, err
+			}
+			return x, nil
+		case "-", "~":
+			x, err := p.parsePrimary()
+			if err != nil {
+				return nil, err
+			}
+			return &exprUnary{p.pos(tok.col), tok.text, x}, nil
+		}
+	case tokString:
+		return nil, syntaxErrorf(tok.col, "unexpected string in expression")
+	}
+
+	return nil, syntaxErrorf(tok.col, "unexpected '%s' in expression", tok.text)
+}
+
+func (p *parser) parseBinary(minPrec int) (expr, error) {
+	x, err := p.parsePrimary()
+	if err != nil {
+		return nil, err
+	}
+
+	// Registers never take part in arithmetic, so 'add v0 -1' is two operands.
+	if _, ok := registerOf(x); ok {
+		return x, nil
+	}
+
+	for {
+		tok := p.peek()
+		if tok == nil || tok.kind != tokPunct {
+			return x, nil
+		}
+
+		prec, ok := binaryPrecedence[tok.text]
+		if !ok || prec < minPrec {
+			return x, nil
+		}
+		p.index++
+
+		y, err := p.parseBinary(prec + 1)
+		if err != nil {
+			return nil, err
+		}
+		x = &exprBinary{p.pos(tok.col), tok.text, x, y}
+	}
+}
+
+func (p *parser) parseExpr() (expr, error) {
+	return p.parseBinary(1)
+}
+
+// operands reads the rest of the line as a list of expressions and calls fn
+// with each one and the tokens making it up. Operands are separated by
+// whitespace or an optional comma.
+func (p *parser) operands(fn func(x expr, tokens []token)) error {
+	for !p.done() {
+		start := p.index
+		x, err := p.parseExpr()
+		if err != nil {
+			return err
+		}
+		fn(x, p.tokens[start:p.index])
+
+		if p.peekPunct(",") {
+			p.index++
+			if p.done() {
+				return syntaxErrorf(p.endCol(), "expected expression after ','")
+			}
+		}
+	}
+	return nil
+}
+
+func (p *parser) parseOperands() ([]expr, error) {
+	var operands []expr
+	err := p.operands(func(x expr, _ []token) {
+		operands = append(operands, x)
+	})
+	return operands, err
+}
+
+func (p *parser) splitOperands() ([][]token, error) {
+	var operands [][]token
+	err := p.operands(func(_ expr, tokens []token) {
+		operands = append(operands, tokens)
+	})
+	return operands, err
+}
+
+func (asm *assembler) eval(e expr) (int, error) {
+	switch e := e.(type) {
+	case *exprNumber:
+		return e.value, nil
+	case *exprSymbol:
+		if isRegister(e.name) {
+			return 0, &evalError{e.pos, fmt.Sprintf("register %s used in expression", e.name)}
+		}
+		asm.refs[e.pos] = e.name
+		return asm.lookup(e)
+	case *exprInst:
+		return asm.instAddr(e)
+	case *exprUnary:
+		x, err := asm.eval(e.x)
+		if err != nil {
+			return 0, err
+		}
+		if e.op == "-" {
+			return -x, nil
+		}
+		return ^x, nil
+	case *exprCall:
+		x, err := asm.eval(e.arg)
+		if err != nil {
+			return 0, err
+		}
+		if e.fn == "hi" {
+			return (x >> 8) & 0xFF, nil
+		}
+		return x & 0xFF, nil
+	case *exprBinary:
+		x, err := asm.eval(e.x)
+		if err != nil {
+			return 0, err
+		}
+		y, err := asm.eval(e.y)
+		if err != nil {
+			return 0, err
+		}
+
+		switch e.op {
+		case "+":
+			return x + y, nil
+		case "-":
+			return x - y, nil
+		case "*":
+			return x * y, nil
+		case "/":
+			if y == 0 {
+				return 0, &evalError{e.pos, "division by zero"}
+			}
+			return x / y, nil
+		case "&":
+			return x & y, nil
+		case "|":
+			return x | y, nil
+		case "<<", ">>":
+			if y < 0 || y > 31 {
+				return 0, &evalError{e.pos, fmt.Sprintf("invalid shift count %d", y)}
+			}
+			if e.op == "<<" {
+				return x << uint(y), nil
+			}
+			return x >> uint(y), nil
+		}
+	}
+
+	panic(nil)
+}
@@ -0,0 +1,238 @@
+/*
+Copyright (C) 2016 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package asm
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+)
+
+const (
+	formatIndent        = "    "
+	formatMnemonicWidth = 8
+	formatCommentColumn = 24
+)
+
+type formatLine struct {
+	code, comment string
+}
+
+// Format formats assembler source in the canonical style. Labels,
+// constants, macros and conditional assembly start in the first column,
+// code is indented one level plus one for every enclosing control flow
+// block, mnemonics are padded to a column and trailing comments in
+// consecutive lines are aligned. Hex numbers are written in upper case
+// while the operands of data directives are left as written. Only the
+// native syntax is supported.
+func Format(src []byte) ([]byte, error) {
+	var (
+		lines  []formatLine
+		blocks []string
+	)
+
+	text := strings.Replace(string(src), "\r\n", "\n", -1)
+	for n, line := range strings.Split(text, "\n") {
+		code, comment := splitComment(line)
+		tokens, err := lex(code)
+		if err != nil {
+			if serr, ok := err.(*syntaxError); ok {
+				return nil, fmt.Errorf("%d:%d: %s", n+1, serr.col, serr.msg)
+			}
+			return nil, fmt.Errorf("%d: %v", n+1, err)
+		}
+
+		if len(tokens) == 0 {
+			if comment == "" {
+				lines = append(lines, formatLine{})
+			} else if strings.TrimSpace(line)[0] == ';' && line[0] != ';' {
+				lines = append(lines, formatLine{code: indentation(blocks), comment: comment})
+			} else {
+				lines = append(lines, formatLine{comment: comment})
+			}
+			continue
+		}
+
+		if len(tokens) > 1 && tokens[0].kind == tokIdent && tokens[1].text == ":" {
+			if len(tokens) == 2 {
+				lines = append(lines, formatLine{tokens[0].text + ":", trailingComment(comment)})
+				continue
+			}
+			lines = append(lines, formatLine{code: tokens[0].text + ":"})
+			tokens = tokens[2:]
+		}
+
+		var stmt string
+		stmt, blocks = formatStatement(code, tokens, blocks)
+		lines = append(lines, formatLine{stmt, trailingComment(comment)})
+	}
+
+	for len(lines) > 0 && lines[len(lines)-1] == (formatLine{}) {
+		lines = lines[:len(lines)-1]
+	}
+
+	var buf bytes.Buffer
+	for i := 0; i < len(lines); {
+		line := lines[i]
+		if line == (formatLine{}) {
+			if i == 0 || lines[i-1] != (formatLine{}) {
+				buf.WriteByte('\n')
+			}
+			i++
+			continue
+		}
+		if line.code == "" || line.comment == "" || strings.TrimSpace(line.code) == "" {
+			buf.WriteString(line.code + line.comment + "\n")
+			i++
+			continue
+		}
+
+		// Align the trailing comments of consecutive lines.
+		end, column := i, formatCommentColumn
+		for ; end < len(lines) && lines[end].comment != "" && strings.TrimSpace(lines[end].code) != ""; end++ {
+			if n := len(lines[end].code) + 2; n > column {
+				column = n
+			}
+		}
+		for ; i < end; i++ {
+			line := lines[i]
+			buf.WriteString(line.code + strings.Repeat(" ", column-len(line.code)) + line.comment + "\n")
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+// formatStatement formats a line without label and comment and returns it
+// with the updated stack of open blocks.
+func formatStatement(code string, tokens []token, blocks []string) (string, []string) {
+	first := tokens[0].text
+	last := tokens[len(tokens)-1].text
+	operands := formatOperands(code, tokens[1:])
+
+	switch first {
+	case "macro", "endm", "define", "include", "ifdef", "ifndef", "endif":
+		if first == "ifdef" || first == "ifndef" {
+			blocks = append(blocks, "cond")
+		} else if first == "endif" && len(blocks) > 0 {
+			blocks = blocks[:len(blocks)-1]
+		}
+		return joinOperands(first, operands), blocks
+	case "if":
+		if last == "then" {
+			s := indentation(blocks) + joinOperands(first, operands)
+			return s, append(blocks, "if")
+		}
+		return joinOperands(first, operands), append(blocks, "cond")
+	case "loop":
+		s := indentation(blocks) + joinOperands(first, operands)
+		return s, append(blocks, "loop")
+	case "else":
+		if len(blocks) > 0 && blocks[len(blocks)-1] == "if" {
+			return indentation(blocks[:len(blocks)-1]) + joinOperands(first, operands), blocks
+		}
+		return joinOperands(first, operands), blocks
+	case "end", "again":
+		if len(blocks) > 0 {
+			blocks = blocks[:len(blocks)-1]
+		}
+		return indentation(blocks) + joinOperands(first, operands), blocks
+	case "while":
+		return indentation(blocks) + joinOperands(first, operands), blocks
+	}
+
+	if len(tokens) > 1 && tokens[1].kind == tokIdent && tokens[1].text == "equ" {
+		return first + " " + formatOperands(code, tokens[1:]), blocks
+	}
+
+	switch first {
+	case ".", "..", "sprite":
+		operands = strings.TrimSpace(code[tokens[0].col-1+len(first):])
+	}
+	if operands == "" {
+		return indentation(blocks) + first, blocks
+	}
+	return indentation(blocks) + fmt.Sprintf("%-*s", formatMnemonicWidth-1, first) + " " + operands, blocks
+}
+
+// formatOperands joins tokens with single spaces where the source had
+// whitespace, and a space after every comma.
+func formatOperands(code string, tokens []token) string {
+	var (
+		buf   bytes.Buffer
+		space bool
+	)
+	for i, tok := range tokens {
+		end := len(code)
+		if i+1 < len(tokens) {
+			end = tokens[i+1].col - 1
+		}
+		raw := strings.TrimRight(code[tok.col-1:end], " \t")
+
+		if i > 0 && tok.text != "," && (space || tokens[i-1].text == ",") {
+			buf.WriteByte(' ')
+		}
+		space = len(raw) < end-tok.col+1
+		if tok.kind == tokNumber && raw[0] == '$' {
+			raw = "$" + strings.ToUpper(raw[1:])
+		}
+		buf.WriteString(raw)
+	}
+	return buf.String()
+}
+
+func joinOperands(first, operands string) string {
+	if operands == "" {
+		return first
+	}
+	return first + " " + operands
+}
+
+func indentation(blocks []string) string {
+	depth := 1
+	for _, b := range blocks {
+		if b != "cond" {
+			depth++
+		}
+	}
+	return strings.Repeat(formatIndent, depth)
+}
+
+// splitComment splits line at the first ';' outside of a string.
+func splitComment(line string) (string, string) {
+	for i := 0; i < len(line); i++ {
+		switch line[i] {
+		case '"':
+			for i++; i < len(line) && line[i] != '"'; i++ {
+				if line[i] == '\\' {
+					i++
+				}
+			}
+		case ';':
+			return line[:i], strings.TrimRight(line[i:], " \t")
+		}
+	}
+	return line, ""
+}
+
+// trailingComment puts a space between ';' and the text of a comment.
+func trailingComment(comment string) string {
+	if len(comment) > 1 && comment[1] != ' ' && comment[1] != '\t' && comment[1] != ';' {
+		return "; " + comment[1:]
+	}
+	return comment
+}
@@ -0,0 +1,187 @@
+/*
+Copyright (C) 2016 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package asm
+
+import (
+	"bufio"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+const maxIncludeDepth = 16
+
+// assembleFile assembles all lines of fileName as if they were part of the
+// current source. Blocks opened in a file must be closed in the same file.
+func (asm *assembler) assembleFile(fileName string) error {
+	fp, err := os.Open(fileName)
+	if err != nil {
+		return err
+	}
+	defer fp.Close()
+	return asm.assembleReader(fileName, fp)
+}
+
+// assembleReader assembles the lines read from reader as the file fileName.
+func (asm *assembler) assembleReader(fileName string, reader io.Reader) error {
+	file, line, numConds, numBlocks := asm.file, asm.line, len(asm.conds), len(asm.blocks)
+	asm.file = fileName
+	asm.files = append(asm.files, fileName)
+
+	scanner := bufio.NewScanner(reader)
+	for asm.line = 1; scanner.Scan(); asm.line++ {
+		asm.assembleLine(scanner.Text())
+	}
+	err := scanner.Err()
+
+	asm.endOfFile(numConds, numBlocks)
+	asm.files = asm.files[:len(asm.files)-1]
+	asm.file, asm.line = file, line
+	return err
+}
+
+// findFile resolves name relative to the current file and then the include paths.
+func (asm *assembler) findFile(name string) (string, error) {
+	candidates := []string{name}
+	if !filepath.IsAbs(name) {
+		candidates = []string{filepath.Join(filepath.Dir(asm.file), name)}
+		for _, dir := range asm.includePaths {
+			candidates = append(candidates, filepath.Join(dir, name))
+		}
+	}
+
+	for _, path := range candidates {
+		if _, err := os.Stat(path); err == nil {
+			return path, nil
+		}
+	}
+
+	_, err := os.Stat(candidates[0])
+	return "", err
+}
+
+func (asm *assembler) stringOperand(directive token, p *parser) (token, bool) {
+	tok := p.peek()
+	if tok == nil || tok.kind != tokString {
+		asm.errorf(directive.col, "'%s' expects a file name in quotes", directive.text)
+		return token{}, false
+	}
+	p.index++
+
+	if p.peekPunct(",") {
+		p.index++
+	}
+	return *tok, true
+}
+
+func (asm *assembler) include(directive token, p *parser) {
+	name, ok := asm.stringOperand(directive, p)
+	if !ok {
+		return
+	}
+	if !p.done() {
+		asm.errorf(p.peek().col, "unexpected '%s' after file name", p.peek().text)
+		return
+	}
+
+	path, err := asm.findFile(name.text)
+	if err != nil {
+		asm.errorf(name.col, "cannot include '%s': %v", name.text, err)
+		return
+	}
+
+	if len(asm.files) >= maxIncludeDepth {
+		asm.errorf(name.col, "includes nested too deeply")
+		return
+	}
+	for _, file := range asm.files {
+		if sameFile(file, path) {
+			asm.errorf(name.col, "'%s' includes itself", name.text)
+			return
+		}
+	}
+
+	if err := asm.assembleFile(path); err != nil {
+		asm.errorf(name.col, "cannot include '%s': %v", name.text, err)
+	}
+}
+
+func (asm *assembler) incbin(directive token, p *parser) {
+	name, ok := asm.stringOperand(directive, p)
+	if !ok {
+		return
+	}
+
+	args, err := p.parseOperands()
+	if err != nil {
+		asm.reportError(err)
+		return
+	}
+	if len(args) > 2 {
+		asm.report(SeverityError, args[2].position(), "'incbin' expects a file name, offset and length")
+		return
+	}
+
+	path, err := asm.findFile(name.text)
+	if err != nil {
+		asm.errorf(name.col, "cannot read '%s': %v", name.text, err)
+		return
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		asm.errorf(name.col, "cannot read '%s': %v", name.text, err)
+		return
+	}
+
+	bounds := []int{0, len(data)}
+	for i, arg := range args {
+		v, err := asm.eval(arg)
+		if err != nil {
+			asm.reportError(err)
+			return
+		}
+		bounds[i] = v
+	}
+
+	start, length := bounds[0], bounds[1]
+	if len(args) < 2 {
+		length -= start
+	}
+	if start < 0 || length < 0 || start+length > len(data) {
+		asm.errorf(name.col, "range %d+%d is outside of '%s' (%d bytes)", start, length, name.text, len(data))
+		return
+	}
+
+	for _, b := range data[start : start+length] {
+		asm.writeUint8(b)
+	}
+}
+
+func sameFile(a, b string) bool {
+	ia, err := os.Stat(a)
+	if err != nil {
+		return false
+	}
+	ib, err := os.Stat(b)
+	if err != nil {
+		return false
+	}
+	return os.SameFile(ia, ib)
+}
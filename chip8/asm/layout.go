@@ -0,0 +1,260 @@
+/*
+Copyright (C) 2016 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package asm
+
+import (
+	"fmt"
+	"io"
+	"sort"
+)
+
+type section struct {
+	start    int
+	data     []byte
+	source   []sourceInfo
+	size     int
+	reserved bool
+	reloc    bool
+	pos      position
+}
+
+func (s *section) len() int {
+	if s.reserved {
+		return s.size
+	}
+	return len(s.data)
+}
+
+func (s *section) end() int {
+	return s.start + s.len()
+}
+
+func (asm *assembler) constOperand(directive token, p *parser) (int, bool) {
+	args, err := p.parseOperands()
+	if err != nil {
+		asm.reportError(err)
+		return 0, false
+	}
+	if !asm.checkLen(directive, args, 1) {
+		return 0, false
+	}
+
+	v, err := asm.eval(args[0])
+	if err != nil {
+		if ue, ok := err.(*undefinedError); ok {
+			asm.report(SeverityError, ue.pos, "'%s' uses '%s' before it is defined", directive.text, ue.name)
+		} else {
+			asm.reportError(err)
+		}
+		return 0, false
+	}
+	return v, true
+}
+
+// layoutDirective handles org, align, reserve/space, start and target and
+// reports whether directive was one of them.
+func (asm *assembler) layoutDirective(directive token, p *parser) bool {
+	switch directive.text {
+	case "target":
+		name := p.peek()
+		if name == nil || name.kind != tokIdent || len(p.tokens)-p.index != 1 {
+			asm.errorf(directive.col, "'target' expects a platform name")
+			return true
+		}
+
+		target := findPlatform(name.text)
+		switch {
+		case target == nil:
+			asm.errorf(name.col, "unknown target '%s'", name.text)
+		case len(asm.sections) > 0:
+			asm.errorf(directive.col, "'target' must come before any code or data")
+		default:
+			asm.platform = target
+		}
+	case "start":
+		v, ok := asm.constOperand(directive, p)
+		if !ok {
+			return true
+		}
+
+		if len(asm.sections) > 0 {
+			asm.errorf(directive.col, "'start' must come before any code or data")
+		} else if v < 0 || v >= asm.platform.memSize {
+			asm.errorf(directive.col, "start address $%X is outside of memory", v)
+		} else {
+			asm.startAddr, asm.addr = v, v
+		}
+	case "org":
+		v, ok := asm.constOperand(directive, p)
+		if !ok {
+			return true
+		}
+
+		if v < 0 || v >= asm.platform.memSize {
+			asm.errorf(directive.col, "address $%X is outside of memory", v)
+			return true
+		}
+		asm.addr, asm.current = v, nil
+		asm.absolute = true
+	case "align":
+		v, ok := asm.constOperand(directive, p)
+		if !ok {
+			return true
+		}
+
+		if v <= 0 {
+			asm.errorf(directive.col, "invalid alignment %d", v)
+			return true
+		}
+
+		if !asm.absolute && v > asm.maxAlign {
+			asm.maxAlign = v
+		}
+
+		pad := (v - asm.addr%v) % v
+		if asm.current == nil {
+			asm.addr += pad
+			return true
+		}
+		for ; pad > 0; pad-- {
+			asm.writeUint8(0)
+		}
+	case "reserve", "space":
+		asm.reserve(directive, p)
+	default:
+		return false
+	}
+	return true
+}
+
+// reserve handles 'reserve size', it leaves size bytes of memory
+// uninitialized.
+func (asm *assembler) reserve(directive token, p *parser) {
+	v, ok := asm.constOperand(directive, p)
+	if !ok {
+		return
+	}
+
+	if v < 0 {
+		asm.errorf(directive.col, "invalid size %d", v)
+		return
+	}
+
+	asm.sections = append(asm.sections, &section{
+		start:    asm.addr,
+		size:     v,
+		reserved: true,
+		reloc:    !asm.absolute,
+		pos:      asm.pos(directive.col),
+	})
+	asm.addr += v
+	asm.current = nil
+}
+
+func (asm *assembler) sortedSections() []*section {
+	sections := make([]*section, 0, len(asm.sections))
+	for _, s := range asm.sections {
+		if s.len() > 0 {
+			sections = append(sections, s)
+		}
+	}
+
+	sort.SliceStable(sections, func(i, j int) bool {
+		return sections[i].start < sections[j].start
+	})
+	return sections
+}
+
+// checkLayout reports sections that overlap or do not fit in memory.
+func (asm *assembler) checkLayout() {
+	var prev *section
+	for _, s := range asm.sortedSections() {
+		if !s.reserved && s.start < asm.startAddr {
+			asm.report(SeverityError, s.pos, "section at $%X is below the program start $%X", s.start, asm.startAddr)
+		}
+		if s.end() > asm.platform.memSize {
+			asm.report(SeverityError, s.pos, "section $%X-$%X exceeds the end of memory $%X", s.start, s.end()-1, asm.platform.memSize-1)
+		}
+		if prev != nil && s.start < prev.end() {
+			asm.report(SeverityError, s.pos, "section $%X-$%X overlaps $%X-$%X defined at %v", s.start, s.end()-1, prev.start, prev.end()-1, prev.pos)
+		}
+
+		if prev == nil || s.end() > prev.end() {
+			prev = s
+		}
+	}
+}
+
+// image returns the program as loaded at the start address together with
+// the source position of every byte. Gaps between sections are zero.
+func (asm *assembler) image() ([]byte, []sourceInfo) {
+	end := asm.startAddr
+	for _, s := range asm.sections {
+		if !s.reserved && s.end() > end {
+			end = s.end()
+		}
+	}
+
+	program := make([]byte, end-asm.startAddr)
+	source := make([]sourceInfo, len(program))
+	for _, s := range asm.sections {
+		if !s.reserved {
+			copy(program[s.start-asm.startAddr:], s.data)
+			copy(source[s.start-asm.startAddr:], s.source)
+		}
+	}
+	return program, source
+}
+
+func (asm *assembler) byteAt(addr int) *byte {
+	for _, s := range asm.sections {
+		if !s.reserved && addr >= s.start && addr < s.end() {
+			return &s.data[addr-s.start]
+		}
+	}
+	panic(fmt.Sprintf("no data at $%X", addr))
+}
+
+func (asm *assembler) writeMemoryMap(writer io.Writer) {
+	fmt.Fprintf(writer, "memory map (%s):\n", asm.platform.name)
+
+	addr, free := asm.startAddr, 0
+	freeBlock := func(end int) {
+		if end > addr {
+			fmt.Fprintf(writer, "  $%04X-$%04X %6d  free\n", addr, end-1, end-addr)
+			free += end - addr
+		}
+	}
+
+	for _, s := range asm.sortedSections() {
+		freeBlock(s.start)
+
+		kind := ""
+		if s.reserved {
+			kind = " (reserved)"
+		}
+		fmt.Fprintf(writer, "  $%04X-$%04X %6d  %v%s\n", s.start, s.end()-1, s.len(), s.pos, kind)
+
+		if s.end() > addr {
+			addr = s.end()
+		}
+	}
+	freeBlock(asm.platform.memSize)
+
+	fmt.Fprintf(writer, "%d bytes free below $%X\n", free, asm.platform.memSize-1)
+}
@@ -0,0 +1,163 @@
+/*
+Copyright (C) 2016 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package asm
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+type (
+	tokenKind int
+
+	token struct {
+		kind  tokenKind
+		text  string
+		value int
+		col   int
+	}
+
+	syntaxError struct {
+		col int
+		msg string
+	}
+)
+
+const (
+	tokIdent tokenKind = iota
+	tokNumber
+	tokString
+	tokPunct
+)
+
+func (err *syntaxError) Error() string {
+	return err.msg
+}
+
+func syntaxErrorf(col int, format string, a ...interface{}) *syntaxError {
+	return &syntaxError{col, fmt.Sprintf(format, a...)}
+}
+
+func isIdentStart(c byte) bool {
+	return c == '_' || c == '.' || c == '@' || unicode.IsLetter(rune(c))
+}
+
+func isIdentChar(c byte) bool {
+	return isIdentStart(c) || unicode.IsDigit(rune(c))
+}
+
+func isRegister(s string) bool {
+	if len(s) != 2 || s[0] != 'v' {
+		return false
+	}
+	return strings.IndexByte("0123456789abcdef", s[1]) >= 0
+}
+
+func lexNumber(s string, col int) (token, error) {
+	var (
+		n   uint64
+		err error
+	)
+
+	switch s[0] {
+	case '$':
+		n, err = strconv.ParseUint(s[1:], 16, 32)
+	case '%':
+		n, err = strconv.ParseUint(s[1:], 2, 32)
+	default:
+		n, err = strconv.ParseUint(s, 10, 32)
+	}
+
+	if err != nil {
+		if ne, ok := err.(*strconv.NumError); ok && ne.Err == strconv.ErrRange {
+			return token{}, syntaxErrorf(col, "number %s is too large", s)
+		}
+		return token{}, syntaxErrorf(col, "invalid number '%s'", s)
+	}
+	return token{tokNumber, s, int(n), col}, nil
+}
+
+// lex splits a source line into tokens, stopping at the first ';'.
+func lex(line string) ([]token, error) {
+	var tokens []token
+
+	for i := 0; i < len(line); {
+		c := line[i]
+		col := i + 1
+
+		switch {
+		case c == ';':
+			return tokens, nil
+		case unicode.IsSpace(rune(c)):
+			i++
+		case isIdentStart(c):
+			start := i
+			for i < len(line) && isIdentChar(line[i]) {
+				i++
+			}
+			tokens = append(tokens, token{tokIdent, line[start:i], 0, col})
+		case unicode.IsDigit(rune(c)) || ((c == '$' || c == '%') && i+1 < len(line) && isIdentChar(line[i+1])):
+			start := i
+			for i++; i < len(line) && isIdentChar(line[i]); i++ {
+			}
+
+			tok, err := lexNumber(line[start:i], col)
+			if err != nil {
+				return tokens, err
+			}
+			tokens = append(tokens, tok)
+		case c == '"':
+			end := i + 1
+			for ; end < len(line) && line[end] != '"'; end++ {
+				if line[end] == '\\' {
+					end++
+				}
+			}
+			if end >= len(line) {
+				return tokens, syntaxErrorf(col, "unterminated string")
+			}
+
+			s, err := strconv.Unquote(line[i : end+1])
+			if err != nil {
+				return tokens, syntaxErrorf(col, "invalid string %s", line[i:end+1])
+			}
+			tokens = append(tokens, token{tokString, s, 0, col})
+			i = end + 1
+		case strings.HasPrefix(line[i:], "<<") || strings.HasPrefix(line[i:], ">>") ||
+			strings.HasPrefix(line[i:], "==") || strings.HasPrefix(line[i:], "!="):
+			tokens = append(tokens, token{tokPunct, line[i : i+2], 0, col})
+			i += 2
+		case strings.IndexByte("+-*/&|~(),:!", c) >= 0:
+			tokens = append(tokens, token{tokPunct, line[i : i+1], 0, col})
+			i++
+		default:
+			return tokens, syntaxErrorf(col, "unexpected character '%c'", c)
+		}
+	}
+
+	return tokens, nil
+}
+
+func (asm *assembler) lex(line string) ([]token, error) {
+	if asm.chipper {
+		return lexChipper(line)
+	}
+	return lex(line)
+}
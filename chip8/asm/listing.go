@@ -0,0 +1,95 @@
+/*
+Copyright (C) 2016 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package asm
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/andreas-jonsson/chip8/chip8"
+)
+
+const listBytesPerRow = 4
+
+// listEntry is one source line in the listing along with the addresses
+// of all bytes it produced, including bytes from macro expansions.
+type listEntry struct {
+	pos   position
+	text  string
+	addr  int
+	bytes []int
+}
+
+func (asm *assembler) writeListing(writer io.Writer) error {
+	w := bufio.NewWriter(writer)
+
+	file := ""
+	for _, entry := range asm.listing {
+		if entry.pos.file != file {
+			file = entry.pos.file
+			fmt.Fprintf(w, "; %s\n", file)
+		}
+
+		text := strings.TrimRight(entry.text, " \t")
+		if len(entry.bytes) == 0 {
+			fmt.Fprintf(w, "%5d  %04X  %-*s  %s\n", entry.pos.line, entry.addr, listBytesPerRow*3-1, "", text)
+			continue
+		}
+
+		for i := 0; i < len(entry.bytes); i += listBytesPerRow {
+			row := entry.bytes[i:]
+			if len(row) > listBytesPerRow {
+				row = row[:listBytesPerRow]
+			}
+
+			hex := make([]string, len(row))
+			for j, addr := range row {
+				hex[j] = fmt.Sprintf("%02X", *asm.byteAt(addr))
+			}
+
+			if i == 0 {
+				fmt.Fprintf(w, "%5d  %04X  %-*s  %s\n", entry.pos.line, row[0], listBytesPerRow*3-1, strings.Join(hex, " "), text)
+			} else {
+				fmt.Fprintf(w, "%5s  %04X  %s\n", "", row[0], strings.Join(hex, " "))
+			}
+		}
+	}
+
+	return w.Flush()
+}
+
+// symbolTable returns all labels sorted by address.
+func (asm *assembler) symbolTable() chip8.Symbols {
+	var symbols chip8.Symbols
+	for name, sym := range asm.symbols {
+		if sym.lable {
+			symbols = append(symbols, chip8.Symbol{Name: name, Addr: uint16(sym.value)})
+		}
+	}
+
+	sort.Slice(symbols, func(i, j int) bool {
+		if symbols[i].Addr == symbols[j].Addr {
+			return symbols[i].Name < symbols[j].Name
+		}
+		return symbols[i].Addr < symbols[j].Addr
+	})
+	return symbols
+}
@@ -0,0 +1,165 @@
+/*
+Copyright (C) 2016 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package asm
+
+import "fmt"
+
+const maxMacroDepth = 32
+
+type (
+	sourceLine struct {
+		text string
+		pos  position
+	}
+
+	macro struct {
+		name   string
+		params []string
+		body   []sourceLine
+		pos    position
+	}
+
+	expansion struct {
+		name string
+		pos  position
+	}
+)
+
+func isLocalLable(s string) bool {
+	return s != "" && s[0] == '@'
+}
+
+func (asm *assembler) defineMacro(directive token, p *parser) {
+	name := p.peek()
+	if name == nil || name.kind != tokIdent {
+		asm.errorf(directive.col, "'macro' expects a name")
+		return
+	}
+	p.index++
+
+	m := &macro{name: name.text, pos: asm.pos(name.col)}
+	for !p.done() {
+		param := p.peek()
+		if param.kind != tokIdent || isRegister(param.text) || isLocalLable(param.text) {
+			asm.errorf(param.col, "invalid macro parameter '%s'", param.text)
+			return
+		}
+		for _, prev := range m.params {
+			if prev == param.text {
+				asm.errorf(param.col, "duplicate macro parameter '%s'", param.text)
+				return
+			}
+		}
+		m.params = append(m.params, param.text)
+
+		if p.index++; p.peekPunct(",") {
+			p.index++
+		}
+	}
+
+	if len(asm.context) > 0 {
+		asm.errorf(directive.col, "macro '%s' defined inside a macro expansion", m.name)
+		return
+	}
+	if prev, ok := asm.macros[m.name]; ok {
+		asm.errorf(name.col, "macro '%s' defined twice, previous definition at %v", m.name, prev.pos)
+	}
+	asm.recording = m
+}
+
+func (asm *assembler) recordLine(line string) {
+	tokens, _ := asm.lex(line)
+	if len(tokens) > 0 && tokens[0].kind == tokIdent {
+		switch tokens[0].text {
+		case "endm":
+			if _, ok := asm.macros[asm.recording.name]; !ok {
+				asm.macros[asm.recording.name] = asm.recording
+			}
+			asm.recording = nil
+			return
+		case "macro":
+			asm.errorf(tokens[0].col, "nested macro definition in '%s'", asm.recording.name)
+		}
+	}
+	asm.recording.body = append(asm.recording.body, sourceLine{line, asm.pos(1)})
+}
+
+func (asm *assembler) expandMacro(m *macro, name token, p *parser) {
+	args, err := p.splitOperands()
+	if err != nil {
+		asm.reportError(err)
+		return
+	}
+
+	if len(args) != len(m.params) {
+		asm.errorf(name.col, "macro '%s' expects %d argument(s), got %d", m.name, len(m.params), len(args))
+		return
+	}
+	if len(asm.context) >= maxMacroDepth {
+		asm.errorf(name.col, "macro '%s' nested too deeply", m.name)
+		return
+	}
+
+	params := make(map[string][]token)
+	for i, param := range m.params {
+		params[param] = args[i]
+	}
+
+	asm.numExpansions++
+	suffix := fmt.Sprintf(".%d", asm.numExpansions)
+
+	file, line, origin, numConds := asm.file, asm.line, asm.origin, len(asm.conds)
+	asm.context = append(asm.context, expansion{m.name, asm.pos(name.col)})
+	asm.origin = append([]position{asm.pos(name.col)}, origin...)
+
+	for _, src := range m.body {
+		asm.file, asm.line = src.pos.file, src.pos.line
+
+		tokens, err := asm.lex(src.text)
+		if err != nil {
+			asm.reportError(err)
+			continue
+		}
+
+		var expanded []token
+		for _, tok := range tokens {
+			if arg, ok := params[tok.text]; ok && tok.kind == tokIdent {
+				for _, a := range arg {
+					a.col = tok.col
+					expanded = append(expanded, a)
+				}
+				continue
+			}
+			if tok.kind == tokIdent && isLocalLable(tok.text) {
+				tok.text += suffix
+			}
+			expanded = append(expanded, tok)
+		}
+		asm.assembleTokens(expanded)
+	}
+
+	if len(asm.conds) != numConds {
+		asm.errorf(1, "unbalanced 'if' in macro body")
+		if len(asm.conds) > numConds {
+			asm.conds = asm.conds[:numConds]
+		}
+	}
+
+	asm.context = asm.context[:len(asm.context)-1]
+	asm.file, asm.line, asm.origin = file, line, origin
+}
@@ -0,0 +1,308 @@
+/*
+Copyright (C) 2016 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package asm
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/andreas-jonsson/chip8/chip8"
+)
+
+// An object file holds one relocatable section with everything assembled
+// before the first 'org', assembled as if it started at the start address,
+// and one absolute section for every block placed with 'org'.
+
+// linkDirective handles 'import name, ...' and 'export name, ...'.
+func (asm *assembler) linkDirective(directive token, p *parser) {
+	args, err := p.parseOperands()
+	if err != nil {
+		asm.reportError(err)
+		return
+	}
+	if len(args) == 0 {
+		asm.errorf(directive.col, "'%s' expects at least 1 symbol name", directive.text)
+		return
+	}
+
+	for _, arg := range args {
+		sym, ok := arg.(*exprSymbol)
+		if !ok {
+			asm.report(SeverityError, arg.position(), "'%s' expects a symbol name", directive.text)
+			continue
+		}
+
+		if directive.text == "import" {
+			asm.define(sym.name, sym.pos, &symbol{resolved: true, imported: true})
+			continue
+		}
+		if asm.exports == nil {
+			asm.exports = make(map[string]position)
+		}
+		asm.exports[sym.name] = sym.pos
+	}
+}
+
+// linearValue is k, k plus the address of symbol or k plus the start of
+// the relocatable section, optionally reduced by lo or hi.
+type linearValue struct {
+	k     int
+	sym   string
+	fn    string
+	reloc bool
+}
+
+func (v linearValue) absolute() bool {
+	return !v.reloc && v.sym == ""
+}
+
+func (asm *assembler) linear(e expr) (linearValue, error) {
+	tooComplex := &evalError{e.position(), "expression is too complex to relocate"}
+
+	switch e := e.(type) {
+	case *exprNumber:
+		return linearValue{k: e.value}, nil
+	case *exprInst:
+		addr, err := asm.instAddr(e)
+		if err != nil {
+			return linearValue{}, err
+		}
+		if asm.insts[e.n].reloc {
+			return linearValue{k: addr - asm.startAddr, reloc: true}, nil
+		}
+		return linearValue{k: addr}, nil
+	case *exprSymbol:
+		sym, ok := asm.symbols[e.name]
+		switch {
+		case !ok:
+			return linearValue{}, &undefinedError{e.pos, e.name}
+		case sym.imported:
+			return linearValue{sym: e.name}, nil
+		case sym.expr != nil:
+			if sym.resolving {
+				return linearValue{}, &evalError{e.pos, fmt.Sprintf("circular definition of '%s'", e.name)}
+			}
+			sym.resolving = true
+			v, err := asm.linear(sym.expr)
+			sym.resolving = false
+			return v, err
+		case sym.reloc:
+			return linearValue{k: sym.value - asm.startAddr, reloc: true}, nil
+		}
+		return linearValue{k: sym.value}, nil
+	case *exprUnary:
+		x, err := asm.linear(e.x)
+		if err != nil || !x.absolute() || x.fn != "" {
+			if err == nil {
+				err = tooComplex
+			}
+			return linearValue{}, err
+		}
+		v, err := asm.eval(e)
+		return linearValue{k: v}, err
+	case *exprCall:
+		x, err := asm.linear(e.arg)
+		if err != nil {
+			return linearValue{}, err
+		}
+		if x.absolute() {
+			v, err := asm.eval(e)
+			return linearValue{k: v}, err
+		}
+		if x.fn != "" {
+			return linearValue{}, tooComplex
+		}
+		x.fn = e.fn
+		return x, nil
+	case *exprBinary:
+		x, err := asm.linear(e.x)
+		if err != nil {
+			return linearValue{}, err
+		}
+		y, err := asm.linear(e.y)
+		if err != nil {
+			return linearValue{}, err
+		}
+
+		if x.absolute() && y.absolute() {
+			v, err := asm.eval(e)
+			return linearValue{k: v}, err
+		}
+		if x.fn != "" || y.fn != "" {
+			return linearValue{}, tooComplex
+		}
+
+		switch {
+		case e.op == "+" && y.absolute():
+			x.k += y.k
+			return x, nil
+		case e.op == "+" && x.absolute():
+			y.k += x.k
+			return y, nil
+		case e.op == "-" && y.absolute():
+			x.k -= y.k
+			return x, nil
+		case e.op == "-" && x.reloc == y.reloc && x.sym == y.sym:
+			// The distance between two addresses in the same section.
+			return linearValue{k: x.k - y.k}, nil
+		}
+		return linearValue{}, tooComplex
+	}
+	return linearValue{}, tooComplex
+}
+
+// shiftRanges makes the addresses of m relative to offset.
+func shiftRanges(m *chip8.SourceMap, offset int) *chip8.SourceMap {
+	m.Version = chip8.SourceMapVersion
+	for i := range m.Ranges {
+		m.Ranges[i].Start -= offset
+		m.Ranges[i].End -= offset
+	}
+	return m
+}
+
+// objectFile returns the assembled program as an object file. Problems are
+// reported as diagnostics.
+func (asm *assembler) objectFile() *chip8.Object {
+	obj := &chip8.Object{Platform: asm.platform.name, MemSize: asm.platform.memSize}
+
+	// The relocatable section, gaps and reserved memory are zero filled.
+	end := asm.startAddr
+	for _, s := range asm.sections {
+		if s.reloc && s.end() > end {
+			end = s.end()
+		}
+	}
+
+	data := make([]byte, end-asm.startAddr)
+	source := make([]sourceInfo, len(data))
+	for _, s := range asm.sections {
+		if s.reloc && !s.reserved {
+			copy(data[s.start-asm.startAddr:], s.data)
+			copy(source[s.start-asm.startAddr:], s.source)
+		}
+	}
+
+	align := asm.maxAlign
+	if align < 2 {
+		align = 2
+	}
+	obj.Sections = append(obj.Sections, chip8.ObjectSection{
+		Addr:   -1,
+		Align:  align,
+		Data:   data,
+		Source: shiftRanges(sourceMap(asm.startAddr, source), asm.startAddr),
+	})
+
+	bases := []int{asm.startAddr}
+	for _, s := range asm.sortedSections() {
+		if s.reloc || s.reserved {
+			continue
+		}
+		obj.Sections = append(obj.Sections, chip8.ObjectSection{
+			Addr:   s.start,
+			Data:   append([]byte(nil), s.data...),
+			Source: shiftRanges(sourceMap(s.start, s.source), s.start),
+		})
+		bases = append(bases, s.start)
+	}
+
+	sectionAt := func(addr int) int {
+		for i := len(obj.Sections) - 1; i >= 0; i-- {
+			if addr >= bases[i] && addr < bases[i]+len(obj.Sections[i].Data) {
+				return i
+			}
+		}
+		return -1
+	}
+
+	for _, info := range asm.relocs {
+		v, err := asm.linear(info.expr)
+		if err != nil {
+			asm.reportError(err)
+			continue
+		}
+		if v.absolute() {
+			continue
+		}
+
+		i := sectionAt(info.addr)
+		s := &obj.Sections[i]
+		offset := info.addr - bases[i]
+
+		mask := uint16(1<<info.bits-1) << info.shift
+		if info.size == 1 {
+			s.Data[offset] &^= byte(mask)
+		} else {
+			s.Data[offset] &^= byte(mask >> 8)
+			s.Data[offset+1] &^= byte(mask)
+		}
+
+		s.Relocations = append(s.Relocations, chip8.Relocation{
+			Offset: offset,
+			Size:   info.size,
+			Bits:   info.bits,
+			Shift:  info.shift,
+			Symbol: v.sym,
+			Addend: v.k,
+			Func:   v.fn,
+		})
+	}
+
+	names := make([]string, 0, len(asm.symbols))
+	for name := range asm.symbols {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		sym := asm.symbols[name]
+		if sym.imported {
+			obj.Imports = append(obj.Imports, name)
+			continue
+		}
+
+		pos, exported := asm.exports[name]
+		v, err := asm.linear(&exprSymbol{sym.pos, name})
+		if err != nil || v.sym != "" || v.fn != "" {
+			if exported {
+				asm.report(SeverityError, pos, "exported symbol '%s' does not have a fixed value", name)
+			}
+			continue
+		}
+
+		section := -1
+		if v.reloc {
+			section = 0
+		}
+		obj.Symbols = append(obj.Symbols, chip8.ObjectSymbol{
+			Name:     name,
+			Section:  section,
+			Value:    v.k,
+			Label:    sym.lable,
+			Exported: exported,
+		})
+	}
+
+	for name, pos := range asm.exports {
+		if _, ok := asm.symbols[name]; !ok {
+			asm.report(SeverityError, pos, "exported symbol '%s' is not defined", name)
+		}
+	}
+	return obj
+}
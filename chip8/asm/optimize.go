@@ -0,0 +1,344 @@
+/*
+Copyright (C) 2016 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package asm
+
+import (
+	"fmt"
+	"io"
+)
+
+// The optimizer works in two passes. The program is assembled once and
+// the instructions are analyzed to produce a set of edits, keyed by the
+// order the instructions were written in. The program is then assembled
+// again with the edits applied, so labels, forward references and the
+// source map are laid out as if the source had been written that way.
+
+type (
+	instInfo struct {
+		addr  int
+		size  int
+		name  string
+		reloc bool
+	}
+
+	edit struct {
+		name   string
+		delete bool
+		rename string
+		target int
+		value  int
+		hasVal bool
+	}
+
+	// exprInst is the address of the n:th instruction written.
+	exprInst struct {
+		pos position
+		n   int
+	}
+
+	optStats struct {
+		chains, unreachable, tailCalls, merged int
+	}
+)
+
+const maxJumpChain = 16
+
+func (e *exprInst) position() position { return e.pos }
+
+func (asm *assembler) instAddr(e *exprInst) (int, error) {
+	if e.n >= len(asm.insts) {
+		return 0, &undefinedError{e.pos, fmt.Sprintf("instruction #%d", e.n)}
+	}
+	return asm.insts[e.n].addr, nil
+}
+
+// applyEdit records the instruction about to be written and applies the
+// optimizer edit for it, if any. It reports false if the instruction is
+// removed.
+func (asm *assembler) applyEdit(name *string, mnemonic token, args *[]expr) bool {
+	n := len(asm.insts)
+	size := 2
+	if *name == "loadil" {
+		size = 4
+	}
+	asm.insts = append(asm.insts, instInfo{asm.addr, size, *name, !asm.absolute})
+
+	e, ok := asm.edits[n]
+	if !ok {
+		return true
+	}
+	if e.name != *name {
+		asm.editMismatch = true
+		return true
+	}
+	if e.delete {
+		return false
+	}
+
+	pos := asm.pos(mnemonic.col)
+	if e.rename != "" {
+		*name = e.rename
+	}
+	if e.target >= 0 {
+		*args = []expr{&exprInst{pos, e.target}}
+	}
+	if e.hasVal && len(*args) == 2 {
+		*args = []expr{(*args)[0], &exprNumber{pos, e.value}}
+	}
+	return true
+}
+
+func isSkip(op uint16) bool {
+	switch {
+	case op&0xF000 == 0x3000, op&0xF000 == 0x4000:
+		return true
+	case op&0xF00F == 0x5000, op&0xF00F == 0x9000:
+		return true
+	case op&0xF0FF == 0xE09E, op&0xF0FF == 0xE0A1:
+		return true
+	}
+	return false
+}
+
+type optimizer struct {
+	asm     *assembler
+	ops     []uint16
+	index   map[int]int
+	targets map[int]bool
+	edits   map[int]edit
+	stats   optStats
+}
+
+func (o *optimizer) inst(i int) instInfo {
+	return o.asm.insts[i]
+}
+
+// next returns the instruction directly following i in memory.
+func (o *optimizer) next(i int) (int, bool) {
+	if i+1 >= len(o.asm.insts) || o.inst(i+1).addr != o.inst(i).addr+o.inst(i).size {
+		return 0, false
+	}
+	return i + 1, true
+}
+
+// afterSkip reports whether instruction i can be skipped over by the
+// instruction in front of it.
+func (o *optimizer) afterSkip(i int) bool {
+	return i > 0 && o.inst(i-1).addr+o.inst(i-1).size == o.inst(i).addr && isSkip(o.ops[i-1])
+}
+
+func (o *optimizer) edit(i int) edit {
+	if e, ok := o.edits[i]; ok {
+		return e
+	}
+	return edit{name: o.inst(i).name, target: -1}
+}
+
+func (o *optimizer) free(i int) bool {
+	_, ok := o.edits[i]
+	return !ok
+}
+
+func (o *optimizer) remove(i int) {
+	e := o.edit(i)
+	e.delete = true
+	o.edits[i] = e
+}
+
+// optimize analyzes the assembled program and returns the edits for the
+// second pass.
+func (asm *assembler) optimize() (map[int]edit, optStats) {
+	o := &optimizer{
+		asm:     asm,
+		ops:     make([]uint16, len(asm.insts)),
+		index:   make(map[int]int),
+		targets: map[int]bool{asm.startAddr: true},
+		edits:   make(map[int]edit),
+	}
+
+	hasJump0 := false
+	for i, inst := range asm.insts {
+		o.ops[i] = uint16(*asm.byteAt(inst.addr))<<8 | uint16(*asm.byteAt(inst.addr + 1))
+		o.index[inst.addr] = i
+
+		switch op := o.ops[i]; op & 0xF000 {
+		case 0x1000, 0x2000, 0xA000:
+			o.targets[int(op&0xFFF)] = true
+		case 0xB000:
+			o.targets[int(op&0xFFF)] = true
+			hasJump0 = true
+		}
+		if inst.name == "loadil" {
+			o.targets[int(*asm.byteAt(inst.addr + 2))<<8|int(*asm.byteAt(inst.addr + 3))] = true
+		}
+	}
+	for _, sym := range asm.symbols {
+		if sym.lable {
+			o.targets[sym.value] = true
+		}
+	}
+
+	o.foldJumps()
+	o.tailCalls()
+	o.mergeLoads()
+	// Computed jumps may land anywhere after their base address.
+	if !hasJump0 {
+		o.removeUnreachable()
+	}
+	return o.edits, o.stats
+}
+
+// foldJumps lets jumps and calls to a jump go directly to its target.
+func (o *optimizer) foldJumps() {
+	for i, op := range o.ops {
+		if op&0xF000 != 0x1000 && op&0xF000 != 0x2000 {
+			continue
+		}
+
+		target, ok := o.index[int(op&0xFFF)]
+		if !ok || o.ops[target]&0xF000 != 0x1000 {
+			continue
+		}
+
+		final := -1
+		for n := 0; n < maxJumpChain; n++ {
+			next, ok := o.index[int(o.ops[target]&0xFFF)]
+			if !ok || next == target || next == i {
+				break
+			}
+			final = next
+			if o.ops[next]&0xF000 != 0x1000 {
+				break
+			}
+			target = next
+		}
+		if final < 0 {
+			continue
+		}
+
+		e := o.edit(i)
+		e.target = final
+		o.edits[i] = e
+		o.stats.chains++
+	}
+}
+
+// tailCalls replaces 'call x; rts' with 'jump x'.
+func (o *optimizer) tailCalls() {
+	for i, op := range o.ops {
+		if op&0xF000 != 0x2000 || o.afterSkip(i) {
+			continue
+		}
+
+		ret, ok := o.next(i)
+		if !ok || o.ops[ret] != 0x00EE || o.targets[o.inst(ret).addr] || !o.free(ret) {
+			continue
+		}
+
+		e := o.edit(i)
+		e.rename = "jump"
+		o.edits[i] = e
+		o.remove(ret)
+		o.stats.tailCalls++
+	}
+}
+
+// mergeLoads folds 'add vx, n' into a preceding 'load vx, n' or 'add vx, n'
+// and drops loads that are overwritten by the next instruction.
+func (o *optimizer) mergeLoads() {
+	for i := 0; i < len(o.ops); i++ {
+		op := o.ops[i]
+		if (op&0xF000 != 0x6000 && op&0xF000 != 0x7000) || o.afterSkip(i) || !o.free(i) {
+			continue
+		}
+
+		reg := op & 0x0F00
+		value := int(op & 0xFF)
+		merged := false
+
+		j := i
+		for {
+			next, ok := o.next(j)
+			if !ok || o.targets[o.inst(next).addr] || !o.free(next) {
+				break
+			}
+
+			nop := o.ops[next]
+			if nop&0xF000 == 0x6000 && nop&0x0F00 == reg && op&0xF000 == 0x6000 {
+				// Overwritten before use.
+				o.remove(i)
+				o.stats.merged++
+				break
+			}
+			if nop&0xF000 != 0x7000 || nop&0x0F00 != reg {
+				break
+			}
+
+			value = (value + int(nop&0xFF)) & 0xFF
+			o.remove(next)
+			o.stats.merged++
+			merged = true
+			j = next
+		}
+
+		if e := o.edit(i); merged && !e.delete {
+			e.value, e.hasVal = value, true
+			o.edits[i] = e
+		}
+		i = j
+	}
+}
+
+// removeUnreachable removes instructions after a jump, rts or halt up to
+// the next label or jump target.
+func (o *optimizer) removeUnreachable() {
+	for i, op := range o.ops {
+		e := o.edit(i)
+		if op&0xF000 != 0x1000 && op != 0x00EE && op != 0x00FD && e.rename != "jump" {
+			continue
+		}
+		if e.delete || o.afterSkip(i) {
+			continue
+		}
+
+		for j, ok := o.next(i); ok; j, ok = o.next(j) {
+			if o.targets[o.inst(j).addr] {
+				break
+			}
+			if o.free(j) || !o.edits[j].delete {
+				o.remove(j)
+				o.stats.unreachable++
+			}
+		}
+	}
+}
+
+func (s optStats) write(writer io.Writer, saved int) {
+	fmt.Fprintf(writer, "optimizer: %d jump chain(s) folded, %d tail call(s), %d load/add merge(s), %d unreachable instruction(s) removed, %d bytes saved\n",
+		s.chains, s.tailCalls, s.merged, s.unreachable, saved)
+}
+
+// dataSize returns the number of bytes written, not counting gaps and
+// reserved memory.
+func (asm *assembler) dataSize() int {
+	n := 0
+	for _, s := range asm.sections {
+		n += len(s.data)
+	}
+	return n
+}
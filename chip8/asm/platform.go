@@ -0,0 +1,93 @@
+/*
+Copyright (C) 2016 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package asm
+
+import "strings"
+
+const (
+	featScroll = 1 << iota
+	featSuperChip
+	featXOChip
+	featChippy
+)
+
+type platform struct {
+	name     string
+	memSize  int
+	features uint
+}
+
+const defaultPlatform = "chippy"
+
+var platforms = []*platform{
+	{"chip8", 0x1000, 0},
+	{"schip", 0x1000, featScroll | featSuperChip},
+	{"xochip", 0x10000, featScroll | featSuperChip | featXOChip},
+	{"chippy", 0x1000, featScroll | featChippy},
+}
+
+// Mnemonics not listed here are part of the original CHIP-8 instruction set.
+var mnemonicFeatures = map[string]uint{
+	"scr":    featScroll,
+	"scrr":   featScroll,
+	"scrl":   featScroll,
+	"halt":   featScroll,
+	"low":    featScroll,
+	"high":   featScroll,
+	"ldhspr": featSuperChip,
+	"storf":  featSuperChip,
+	"readf":  featSuperChip,
+	"scru":   featXOChip,
+	"loadil": featXOChip,
+	"storr":  featXOChip,
+	"readr":  featXOChip,
+	"plane":  featXOChip,
+	"audio":  featXOChip,
+	"pitch":  featXOChip,
+	"freq":   featChippy,
+	"reset":  featChippy,
+	"color":  featChippy,
+}
+
+func findPlatform(name string) *platform {
+	for _, p := range platforms {
+		if p.name == name {
+			return p
+		}
+	}
+	return nil
+}
+
+func (asm *assembler) checkSupported(mnemonic token) {
+	asm.checkFeature(mnemonicFeatures[mnemonic.text], mnemonic)
+}
+
+// checkFeature reports mnemonic if the target does not support feat.
+func (asm *assembler) checkFeature(feat uint, mnemonic token) {
+	if feat == 0 || asm.platform.features&feat != 0 {
+		return
+	}
+
+	var targets []string
+	for _, p := range platforms {
+		if p.features&feat != 0 {
+			targets = append(targets, p.name)
+		}
+	}
+	asm.errorf(mnemonic.col, "'%s' is not supported by target %s, only by %s", mnemonic.text, asm.platform.name, strings.Join(targets, ", "))
+}
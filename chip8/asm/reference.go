@@ -0,0 +1,171 @@
+/*
+Copyright (C) 2016 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package asm
+
+import "strings"
+
+// Instruction describes a mnemonic for documentation and editor support.
+// Opcode is the encoding with operand fields as letters, s and t are
+// registers.
+type Instruction struct {
+	Mnemonic    string
+	Opcode      string
+	Operands    int
+	Description string
+}
+
+// Instructions lists every mnemonic the assembler knows.
+var Instructions = []Instruction{
+	{"sys", "0nnn", 1, "Execute syscall"},
+	{"clr", "00E0", 0, "Clear the screen"},
+	{"rts", "00EE", 0, "Return from subroutine"},
+	{"jump", "1nnn", 1, "Jump to address nnn"},
+	{"call", "2nnn", 1, "Call routine at address nnn"},
+	{"ske", "3snn", 2, "Skip next instruction if register s equals nn"},
+	{"skne", "4snn", 2, "Skip next instruction if register s does not equal nn"},
+	{"skre", "5st0", 2, "Skip next instruction if register s equals register t"},
+	{"load", "6snn", 2, "Load register s with value nn"},
+	{"add", "7snn", 2, "Add value nn to register s"},
+	{"move", "8st0", 2, "Move the value of register t to register s"},
+	{"or", "8st1", 2, "Logical OR of register s and t, stored in s"},
+	{"and", "8st2", 2, "Logical AND of register s and t, stored in s"},
+	{"xor", "8st3", 2, "Logical XOR of register s and t, stored in s"},
+	{"addr", "8st4", 2, "Add register t to s, vf is set on carry"},
+	{"sub", "8st5", 2, "Subtract register t from s, vf is set on no borrow"},
+	{"shr", "8s06", 1, "Shift register s 1 bit right, bit 0 goes to vf"},
+	{"subr", "8st7", 2, "Store register t minus s in s, vf is set on no borrow"},
+	{"shl", "8s0E", 1, "Shift register s 1 bit left, bit 7 goes to vf"},
+	{"sknre", "9st0", 2, "Skip next instruction if register s does not equal register t"},
+	{"loadi", "Annn", 1, "Load index with address nnn"},
+	{"jump0", "Bnnn", 1, "Jump to address nnn plus v0"},
+	{"rand", "Ctnn", 2, "Load register t with a random number and'ed with nn"},
+	{"draw", "Dstn", 3, "Draw the n byte sprite at index at x register s, y register t, vf is set on collision"},
+	{"skp", "Es9E", 1, "Skip next instruction if the key in register s is pressed"},
+	{"sknp", "EsA1", 1, "Skip next instruction if the key in register s is not pressed"},
+	{"moved", "Ft07", 1, "Move the delay timer value into register t"},
+	{"keyd", "Ft0A", 1, "Wait for a key press and store the key in register t"},
+	{"loadd", "Fs15", 1, "Load the delay timer with register s"},
+	{"loads", "Fs18", 1, "Load the sound timer with register s"},
+	{"addi", "Fs1E", 1, "Add register s to index"},
+	{"ldspr", "Fs29", 1, "Load index with the font sprite of the digit in register s"},
+	{"bcd", "Fs33", 1, "Store the binary coded decimal value of register s at index"},
+	{"stor", "Fs55", 1, "Store registers v0 to s at index"},
+	{"read", "Fs65", 1, "Read registers v0 to s from index"},
+
+	{"scr", "00Cn", 1, "Scroll n lines down"},
+	{"scrr", "00FB", 0, "Scroll 4 pixels right"},
+	{"scrl", "00FC", 0, "Scroll 4 pixels left"},
+	{"halt", "00FD", 0, "System halt"},
+	{"low", "00FE", 0, "Set 64x32 video mode"},
+	{"high", "00FF", 0, "Set 128x64 video mode"},
+	{"ldhspr", "Fs30", 1, "Load index with the 10 byte font sprite of the digit in register s"},
+	{"storf", "Fs75", 1, "Store registers v0 to s in the RPL flags"},
+	{"readf", "Fs85", 1, "Read registers v0 to s from the RPL flags"},
+
+	{"scru", "00Dn", 1, "Scroll n lines up"},
+	{"storr", "5st2", 2, "Store registers s to t at index"},
+	{"readr", "5st3", 2, "Read registers s to t from index"},
+	{"loadil", "F000 nnnn", 1, "Load index with 16 bit address nnnn"},
+	{"plane", "Fn01", 1, "Select drawing planes n"},
+	{"audio", "F002", 0, "Load the 16 byte audio pattern at index"},
+	{"pitch", "Fs3A", 1, "Set the audio pitch to register s"},
+
+	{"freq", "0100", 0, "Set the CPU frequency to v0 * 10 hz"},
+	{"reset", "0101", 0, "System reset"},
+	{"color", "0102", 0, "Set background (v0) and foreground (v1) color"},
+}
+
+// Directives lists the assembler directives and control flow keywords.
+var Directives = []string{
+	".", "..", "sprite", "charmap",
+	"macro", "endm", "define",
+	"include", "incbin",
+	"target", "start", "org", "align", "reserve", "space",
+	"if", "ifdef", "ifndef", "else", "endif",
+	"then", "end", "loop", "while", "again",
+	"import", "export",
+}
+
+// FindInstruction returns the description of mnemonic.
+func FindInstruction(mnemonic string) (Instruction, bool) {
+	for _, inst := range Instructions {
+		if inst.Mnemonic == mnemonic {
+			return inst, true
+		}
+	}
+	return Instruction{}, false
+}
+
+// Targets returns the targets that support mnemonic.
+func Targets(mnemonic string) []string {
+	var targets []string
+	for _, p := range platforms {
+		if feat := mnemonicFeatures[mnemonic]; feat == 0 || p.features&feat != 0 {
+			targets = append(targets, p.name)
+		}
+	}
+	return targets
+}
+
+// Decode returns the instruction encoded by opcode. The instruction that
+// matches the most digits of the opcode is returned, so $00E0 is clr and
+// not sys. Shifts are accepted with any register in y.
+func Decode(opcode uint16) (Instruction, bool) {
+	if op := opcode & 0xF00F; op == 0x8006 || op == 0x800E {
+		opcode &= 0xFF0F
+	}
+
+	var (
+		best  Instruction
+		score = -1
+	)
+	for _, inst := range Instructions {
+		if n := matchOpcode(inst.Opcode, opcode); n > score {
+			best, score = inst, n
+		}
+	}
+	return best, score >= 0
+}
+
+// matchOpcode returns the number of digits in pattern matched by opcode or
+// -1 if it does not match.
+func matchOpcode(pattern string, opcode uint16) int {
+	n := 0
+	for i := 0; i < 4; i++ {
+		c := pattern[i]
+		if c >= 'a' && c <= 'z' {
+			continue
+		}
+
+		digit := (opcode >> uint(12-4*i)) & 0xF
+		if v := strings.IndexByte("0123456789ABCDEF", c); v != int(digit) {
+			return -1
+		}
+		n++
+	}
+	return n
+}
+
+// MemorySize returns the size of the memory of target or 0 if there is no
+// such target.
+func MemorySize(target string) int {
+	if p := findPlatform(target); p != nil {
+		return p.memSize
+	}
+	return 0
+}
@@ -0,0 +1,79 @@
+/*
+Copyright (C) 2016 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package asm
+
+import "github.com/andreas-jonsson/chip8/chip8"
+
+// sourceInfo is the origin of one byte of output. expandedFrom holds the
+// macro invocations that produced it, innermost first.
+type sourceInfo struct {
+	pos          position
+	expandedFrom []position
+}
+
+func (info *sourceInfo) equal(other *sourceInfo) bool {
+	if info.pos != other.pos || len(info.expandedFrom) != len(other.expandedFrom) {
+		return false
+	}
+	for i, pos := range info.expandedFrom {
+		if pos != other.expandedFrom[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// sourceMap merges the origin of every byte of the program loaded at
+// start into address ranges.
+func sourceMap(start int, source []sourceInfo) *chip8.SourceMap {
+	m := new(chip8.SourceMap)
+	files := make(map[string]int)
+
+	toSourcePos := func(pos position) chip8.SourcePos {
+		index, ok := files[pos.file]
+		if !ok {
+			index = len(m.Files)
+			files[pos.file] = index
+			m.Files = append(m.Files, pos.file)
+		}
+		return chip8.SourcePos{File: index, Line: pos.line, Column: pos.col}
+	}
+
+	for i := 0; i < len(source); {
+		info := &source[i]
+		end := i + 1
+		for end < len(source) && source[end].equal(info) {
+			end++
+		}
+
+		if info.pos.file != "" {
+			r := chip8.SourceRange{
+				Start:     start + i,
+				End:       start + end,
+				SourcePos: toSourcePos(info.pos),
+			}
+			for _, pos := range info.expandedFrom {
+				r.ExpandedFrom = append(r.ExpandedFrom, toSourcePos(pos))
+			}
+			m.Ranges = append(m.Ranges, r)
+		}
+		i = end
+	}
+
+	return m
+}
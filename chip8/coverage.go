@@ -0,0 +1,130 @@
+/*
+Copyright (C) 2016 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package chip8
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// Coverage counts how often every memory address was executed as part of
+// an opcode, read as data by draw and Fx65, or written by Fx33 and Fx55.
+type Coverage struct {
+	Executed, Read, Written [4096]uint32
+}
+
+// Flags returns the ways addr was accessed as a combination of x, r and w,
+// or an empty string.
+func (c *Coverage) Flags(addr uint16) string {
+	var flags []byte
+	if c.Executed[addr] > 0 {
+		flags = append(flags, 'x')
+	}
+	if c.Read[addr] > 0 {
+		flags = append(flags, 'r')
+	}
+	if c.Written[addr] > 0 {
+		flags = append(flags, 'w')
+	}
+	return string(flags)
+}
+
+// ReadCoverage reads a coverage map. Every line holds a hexadecimal address
+// or range 'start-end' followed by its flags, everything after ';' is a
+// comment. The counts of the coverage are set to 1.
+func ReadCoverage(reader io.Reader) (*Coverage, error) {
+	c := new(Coverage)
+
+	scanner := bufio.NewScanner(reader)
+	for line := 1; scanner.Scan(); line++ {
+		text := scanner.Text()
+		if i := strings.IndexByte(text, ';'); i >= 0 {
+			text = text[:i]
+		}
+
+		fields := strings.Fields(text)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("invalid coverage, line %d", line)
+		}
+
+		bounds := strings.SplitN(fields[0], "-", 2)
+		start, err := strconv.ParseUint(bounds[0], 16, 12)
+		if err != nil {
+			return nil, fmt.Errorf("invalid coverage address, line %d", line)
+		}
+		end := start
+		if len(bounds) == 2 {
+			if end, err = strconv.ParseUint(bounds[1], 16, 12); err != nil || end < start {
+				return nil, fmt.Errorf("invalid coverage address, line %d", line)
+			}
+		}
+
+		for _, f := range fields[1] {
+			var counts *[4096]uint32
+			switch f {
+			case 'x':
+				counts = &c.Executed
+			case 'r':
+				counts = &c.Read
+			case 'w':
+				counts = &c.Written
+			default:
+				return nil, fmt.Errorf("invalid coverage flag '%c', line %d", f, line)
+			}
+			for addr := start; addr <= end; addr++ {
+				counts[addr] = 1
+			}
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Write writes the coverage in the format read by ReadCoverage, with
+// consecutive addresses that have the same flags merged into ranges.
+func (c *Coverage) Write(writer io.Writer) error {
+	w := bufio.NewWriter(writer)
+	fmt.Fprintln(w, "; chip8 coverage")
+
+	for addr := 0; addr < len(c.Executed); {
+		flags := c.Flags(uint16(addr))
+		end := addr
+		for end+1 < len(c.Executed) && c.Flags(uint16(end+1)) == flags {
+			end++
+		}
+
+		switch {
+		case flags == "":
+		case end == addr:
+			fmt.Fprintf(w, "%03X %s\n", addr, flags)
+		default:
+			fmt.Fprintf(w, "%03X-%03X %s\n", addr, end, flags)
+		}
+		addr = end + 1
+	}
+	return w.Flush()
+}
@@ -0,0 +1,107 @@
+/*
+Copyright (C) 2016 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package chip8
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+// ObjectVersion is the version of the object file format written by this
+// package.
+const ObjectVersion = 1
+
+// Relocation is a field of Size bytes at Offset in a section that holds
+// the address of Symbol plus Addend, optionally reduced to its low or high
+// byte by Func. An empty Symbol refers to the relocatable section of the
+// same object. The value is Bits wide and shifted left by Shift.
+type Relocation struct {
+	Offset int    `json:"offset"`
+	Size   int    `json:"size"`
+	Bits   uint   `json:"bits"`
+	Shift  uint   `json:"shift"`
+	Symbol string `json:"symbol,omitempty"`
+	Addend int    `json:"addend"`
+	Func   string `json:"func,omitempty"`
+}
+
+// ObjectSection is a block of code or data. Relocatable sections have
+// Addr -1 and are placed by the linker at a multiple of Align. Source
+// holds the source map of the section with addresses relative to its
+// start.
+type ObjectSection struct {
+	Addr        int          `json:"addr"`
+	Align       int          `json:"align,omitempty"`
+	Data        []byte       `json:"data"`
+	Source      *SourceMap   `json:"source,omitempty"`
+	Relocations []Relocation `json:"relocations,omitempty"`
+}
+
+// ObjectSymbol is a label or constant. Labels in a relocatable section
+// have Section set to its index and Value relative to its start, all other
+// symbols have Section -1.
+type ObjectSymbol struct {
+	Name     string `json:"name"`
+	Section  int    `json:"section"`
+	Value    int    `json:"value"`
+	Label    bool   `json:"label,omitempty"`
+	Exported bool   `json:"exported,omitempty"`
+}
+
+// Object is a relocatable object file produced by the assembler.
+type Object struct {
+	Version  int             `json:"version"`
+	Platform string          `json:"platform"`
+	MemSize  int             `json:"memSize"`
+	Sections []ObjectSection `json:"sections"`
+	Symbols  []ObjectSymbol  `json:"symbols,omitempty"`
+	Imports  []string        `json:"imports,omitempty"`
+}
+
+// ReadObject reads an object file.
+func ReadObject(reader io.Reader) (*Object, error) {
+	obj := new(Object)
+	if err := json.NewDecoder(reader).Decode(obj); err != nil {
+		return nil, err
+	}
+
+	if obj.Version != ObjectVersion {
+		return nil, fmt.Errorf("unsupported object file version %d", obj.Version)
+	}
+
+	for _, s := range obj.Sections {
+		for _, r := range s.Relocations {
+			if r.Offset < 0 || r.Size < 1 || r.Size > 2 || r.Offset+r.Size > len(s.Data) {
+				return nil, fmt.Errorf("invalid relocation at offset %d", r.Offset)
+			}
+		}
+	}
+	for _, sym := range obj.Symbols {
+		if sym.Section >= len(obj.Sections) {
+			return nil, fmt.Errorf("invalid section index %d for symbol '%s'", sym.Section, sym.Name)
+		}
+	}
+	return obj, nil
+}
+
+// Write writes the object as JSON.
+func (obj *Object) Write(writer io.Writer) error {
+	obj.Version = ObjectVersion
+	return json.NewEncoder(writer).Encode(obj)
+}
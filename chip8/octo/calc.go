@@ -0,0 +1,133 @@
+/*
+Copyright (C) 2016 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package octo
+
+import "math"
+
+func boolValue(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+var unaryOps = map[string]func(float64) float64{
+	"-":     func(x float64) float64 { return -x },
+	"~":     func(x float64) float64 { return float64(^int64(x)) },
+	"!":     func(x float64) float64 { return boolValue(x == 0) },
+	"sin":   math.Sin,
+	"cos":   math.Cos,
+	"tan":   math.Tan,
+	"exp":   math.Exp,
+	"log":   math.Log,
+	"abs":   math.Abs,
+	"sqrt":  math.Sqrt,
+	"ceil":  math.Ceil,
+	"floor": math.Floor,
+	"sign": func(x float64) float64 {
+		switch {
+		case x < 0:
+			return -1
+		case x > 0:
+			return 1
+		}
+		return 0
+	},
+}
+
+var binaryOps = map[string]func(x, y float64) float64{
+	"-":   func(x, y float64) float64 { return x - y },
+	"+":   func(x, y float64) float64 { return x + y },
+	"*":   func(x, y float64) float64 { return x * y },
+	"/":   func(x, y float64) float64 { return x / y },
+	"%":   math.Mod,
+	"&":   func(x, y float64) float64 { return float64(int64(x) & int64(y)) },
+	"|":   func(x, y float64) float64 { return float64(int64(x) | int64(y)) },
+	"^":   func(x, y float64) float64 { return float64(int64(x) ^ int64(y)) },
+	"<<":  func(x, y float64) float64 { return float64(int64(x) << uint(y)) },
+	">>":  func(x, y float64) float64 { return float64(int64(x) >> uint(y)) },
+	"pow": math.Pow,
+	"min": math.Min,
+	"max": math.Max,
+	"<":   func(x, y float64) float64 { return boolValue(x < y) },
+	">":   func(x, y float64) float64 { return boolValue(x > y) },
+	"<=":  func(x, y float64) float64 { return boolValue(x <= y) },
+	">=":  func(x, y float64) float64 { return boolValue(x >= y) },
+	"==":  func(x, y float64) float64 { return boolValue(x == y) },
+	"!=":  func(x, y float64) float64 { return boolValue(x != y) },
+}
+
+// calc parses a braced expression. Like Octo, there is no operator
+// precedence and expressions are evaluated from right to left.
+func (c *compiler) calc() float64 {
+	c.expect("{")
+	v := c.calcExpr()
+	c.expect("}")
+	return v
+}
+
+func (c *compiler) calcExpr() float64 {
+	x := c.calcTerm()
+	if fn, ok := binaryOps[c.peek().text]; ok {
+		c.next()
+		return fn(x, c.calcExpr())
+	}
+	return x
+}
+
+func (c *compiler) calcTerm() float64 {
+	tok := c.next()
+	if tok.isNum {
+		return tok.number
+	}
+
+	switch tok.text {
+	case "(":
+		v := c.calcExpr()
+		c.expect(")")
+		return v
+	case "HERE":
+		return float64(c.here)
+	case "PI":
+		return math.Pi
+	case "E":
+		return math.E
+	case "@":
+		addr := int(c.calcTerm())
+		if addr < programStart || addr >= programStart+len(c.rom) {
+			return 0
+		}
+		return float64(c.rom[addr-programStart])
+	case "strlen":
+		return float64(len(c.expectString().text))
+	}
+
+	if fn, ok := unaryOps[tok.text]; ok {
+		return fn(c.calcTerm())
+	}
+	if v, ok := c.consts[tok.text]; ok {
+		return v
+	}
+	if addr, ok := c.labels[tok.text]; ok {
+		return float64(addr)
+	}
+	if _, ok := c.protos[tok.text]; ok {
+		panic(errorf(tok.pos, "cannot use forward reference '%s' in expression", tok.text))
+	}
+	panic(errorf(tok.pos, "undefined name '%s' in expression", tok.text))
+}
@@ -0,0 +1,863 @@
+/*
+Copyright (C) 2016 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+// Package octo compiles Octo assembly language into CHIP-8 programs.
+// The output is byte for byte identical to the reference Octo compiler
+// for the supported subset of the language.
+package octo
+
+import (
+	"sort"
+	"strings"
+)
+
+const (
+	programStart  = 0x200
+	maxAddr       = 0x10000
+	maxExpansions = 1 << 16
+)
+
+// Program is a compiled program, loaded at 0x200.
+type Program struct {
+	Data   []byte
+	Labels map[string]uint16
+	Source []Pos
+}
+
+type protoKind int
+
+const (
+	protoAddr protoKind = iota
+	protoLong
+	protoUnpack
+)
+
+// proto is a forward reference to a label that is patched once the label
+// is defined.
+type proto struct {
+	addr int
+	kind protoKind
+	pos  Pos
+}
+
+type branch struct {
+	addr int
+	pos  Pos
+	els  bool
+}
+
+type loop struct {
+	start  int
+	pos    Pos
+	whiles []int
+}
+
+type macro struct {
+	params []string
+	body   []token
+}
+
+type compiler struct {
+	tokens []token
+	index  int
+	pos    Pos
+
+	rom    []byte
+	source []Pos
+	used   []bool
+	here   int
+
+	labels  map[string]int
+	consts  map[string]float64
+	aliases map[string]int
+	macros  map[string]*macro
+	protos  map[string][]proto
+
+	numExpansions int
+
+	branches []branch
+	loops    []loop
+	hasMain  bool
+}
+
+var registerNames = []string{"v0", "v1", "v2", "v3", "v4", "v5", "v6", "v7", "v8", "v9", "va", "vb", "vc", "vd", "ve", "vf"}
+
+// Compile compiles Octo source code. Like the reference compiler, it stops
+// at the first error and returns it as an *Error.
+func Compile(src string) (prog *Program, err error) {
+	tokens, err := lex(src)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &compiler{
+		tokens:  tokens,
+		here:    programStart,
+		labels:  make(map[string]int),
+		consts:  make(map[string]float64),
+		aliases: make(map[string]int),
+		macros:  make(map[string]*macro),
+		protos:  make(map[string][]proto),
+		hasMain: true,
+	}
+
+	defer func() {
+		if r := recover(); r != nil {
+			e, ok := r.(*Error)
+			if !ok {
+				panic(r)
+			}
+			prog, err = nil, e
+		}
+	}()
+
+	c.compile()
+	return c.program(), nil
+}
+
+func (c *compiler) compile() {
+	// Reserve room for 'jump main', it is dropped if main comes first.
+	c.inst(0x00, 0x00)
+
+	for !c.end() {
+		c.statement()
+	}
+
+	if len(c.branches) > 0 {
+		panic(errorf(c.branches[len(c.branches)-1].pos, "'begin' without 'end'"))
+	}
+	if len(c.loops) > 0 {
+		panic(errorf(c.loops[len(c.loops)-1].pos, "'loop' without 'again'"))
+	}
+
+	if len(c.protos) > 0 {
+		var names []string
+		for name := range c.protos {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		panic(errorf(c.protos[names[0]][0].pos, "undefined label '%s'", names[0]))
+	}
+
+	if c.hasMain {
+		addr, ok := c.labels["main"]
+		if !ok {
+			panic(errorf(c.pos, "this program is missing a 'main' label"))
+		}
+		c.rom[0] = 0x10 | byte(addr>>8&0xF)
+		c.rom[1] = byte(addr)
+	}
+}
+
+func (c *compiler) program() *Program {
+	prog := &Program{
+		Data:   c.rom,
+		Labels: make(map[string]uint16),
+		Source: c.source,
+	}
+	for name, addr := range c.labels {
+		prog.Labels[name] = uint16(addr)
+	}
+	return prog
+}
+
+func (c *compiler) end() bool {
+	return c.index >= len(c.tokens)
+}
+
+func (c *compiler) peek() token {
+	if c.end() {
+		return token{pos: c.pos}
+	}
+	return c.tokens[c.index]
+}
+
+func (c *compiler) next() token {
+	if c.end() {
+		panic(errorf(c.pos, "unexpected end of file"))
+	}
+	tok := c.tokens[c.index]
+	c.index++
+	c.pos = tok.pos
+	return tok
+}
+
+func (c *compiler) expect(text string) {
+	if tok := c.next(); tok.text != text || tok.str {
+		panic(errorf(tok.pos, "expected '%s', got '%s'", text, tok.text))
+	}
+}
+
+func (c *compiler) expectString() token {
+	tok := c.next()
+	if !tok.str {
+		panic(errorf(tok.pos, "expected string, got '%s'", tok.text))
+	}
+	return tok
+}
+
+func (c *compiler) emit(b byte) {
+	if c.here >= maxAddr {
+		panic(errorf(c.pos, "program exceeds %d bytes of memory", maxAddr))
+	}
+
+	i := c.here - programStart
+	for len(c.rom) <= i {
+		c.rom = append(c.rom, 0)
+		c.source = append(c.source, Pos{})
+		c.used = append(c.used, false)
+	}
+	if c.used[i] {
+		panic(errorf(c.pos, "data overlap at address 0x%04X", c.here))
+	}
+
+	c.rom[i] = b
+	c.source[i] = c.pos
+	c.used[i] = true
+	c.here++
+}
+
+func (c *compiler) inst(a, b byte) {
+	c.emit(a)
+	c.emit(b)
+}
+
+func (c *compiler) patch(addr int, b byte) {
+	c.rom[addr-programStart] = b
+}
+
+func (c *compiler) patchJump(addr, target int) {
+	c.patch(addr, 0x10|byte(target>>8&0xF))
+	c.patch(addr+1, byte(target))
+}
+
+func (c *compiler) isRegister(tok token) bool {
+	_, ok := c.registerIndex(tok)
+	return ok
+}
+
+func (c *compiler) registerIndex(tok token) (int, bool) {
+	if tok.str {
+		return 0, false
+	}
+	if r, ok := c.aliases[tok.text]; ok {
+		return r, true
+	}
+	for i, name := range registerNames {
+		if strings.ToLower(tok.text) == name {
+			return i, true
+		}
+	}
+	return 0, false
+}
+
+func (c *compiler) register() byte {
+	tok := c.next()
+	r, ok := c.registerIndex(tok)
+	if !ok {
+		panic(errorf(tok.pos, "expected register, got '%s'", tok.text))
+	}
+	return byte(r)
+}
+
+// number parses a numeric literal or constant.
+func (c *compiler) number(tok token) (int, bool) {
+	if tok.str {
+		return 0, false
+	}
+	if tok.isNum {
+		return int(tok.number), true
+	}
+	if v, ok := c.consts[tok.text]; ok {
+		return int(v), true
+	}
+	return 0, false
+}
+
+func (c *compiler) checkName(tok token) string {
+	if tok.str || tok.isNum || c.isRegister(tok) || keywords[tok.text] {
+		panic(errorf(tok.pos, "invalid name '%s'", tok.text))
+	}
+	return tok.text
+}
+
+func (c *compiler) value(bits uint) int {
+	tok := c.next()
+	n, ok := c.number(tok)
+	if !ok {
+		panic(errorf(tok.pos, "undefined constant '%s'", tok.text))
+	}
+
+	max := 1 << bits
+	if n < -(max>>1) || n >= max {
+		panic(errorf(tok.pos, "value '%s' (%d) does not fit in %d bits", tok.text, n, bits))
+	}
+	return n & (max - 1)
+}
+
+// address emits the two byte instruction op with a 12 bit address. Labels
+// that are not yet defined are patched once they are.
+func (c *compiler) address(op byte) {
+	tok := c.next()
+	if n, ok := c.number(tok); ok {
+		if n < 0 || n > 0xFFF {
+			panic(errorf(tok.pos, "address '%s' (0x%X) does not fit in 12 bits", tok.text, n))
+		}
+		c.inst(op|byte(n>>8), byte(n))
+		return
+	}
+
+	name := c.checkName(tok)
+	if addr, ok := c.labels[name]; ok {
+		c.inst(op|byte(addr>>8&0xF), byte(addr))
+		return
+	}
+
+	c.protos[name] = append(c.protos[name], proto{c.here, protoAddr, tok.pos})
+	c.inst(op, 0)
+}
+
+func (c *compiler) wideValue(kind protoKind) int {
+	tok := c.next()
+	if n, ok := c.number(tok); ok {
+		return n & 0xFFFF
+	}
+
+	name := c.checkName(tok)
+	if addr, ok := c.labels[name]; ok {
+		return addr
+	}
+	c.protos[name] = append(c.protos[name], proto{c.here, kind, tok.pos})
+	return 0
+}
+
+func (c *compiler) defineLabel(name string, pos Pos) {
+	if name == "main" && c.here == programStart+2 && c.hasMain {
+		// main comes first, drop the 'jump main'.
+		c.hasMain = false
+		c.here = programStart
+		c.rom, c.source, c.used = nil, nil, nil
+	}
+	c.bind(name, c.here, pos)
+}
+
+func (c *compiler) bind(name string, addr int, pos Pos) {
+	if _, ok := c.labels[name]; ok {
+		panic(errorf(pos, "the name '%s' has already been defined", name))
+	}
+	if _, ok := c.consts[name]; ok {
+		panic(errorf(pos, "the name '%s' has already been defined", name))
+	}
+
+	c.labels[name] = addr
+	for _, ref := range c.protos[name] {
+		c.resolve(ref, addr)
+	}
+	delete(c.protos, name)
+}
+
+func (c *compiler) resolve(ref proto, addr int) {
+	switch ref.kind {
+	case protoAddr:
+		if addr > 0xFFF {
+			panic(errorf(ref.pos, "label address 0x%04X does not fit in 12 bits", addr))
+		}
+		c.patch(ref.addr, c.rom[ref.addr-programStart]|byte(addr>>8))
+		c.patch(ref.addr+1, byte(addr))
+	case protoLong:
+		c.patch(ref.addr, byte(addr>>8))
+		c.patch(ref.addr+1, byte(addr))
+	case protoUnpack:
+		c.patch(ref.addr+1, c.rom[ref.addr+1-programStart]|byte(addr>>8&0xF))
+		c.patch(ref.addr+3, byte(addr))
+	}
+}
+
+var keywords = map[string]bool{
+	":=": true, "+=": true, "-=": true, "=-": true, "|=": true, "&=": true, "^=": true,
+	">>=": true, "<<=": true, "==": true, "!=": true, "<": true, ">": true, "<=": true, ">=": true,
+	"key": true, "-key": true, "hex": true, "bighex": true, "random": true, "delay": true, "buzzer": true,
+	"if": true, "then": true, "begin": true, "else": true, "end": true, "loop": true, "while": true, "again": true,
+	"jump": true, "jump0": true, "native": true, "return": true, ";": true, "clear": true, "bcd": true,
+	"save": true, "load": true, "sprite": true, "i": true, "long": true, "hires": true, "lores": true,
+	"exit": true, "scroll-down": true, "scroll-up": true, "scroll-left": true, "scroll-right": true,
+	"saveflags": true, "loadflags": true, "plane": true, "audio": true, "pitch": true,
+	"{": true, "}": true,
+}
+
+func (c *compiler) statement() {
+	tok := c.next()
+	if tok.str {
+		panic(errorf(tok.pos, "unexpected string"))
+	}
+	if tok.isNum {
+		n := int(tok.number)
+		if n < -128 || n > 255 {
+			panic(errorf(tok.pos, "literal value '%s' does not fit in a byte", tok.text))
+		}
+		c.emit(byte(n))
+		return
+	}
+
+	if strings.HasPrefix(tok.text, ":") {
+		c.directive(tok)
+		return
+	}
+	if c.isRegister(tok) {
+		c.registerOp(tok)
+		return
+	}
+
+	switch tok.text {
+	case "return", ";":
+		c.inst(0x00, 0xEE)
+	case "clear":
+		c.inst(0x00, 0xE0)
+	case "bcd":
+		c.inst(0xF0|c.register(), 0x33)
+	case "save", "load":
+		x := c.register()
+		if c.peek().text == "-" {
+			c.next()
+			y := c.register()
+			if tok.text == "save" {
+				c.inst(0x50|x, y<<4|0x2)
+			} else {
+				c.inst(0x50|x, y<<4|0x3)
+			}
+		} else if tok.text == "save" {
+			c.inst(0xF0|x, 0x55)
+		} else {
+			c.inst(0xF0|x, 0x65)
+		}
+	case "sprite":
+		x := c.register()
+		y := c.register()
+		c.inst(0xD0|x, y<<4|byte(c.value(4)))
+	case "jump":
+		c.address(0x10)
+	case "jump0":
+		c.address(0xB0)
+	case "native":
+		c.address(0x00)
+	case "hires":
+		c.inst(0x00, 0xFF)
+	case "lores":
+		c.inst(0x00, 0xFE)
+	case "exit":
+		c.inst(0x00, 0xFD)
+	case "scroll-down":
+		c.inst(0x00, 0xC0|byte(c.value(4)))
+	case "scroll-up":
+		c.inst(0x00, 0xD0|byte(c.value(4)))
+	case "scroll-right":
+		c.inst(0x00, 0xFB)
+	case "scroll-left":
+		c.inst(0x00, 0xFC)
+	case "saveflags":
+		c.inst(0xF0|c.register(), 0x75)
+	case "loadflags":
+		c.inst(0xF0|c.register(), 0x85)
+	case "plane":
+		c.inst(0xF0|byte(c.value(4)), 0x01)
+	case "audio":
+		c.inst(0xF0, 0x02)
+	case "delay", "buzzer", "pitch":
+		c.expect(":=")
+		op := map[string]byte{"delay": 0x15, "buzzer": 0x18, "pitch": 0x3A}[tok.text]
+		c.inst(0xF0|c.register(), op)
+	case "i":
+		c.indexOp()
+	case "if":
+		c.ifStatement(tok)
+	case "else":
+		if len(c.branches) == 0 || c.branches[len(c.branches)-1].els {
+			panic(errorf(tok.pos, "'else' without 'if ... begin'"))
+		}
+		b := &c.branches[len(c.branches)-1]
+		c.patchJump(b.addr, c.here+2)
+		b.addr, b.els = c.here, true
+		c.inst(0x00, 0x00)
+	case "end":
+		if len(c.branches) == 0 {
+			panic(errorf(tok.pos, "'end' without 'begin'"))
+		}
+		b := c.branches[len(c.branches)-1]
+		c.branches = c.branches[:len(c.branches)-1]
+		c.patchJump(b.addr, c.here)
+	case "loop":
+		c.loops = append(c.loops, loop{start: c.here, pos: tok.pos})
+	case "while":
+		if len(c.loops) == 0 {
+			panic(errorf(tok.pos, "'while' without 'loop'"))
+		}
+		c.emitCondition(c.condition(), true)
+		l := &c.loops[len(c.loops)-1]
+		l.whiles = append(l.whiles, c.here)
+		c.inst(0x00, 0x00)
+	case "again":
+		if len(c.loops) == 0 {
+			panic(errorf(tok.pos, "'again' without 'loop'"))
+		}
+		l := c.loops[len(c.loops)-1]
+		c.loops = c.loops[:len(c.loops)-1]
+		c.inst(0x10|byte(l.start>>8&0xF), byte(l.start))
+		for _, addr := range l.whiles {
+			c.patchJump(addr, c.here)
+		}
+	default:
+		if m, ok := c.macros[tok.text]; ok {
+			c.expandMacro(tok, m)
+			return
+		}
+		if keywords[tok.text] {
+			panic(errorf(tok.pos, "unexpected '%s'", tok.text))
+		}
+		c.index--
+		c.address(0x20)
+	}
+}
+
+func (c *compiler) directive(tok token) {
+	switch tok.text {
+	case ":":
+		name := c.next()
+		c.defineLabel(c.checkName(name), name.pos)
+	case ":const":
+		name := c.checkName(c.next())
+		v := c.next()
+		n, ok := c.number(v)
+		if !ok {
+			panic(errorf(v.pos, "undefined constant '%s'", v.text))
+		}
+		c.defineConst(name, float64(n), tok.pos)
+	case ":calc":
+		name := c.checkName(c.next())
+		c.defineConst(name, c.calc(), tok.pos)
+	case ":alias":
+		name := c.checkName(c.next())
+		c.aliases[name] = int(c.register())
+	case ":byte":
+		var n int
+		if c.peek().text == "{" {
+			n = int(c.calc())
+		} else {
+			n = c.value(8)
+		}
+		c.emit(byte(n))
+	case ":pointer":
+		addr := c.wideValue(protoLong)
+		c.inst(byte(addr>>8), byte(addr))
+	case ":org":
+		var n int
+		if c.peek().text == "{" {
+			n = int(c.calc())
+		} else {
+			v := c.next()
+			var ok bool
+			if n, ok = c.number(v); !ok {
+				panic(errorf(v.pos, "undefined constant '%s'", v.text))
+			}
+		}
+		if n < programStart || n >= maxAddr {
+			panic(errorf(tok.pos, "address 0x%X is outside of program memory", n))
+		}
+		c.here = n
+	case ":unpack":
+		nibble := c.value(4)
+		addr := c.wideValue(protoUnpack)
+		hi, lo := c.unpackRegisters()
+		c.inst(0x60|hi, byte(nibble<<4|addr>>8&0xF))
+		c.inst(0x60|lo, byte(addr))
+	case ":next":
+		name := c.next()
+		c.bind(c.checkName(name), c.here+1, name.pos)
+	case ":breakpoint":
+		c.next()
+	case ":monitor":
+		c.next()
+		c.next()
+	case ":assert":
+		msg := ""
+		if c.peek().str {
+			msg = c.next().text
+		}
+		if c.calc() == 0 {
+			if msg == "" {
+				msg = "assertion failed"
+			}
+			panic(errorf(tok.pos, "%s", msg))
+		}
+	case ":macro":
+		c.defineMacro()
+	default:
+		panic(errorf(tok.pos, "unknown directive '%s'", tok.text))
+	}
+}
+
+func (c *compiler) unpackRegisters() (byte, byte) {
+	hi, lo := 0, 1
+	if r, ok := c.aliases["unpack-hi"]; ok {
+		hi = r
+	}
+	if r, ok := c.aliases["unpack-lo"]; ok {
+		lo = r
+	}
+	return byte(hi), byte(lo)
+}
+
+func (c *compiler) defineConst(name string, v float64, pos Pos) {
+	if _, ok := c.labels[name]; ok {
+		panic(errorf(pos, "the name '%s' has already been defined", name))
+	}
+	if _, ok := c.consts[name]; ok {
+		panic(errorf(pos, "the name '%s' has already been defined", name))
+	}
+	c.consts[name] = v
+}
+
+func (c *compiler) indexOp() {
+	op := c.next()
+	switch op.text {
+	case ":=":
+		switch c.peek().text {
+		case "hex":
+			c.next()
+			c.inst(0xF0|c.register(), 0x29)
+		case "bighex":
+			c.next()
+			c.inst(0xF0|c.register(), 0x30)
+		case "long":
+			c.next()
+			c.inst(0xF0, 0x00)
+			addr := c.wideValue(protoLong)
+			c.inst(byte(addr>>8), byte(addr))
+		default:
+			c.address(0xA0)
+		}
+	case "+=":
+		c.inst(0xF0|c.register(), 0x1E)
+	default:
+		panic(errorf(op.pos, "unknown operator 'i %s'", op.text))
+	}
+}
+
+var registerOps = map[string]byte{
+	":=":  0x0,
+	"|=":  0x1,
+	"&=":  0x2,
+	"^=":  0x3,
+	"+=":  0x4,
+	"-=":  0x5,
+	">>=": 0x6,
+	"=-":  0x7,
+	"<<=": 0xE,
+}
+
+func (c *compiler) registerOp(dst token) {
+	x, _ := c.registerIndex(dst)
+	vx := byte(x)
+
+	op := c.next()
+	code, ok := registerOps[op.text]
+	if !ok {
+		panic(errorf(op.pos, "unknown operator '%s'", op.text))
+	}
+
+	src := c.peek()
+	if c.isRegister(src) {
+		c.inst(0x80|vx, c.register()<<4|code)
+		return
+	}
+
+	switch op.text {
+	case ":=":
+		switch src.text {
+		case "random":
+			c.next()
+			c.inst(0xC0|vx, byte(c.value(8)))
+		case "key":
+			c.next()
+			c.inst(0xF0|vx, 0x0A)
+		case "delay":
+			c.next()
+			c.inst(0xF0|vx, 0x07)
+		default:
+			c.inst(0x60|vx, byte(c.value(8)))
+		}
+	case "+=":
+		c.inst(0x70|vx, byte(c.value(8)))
+	case "-=":
+		c.inst(0x70|vx, byte(-c.value(8)))
+	default:
+		panic(errorf(src.pos, "operator '%s' expects a register, got '%s'", op.text, src.text))
+	}
+}
+
+var negatedConds = map[string]string{
+	"==":   "!=",
+	"!=":   "==",
+	"key":  "-key",
+	"-key": "key",
+	"<":    ">=",
+	">=":   "<",
+	">":    "<=",
+	"<=":   ">",
+}
+
+func (c *compiler) ifStatement(tok token) {
+	cond := c.condition()
+	if c.peek().text == "begin" {
+		c.next()
+		c.emitCondition(cond, true)
+		c.branches = append(c.branches, branch{addr: c.here, pos: tok.pos})
+		c.inst(0x00, 0x00)
+		return
+	}
+
+	c.expect("then")
+	c.emitCondition(cond, false)
+}
+
+type condition struct {
+	x     byte
+	op    token
+	isReg bool
+	y, n  byte
+}
+
+func (c *compiler) condition() condition {
+	cond := condition{x: c.register(), op: c.next()}
+	if _, ok := negatedConds[cond.op.text]; !ok {
+		panic(errorf(cond.op.pos, "unknown conditional operator '%s'", cond.op.text))
+	}
+	if cond.op.text == "key" || cond.op.text == "-key" {
+		return cond
+	}
+
+	if cond.isReg = c.isRegister(c.peek()); cond.isReg {
+		cond.y = c.register()
+	} else {
+		cond.n = byte(c.value(8))
+	}
+	return cond
+}
+
+// emitCondition emits code that skips the next instruction unless the
+// condition holds, or unless it does not hold when negated. Comparisons
+// are done through vf.
+func (c *compiler) emitCondition(cond condition, negated bool) {
+	op := cond.op.text
+	if negated {
+		op = negatedConds[op]
+	}
+
+	x, y, n := cond.x, cond.y, cond.n
+	compare := func(sub, skip byte) {
+		const temp = 0xF
+		if cond.isReg {
+			c.inst(0x80|temp, y<<4)
+		} else {
+			c.inst(0x60|temp, n)
+		}
+		c.inst(0x80|temp, x<<4|sub)
+		c.inst(skip|temp, 0x01)
+	}
+
+	switch op {
+	case "key":
+		c.inst(0xE0|x, 0xA1)
+	case "-key":
+		c.inst(0xE0|x, 0x9E)
+	case "==":
+		if cond.isReg {
+			c.inst(0x90|x, y<<4)
+		} else {
+			c.inst(0x40|x, n)
+		}
+	case "!=":
+		if cond.isReg {
+			c.inst(0x50|x, y<<4)
+		} else {
+			c.inst(0x30|x, n)
+		}
+	case ">":
+		compare(0x5, 0x30)
+	case "<":
+		compare(0x7, 0x30)
+	case ">=":
+		compare(0x7, 0x40)
+	case "<=":
+		compare(0x5, 0x40)
+	}
+}
+
+func (c *compiler) defineMacro() {
+	name := c.checkName(c.next())
+	if _, ok := c.macros[name]; ok {
+		panic(errorf(c.pos, "the macro '%s' has already been defined", name))
+	}
+
+	m := &macro{}
+	for c.peek().text != "{" {
+		m.params = append(m.params, c.checkName(c.next()))
+	}
+	c.next()
+
+	depth := 1
+	for {
+		tok := c.next()
+		if !tok.str {
+			switch tok.text {
+			case "{":
+				depth++
+			case "}":
+				depth--
+			}
+		}
+		if depth == 0 {
+			break
+		}
+		m.body = append(m.body, tok)
+	}
+	c.macros[name] = m
+}
+
+// expandMacro splices the macro body into the token stream with the
+// parameters replaced by the arguments.
+func (c *compiler) expandMacro(name token, m *macro) {
+	c.numExpansions++
+	if c.numExpansions > maxExpansions {
+		panic(errorf(name.pos, "too many macro expansions, recursive macro '%s'?", name.text))
+	}
+
+	args := make(map[string]token)
+	for _, p := range m.params {
+		args[p] = c.next()
+	}
+
+	body := make([]token, len(m.body), len(m.body)+len(c.tokens)-c.index)
+	for i, tok := range m.body {
+		if arg, ok := args[tok.text]; ok && !tok.str {
+			tok = arg
+		}
+		tok.pos = name.pos
+		body[i] = tok
+	}
+	c.tokens = append(body, c.tokens[c.index:]...)
+	c.index = 0
+}
@@ -0,0 +1,155 @@
+/*
+Copyright (C) 2016 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package octo
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Pos is a position in the source, both line and column start at 1.
+type Pos struct {
+	Line, Column int
+}
+
+// Error is a compilation error.
+type Error struct {
+	Pos
+	Msg string
+}
+
+type token struct {
+	text   string
+	str    bool
+	pos    Pos
+	number float64
+	isNum  bool
+}
+
+func (err *Error) Error() string {
+	return fmt.Sprintf("%d:%d: %s", err.Line, err.Column, err.Msg)
+}
+
+func errorf(pos Pos, format string, a ...interface{}) *Error {
+	return &Error{pos, fmt.Sprintf(format, a...)}
+}
+
+func parseNumber(s string) (float64, bool) {
+	neg := strings.HasPrefix(s, "-")
+	if neg {
+		s = s[1:]
+	}
+
+	var (
+		n   uint64
+		err error
+	)
+
+	switch {
+	case strings.HasPrefix(s, "0x") || strings.HasPrefix(s, "0X"):
+		n, err = strconv.ParseUint(s[2:], 16, 32)
+	case strings.HasPrefix(s, "0b") || strings.HasPrefix(s, "0B"):
+		n, err = strconv.ParseUint(s[2:], 2, 32)
+	default:
+		if f, err := strconv.ParseFloat(s, 64); err == nil && s != "" && unicode.IsDigit(rune(s[0])) && !math.IsInf(f, 0) {
+			if neg {
+				f = -f
+			}
+			return f, true
+		}
+		return 0, false
+	}
+
+	if err != nil {
+		return 0, false
+	}
+	if neg {
+		return -float64(n), true
+	}
+	return float64(n), true
+}
+
+// lex splits Octo source into whitespace separated tokens. Comments start
+// with '#' and strings are enclosed in double quotes.
+func lex(src string) ([]token, error) {
+	var tokens []token
+
+	line, col := 1, 1
+	advance := func(c byte) {
+		if c == '\n' {
+			line++
+			col = 1
+		} else {
+			col++
+		}
+	}
+
+	for i := 0; i < len(src); {
+		c := src[i]
+		switch {
+		case c == '#':
+			for i < len(src) && src[i] != '\n' {
+				advance(src[i])
+				i++
+			}
+		case unicode.IsSpace(rune(c)):
+			advance(c)
+			i++
+		case c == '"':
+			pos := Pos{line, col}
+			end := i + 1
+			for ; end < len(src) && src[end] != '"'; end++ {
+				if src[end] == '\\' {
+					end++
+				}
+				if end < len(src) && src[end] == '\n' {
+					return nil, errorf(pos, "unterminated string")
+				}
+			}
+			if end >= len(src) {
+				return nil, errorf(pos, "unterminated string")
+			}
+
+			s, err := strconv.Unquote(src[i : end+1])
+			if err != nil {
+				return nil, errorf(pos, "invalid string %s", src[i:end+1])
+			}
+			tokens = append(tokens, token{text: s, str: true, pos: pos})
+
+			for ; i <= end; i++ {
+				advance(src[i])
+			}
+		default:
+			pos := Pos{line, col}
+			start := i
+			for i < len(src) && !unicode.IsSpace(rune(src[i])) && src[i] != '#' {
+				advance(src[i])
+				i++
+			}
+
+			tok := token{text: src[start:i], pos: pos}
+			tok.number, tok.isNum = parseNumber(tok.text)
+			tokens = append(tokens, tok)
+		}
+	}
+
+	return tokens, nil
+}
@@ -0,0 +1,397 @@
+/*
+Copyright (C) 2016 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package chip8
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"sort"
+	"time"
+)
+
+// maxProfileDepth is the deepest call stack the profile records, the
+// stack of the system holds 16 return addresses.
+const maxProfileDepth = 17
+
+type (
+	// profileStack is an executed pc followed by the call sites of the
+	// subroutines it runs in, innermost first. Entries are the addresses of
+	// those subroutines, the last is the program start.
+	profileStack struct {
+		depth   int
+		pcs     [maxProfileDepth]uint16
+		entries [maxProfileDepth]uint16
+	}
+
+	profileCounts struct {
+		instructions, draws int64
+	}
+
+	// Profile records where a program spends its time. Every executed
+	// instruction and draw is counted with the call stack it ran in, and
+	// the draws of every frame, a 60Hz timer tick, are counted.
+	Profile struct {
+		// Executions counts the instructions executed at every address.
+		Executions [4096]uint64
+
+		// Frames is the number of frames run and FrameDraws[n] the number
+		// of frames with n draws.
+		Frames     int
+		FrameDraws []int
+
+		start  time.Time
+		draws  int
+		stacks map[profileStack]*profileCounts
+	}
+)
+
+// NewProfile returns an empty profile.
+func NewProfile() *Profile {
+	return &Profile{
+		start:  time.Now(),
+		stacks: make(map[profileStack]*profileCounts),
+	}
+}
+
+// SetProfile sets the profile that execution is recorded in, nil disables
+// profiling.
+func (sys *System) SetProfile(profile *Profile) {
+	sys.profile = profile
+}
+
+// Profile returns the profile set with SetProfile.
+func (sys *System) Profile() *Profile {
+	return sys.profile
+}
+
+// profileStep records the instruction about to be executed.
+func (sys *System) profileStep(opcode uint16) {
+	p := sys.profile
+	pc := sys.pc & 0xFFF
+	p.Executions[pc]++
+
+	depth := int(sys.sp)
+	if depth > len(sys.stack) {
+		if depth > 0xFF {
+			depth = 0
+		} else {
+			depth = len(sys.stack)
+		}
+	}
+
+	var s profileStack
+	s.depth = depth + 1
+	s.pcs[0] = pc
+	s.entries[depth] = 0x200
+	for i := 0; i < depth; i++ {
+		call := sys.stack[depth-1-i] & 0xFFF
+		s.pcs[i+1] = call
+		s.entries[i] = uint16(sys.memory[call]&0xF)<<8 | uint16(sys.memory[(call+1)&0xFFF])
+	}
+
+	counts, ok := p.stacks[s]
+	if !ok {
+		counts = new(profileCounts)
+		p.stacks[s] = counts
+	}
+	counts.instructions++
+	if opcode&0xF000 == 0xD000 {
+		counts.draws++
+		p.draws++
+	}
+}
+
+// endFrame counts the draws of the frame that ended.
+func (p *Profile) endFrame() {
+	for len(p.FrameDraws) <= p.draws {
+		p.FrameDraws = append(p.FrameDraws, 0)
+	}
+	p.FrameDraws[p.draws]++
+	p.Frames++
+	p.draws = 0
+}
+
+// Instructions returns the number of instructions executed.
+func (p *Profile) Instructions() uint64 {
+	var n uint64
+	for _, c := range p.Executions {
+		n += c
+	}
+	return n
+}
+
+// functionName returns the name of the subroutine at entry.
+func functionName(entry uint16, symbols Symbols) string {
+	if name, ok := symbols.Lookup(entry); ok {
+		return name
+	}
+	if entry == 0x200 {
+		return "main"
+	}
+	return fmt.Sprintf("sub_%03X", entry)
+}
+
+// WritePprof writes the profile in the gzipped protobuf format of pprof.
+// Samples are the instructions and draws of every call stack, named after
+// the subroutines they run in with the label of the code nested in them.
+// Symbols and the source map may be nil.
+func (p *Profile) WritePprof(writer io.Writer, symbols Symbols, sourceMap *SourceMap) error {
+	w := newPprofWriter()
+
+	instructions := p.Instructions()
+	comments := []string{fmt.Sprintf("%d instructions, %d frames", instructions, p.Frames)}
+	if p.Frames > 0 {
+		comments = append(comments, fmt.Sprintf("%.1f instructions per frame", float64(instructions)/float64(p.Frames)))
+		for n, frames := range p.FrameDraws {
+			if frames > 0 {
+				comments = append(comments, fmt.Sprintf("%d frames with %d draws", frames, n))
+			}
+		}
+	}
+
+	stacks := make([]profileStack, 0, len(p.stacks))
+	for s := range p.stacks {
+		stacks = append(stacks, s)
+	}
+	sort.Slice(stacks, func(i, j int) bool {
+		a, b := stacks[i], stacks[j]
+		for k := 0; k < a.depth && k < b.depth; k++ {
+			if a.pcs[k] != b.pcs[k] {
+				return a.pcs[k] < b.pcs[k]
+			}
+			if a.entries[k] != b.entries[k] {
+				return a.entries[k] < b.entries[k]
+			}
+		}
+		return a.depth < b.depth
+	})
+
+	for _, s := range stacks {
+		var locs []uint64
+		for k := 0; k < s.depth; k++ {
+			locs = append(locs, w.location(s.pcs[k], s.entries[k], symbols, sourceMap))
+		}
+		c := p.stacks[s]
+		w.sample(locs, []int64{c.instructions, c.draws})
+	}
+
+	gz := gzip.NewWriter(writer)
+	if _, err := gz.Write(w.profile(p.start, comments)); err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+type (
+	// protobuf encodes protocol buffer messages.
+	protobuf struct {
+		data []byte
+	}
+
+	pprofLocation struct {
+		pc, entry uint16
+	}
+
+	pprofFunction struct {
+		name, file string
+	}
+
+	// pprofWriter builds the message of profile.proto from pprof.
+	pprofWriter struct {
+		samples   protobuf
+		locations protobuf
+		functions protobuf
+
+		strings   []string
+		stringIDs map[string]int64
+		locIDs    map[pprofLocation]uint64
+		funcIDs   map[pprofFunction]uint64
+	}
+)
+
+func (b *protobuf) varint(x uint64) {
+	for x >= 0x80 {
+		b.data = append(b.data, byte(x)|0x80)
+		x >>= 7
+	}
+	b.data = append(b.data, byte(x))
+}
+
+func (b *protobuf) uint64(tag int, x uint64) {
+	if x != 0 {
+		b.varint(uint64(tag) << 3)
+		b.varint(x)
+	}
+}
+
+func (b *protobuf) int64(tag int, x int64) {
+	b.uint64(tag, uint64(x))
+}
+
+func (b *protobuf) packed(tag int, xs []uint64) {
+	var m protobuf
+	for _, x := range xs {
+		m.varint(x)
+	}
+	b.message(tag, &m)
+}
+
+func (b *protobuf) message(tag int, m *protobuf) {
+	b.varint(uint64(tag)<<3 | 2)
+	b.varint(uint64(len(m.data)))
+	b.data = append(b.data, m.data...)
+}
+
+func (b *protobuf) string(tag int, s string) {
+	b.message(tag, &protobuf{[]byte(s)})
+}
+
+func newPprofWriter() *pprofWriter {
+	return &pprofWriter{
+		strings:   []string{""},
+		stringIDs: map[string]int64{"": 0},
+		locIDs:    make(map[pprofLocation]uint64),
+		funcIDs:   make(map[pprofFunction]uint64),
+	}
+}
+
+func (w *pprofWriter) stringID(s string) int64 {
+	id, ok := w.stringIDs[s]
+	if !ok {
+		id = int64(len(w.strings))
+		w.strings = append(w.strings, s)
+		w.stringIDs[s] = id
+	}
+	return id
+}
+
+func (w *pprofWriter) function(name, file string) uint64 {
+	key := pprofFunction{name, file}
+	if id, ok := w.funcIDs[key]; ok {
+		return id
+	}
+
+	id := uint64(len(w.funcIDs) + 1)
+	w.funcIDs[key] = id
+
+	var m protobuf
+	m.uint64(1, id)
+	m.int64(2, w.stringID(name))
+	m.int64(3, w.stringID(name))
+	m.int64(4, w.stringID(file))
+	w.functions.message(5, &m)
+	return id
+}
+
+// location returns the location of pc in the subroutine at entry. If pc
+// is below another label than entry, the code of that label is written as
+// inlined into the subroutine.
+func (w *pprofWriter) location(pc, entry uint16, symbols Symbols, sourceMap *SourceMap) uint64 {
+	key := pprofLocation{pc, entry}
+	if id, ok := w.locIDs[key]; ok {
+		return id
+	}
+
+	id := uint64(len(w.locIDs) + 1)
+	w.locIDs[key] = id
+
+	var file string
+	var line int64
+	if loc, ok := sourceMap.Lookup(pc); ok {
+		file, line = loc.File, int64(loc.Line)
+	}
+
+	var m protobuf
+	m.uint64(1, id)
+	m.uint64(2, 1)
+	m.uint64(3, uint64(pc))
+
+	fn := functionName(entry, symbols)
+	i := sort.Search(len(symbols), func(i int) bool {
+		return symbols[i].Addr > pc
+	})
+	if i > 0 && symbols[i-1].Addr > entry && symbols[i-1].Name != fn {
+		var l protobuf
+		l.uint64(1, w.function(symbols[i-1].Name, file))
+		l.int64(2, line)
+		m.message(4, &l)
+	}
+
+	var l protobuf
+	l.uint64(1, w.function(fn, file))
+	l.int64(2, line)
+	m.message(4, &l)
+
+	w.locations.message(4, &m)
+	return id
+}
+
+func (w *pprofWriter) sample(locs []uint64, values []int64) {
+	var m protobuf
+	m.packed(1, locs)
+	vals := make([]uint64, len(values))
+	for i, v := range values {
+		vals[i] = uint64(v)
+	}
+	m.packed(2, vals)
+	w.samples.message(2, &m)
+}
+
+func (w *pprofWriter) valueType(tag int, typ, unit string, b *protobuf) {
+	var m protobuf
+	m.int64(1, w.stringID(typ))
+	m.int64(2, w.stringID(unit))
+	b.message(tag, &m)
+}
+
+func (w *pprofWriter) profile(start time.Time, comments []string) []byte {
+	var b protobuf
+	w.valueType(1, "instructions", "count", &b)
+	w.valueType(1, "draws", "count", &b)
+	b.data = append(b.data, w.samples.data...)
+
+	var mapping protobuf
+	mapping.uint64(1, 1)
+	mapping.uint64(3, 0x1000)
+	mapping.uint64(7, 1)
+	mapping.uint64(8, 1)
+	mapping.uint64(9, 1)
+	b.message(3, &mapping)
+
+	b.data = append(b.data, w.locations.data...)
+	b.data = append(b.data, w.functions.data...)
+
+	ids := make([]int64, len(comments))
+	for i, c := range comments {
+		ids[i] = w.stringID(c)
+	}
+	for _, s := range w.strings {
+		b.string(6, s)
+	}
+
+	b.int64(9, start.UnixNano())
+	b.int64(10, int64(time.Since(start)))
+	w.valueType(11, "instructions", "count", &b)
+	b.int64(12, 1)
+	for _, id := range ids {
+		b.int64(13, id)
+	}
+	b.int64(14, w.stringID("instructions"))
+	return b.data
+}
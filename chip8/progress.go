@@ -0,0 +1,190 @@
+/*
+Copyright (C) 2016 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package chip8
+
+import "fmt"
+
+// State is what a program is doing.
+type State int
+
+const (
+	// Running is a program that makes progress.
+	Running State = iota
+	// WaitingTimer is a program that loops until the delay timer changes.
+	WaitingTimer
+	// WaitingKey is a program that loops until a key is pressed or
+	// released.
+	WaitingKey
+	// Finished is a program that loops forever, like a jump to itself.
+	Finished
+)
+
+func (s State) String() string {
+	switch s {
+	case Running:
+		return "running"
+	case WaitingTimer:
+		return "waiting for the timer"
+	case WaitingKey:
+		return "waiting for a key"
+	case Finished:
+		return "program finished"
+	}
+	return fmt.Sprintf("State(%d)", int(s))
+}
+
+// Event reports that the program changed state, PC is the instruction it
+// was found at.
+type Event struct {
+	State State
+	PC    uint16
+}
+
+type (
+	// machineState is the state a program can change, not counting the
+	// timers.
+	machineState struct {
+		pc, i, sp uint16
+		v         [16]byte
+		stack     [16]uint16
+	}
+
+	// progressWatch finds loops without progress. It remembers the state at
+	// steps that are powers of two after the last progress and reports a
+	// loop when the state is seen again, which finds a loop of any length
+	// in at most twice as many steps.
+	progressWatch struct {
+		state    State
+		handler  func(Event)
+		snapshot machineState
+		valid    bool
+		power    int
+		steps    int
+
+		timer                byte
+		readsTimer, readsKey bool
+		low, high            uint16
+		loopLow, loopHigh    uint16
+	}
+)
+
+// SetEvents sets the function called when the program changes state. nil
+// disables events.
+func (sys *System) SetEvents(handler func(Event)) {
+	sys.watch.handler = handler
+}
+
+// State returns the state of the program, as found by Step.
+func (sys *System) State() State {
+	return sys.watch.state
+}
+
+func (sys *System) machineState() machineState {
+	return machineState{sys.pc, sys.i, sys.sp, sys.v, sys.stack}
+}
+
+// progress reports whether opcode changes anything outside the machine
+// state, or depends on randomness.
+func progress(opcode uint16) bool {
+	switch opcode & 0xF000 {
+	case 0x0:
+		return opcode != 0x00EE
+	case 0xC000, 0xD000:
+		return true
+	case 0xF000:
+		switch opcode & 0xFF {
+		case 0x15, 0x18, 0x30, 0x33, 0x55, 0x75, 0x85:
+			return true
+		}
+	}
+	return false
+}
+
+func (sys *System) setState(state State) {
+	w := &sys.watch
+	if w.state == state {
+		return
+	}
+	w.state = state
+	if w.handler != nil {
+		w.handler(Event{state, sys.pc})
+	}
+}
+
+// resetWatch starts looking for a new loop.
+func (sys *System) resetWatch() {
+	w := &sys.watch
+	w.valid = false
+	w.power = 1
+	w.steps = 0
+}
+
+// watchProgress looks for a loop without progress before opcode is
+// executed.
+func (sys *System) watchProgress(opcode uint16) {
+	w := &sys.watch
+	pc := sys.pc & 0xFFF
+
+	if w.state != Running && (pc < w.loopLow || pc > w.loopHigh || progress(opcode)) {
+		sys.setState(Running)
+		sys.resetWatch()
+	}
+
+	// A loop is found again while waiting, so a timer that ran out
+	// without the loop ending finishes the program.
+	current := sys.machineState()
+	if w.valid && current == w.snapshot && w.state != Finished {
+		w.loopLow, w.loopHigh = w.low, w.high
+		switch {
+		case w.readsTimer && (sys.delayTimer > 0 || sys.delayTimer != w.timer):
+			sys.setState(WaitingTimer)
+		case w.readsKey:
+			sys.setState(WaitingKey)
+		default:
+			sys.setState(Finished)
+		}
+	}
+
+	if !w.valid || w.steps == w.power {
+		w.snapshot = current
+		w.valid = true
+		w.power *= 2
+		w.steps = 0
+		w.timer = sys.delayTimer
+		w.readsTimer, w.readsKey = false, false
+		w.low, w.high = pc, pc
+	}
+	w.steps++
+
+	if progress(opcode) {
+		sys.resetWatch()
+		return
+	}
+	if pc < w.low {
+		w.low = pc
+	}
+	if pc > w.high {
+		w.high = pc
+	}
+	switch {
+	case opcode&0xF0FF == 0xF007:
+		w.readsTimer = true
+	case opcode&0xF0FF == 0xF00A, opcode&0xF0FF == 0xE09E, opcode&0xF0FF == 0xE0A1:
+		w.readsKey = true
+	}
+}
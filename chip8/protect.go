@@ -0,0 +1,58 @@
+/*
+Copyright (C) 2016 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package chip8
+
+import "fmt"
+
+// ProtectionError is returned by Step when the store at PC would write to
+// protected memory at Addr. The store is not executed, so the state of the
+// system is the one before it.
+type ProtectionError struct {
+	PC, Addr, Opcode uint16
+}
+
+func (e *ProtectionError) Error() string {
+	return fmt.Sprintf("0x%X: opcode 0x%X writes to protected memory at 0x%X", e.PC, e.Opcode, e.Addr)
+}
+
+// Protect makes the memory [start, end) read-only, a store that writes to
+// it stops with a ProtectionError. Protect(0, 0x200) protects the memory of
+// the interpreter and the font. Protection is kept across resets.
+func (sys *System) Protect(start, end uint16) {
+	for addr := start; addr < end && int(addr) < len(sys.protected); addr++ {
+		sys.protected[addr] = true
+	}
+}
+
+// Unprotect makes the memory [start, end) writable again.
+func (sys *System) Unprotect(start, end uint16) {
+	for addr := start; addr < end && int(addr) < len(sys.protected); addr++ {
+		sys.protected[addr] = false
+	}
+}
+
+// checkStore returns a ProtectionError if the n bytes at the index register
+// are protected.
+func (sys *System) checkStore(opcode, n uint16) error {
+	for i := uint16(0); i < n; i++ {
+		if addr := (sys.i + i) & 0xFFF; sys.protected[addr] {
+			return &ProtectionError{sys.pc, addr, opcode}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,134 @@
+/*
+Copyright (C) 2016 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package chip8
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+)
+
+// SourceMapVersion is the version of the source map format written by
+// this package.
+const SourceMapVersion = 1
+
+// SourcePos is a position in one of the files of a source map.
+type SourcePos struct {
+	File   int `json:"file"`
+	Line   int `json:"line"`
+	Column int `json:"column"`
+}
+
+// SourceRange maps the addresses [Start, End) to a source position, End
+// is at most 0x10000 so a range can include the last byte of memory. If
+// the code was produced by a macro, ExpandedFrom lists the positions the
+// macro was expanded at, innermost first.
+type SourceRange struct {
+	Start int `json:"start"`
+	End   int `json:"end"`
+	SourcePos
+	ExpandedFrom []SourcePos `json:"expandedFrom,omitempty"`
+}
+
+// SourceMap maps program addresses back to the source it was assembled from.
+type SourceMap struct {
+	Version int           `json:"version"`
+	Files   []string      `json:"files"`
+	Ranges  []SourceRange `json:"ranges"`
+}
+
+// SourceLocation is a resolved source position.
+type SourceLocation struct {
+	File         string
+	Line, Column int
+	ExpandedFrom []SourceLocation
+}
+
+func (loc SourceLocation) String() string {
+	return fmt.Sprintf("%s:%d:%d", loc.File, loc.Line, loc.Column)
+}
+
+// ReadSourceMap reads a JSON source map.
+func ReadSourceMap(reader io.Reader) (*SourceMap, error) {
+	m := new(SourceMap)
+	if err := json.NewDecoder(reader).Decode(m); err != nil {
+		return nil, err
+	}
+
+	if m.Version != SourceMapVersion {
+		return nil, fmt.Errorf("unsupported source map version %d", m.Version)
+	}
+
+	for _, r := range m.Ranges {
+		if r.Start < 0 || r.End < r.Start || r.End > 0x10000 {
+			return nil, fmt.Errorf("invalid address range %d-%d in source map", r.Start, r.End)
+		}
+		if err := m.checkPos(r.SourcePos); err != nil {
+			return nil, err
+		}
+		for _, pos := range r.ExpandedFrom {
+			if err := m.checkPos(pos); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	sort.SliceStable(m.Ranges, func(i, j int) bool {
+		return m.Ranges[i].Start < m.Ranges[j].Start
+	})
+	return m, nil
+}
+
+func (m *SourceMap) checkPos(pos SourcePos) error {
+	if pos.File < 0 || pos.File >= len(m.Files) {
+		return fmt.Errorf("invalid file index %d in source map", pos.File)
+	}
+	return nil
+}
+
+// Write writes the source map as JSON.
+func (m *SourceMap) Write(writer io.Writer) error {
+	m.Version = SourceMapVersion
+	return json.NewEncoder(writer).Encode(m)
+}
+
+func (m *SourceMap) location(pos SourcePos) SourceLocation {
+	return SourceLocation{File: m.Files[pos.File], Line: pos.Line, Column: pos.Column}
+}
+
+// Lookup returns the source location of the code at addr.
+func (m *SourceMap) Lookup(addr uint16) (SourceLocation, bool) {
+	if m == nil {
+		return SourceLocation{}, false
+	}
+
+	i := sort.Search(len(m.Ranges), func(i int) bool {
+		return m.Ranges[i].End > int(addr)
+	})
+	if i == len(m.Ranges) || m.Ranges[i].Start > int(addr) {
+		return SourceLocation{}, false
+	}
+
+	r := m.Ranges[i]
+	loc := m.location(r.SourcePos)
+	for _, pos := range r.ExpandedFrom {
+		loc.ExpandedFrom = append(loc.ExpandedFrom, m.location(pos))
+	}
+	return loc, true
+}
@@ -0,0 +1,108 @@
+/*
+Copyright (C) 2016 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package chip8
+
+import "fmt"
+
+// Warning is a suspicious memory access made by the instruction at PC.
+type Warning struct {
+	PC, Addr uint16
+	Message  string
+}
+
+func (w Warning) String() string {
+	return fmt.Sprintf("$%03X: %s", w.PC, w.Message)
+}
+
+type warningKind int
+
+const (
+	warnUninitialized warningKind = iota
+	warnSelfModifying
+)
+
+type warningKey struct {
+	pc   uint16
+	kind warningKind
+}
+
+// SetWarnings sets the function called with the warnings of strict mode
+// and self-modifying code. Every instruction is warned about once for each
+// kind of warning. nil disables warnings.
+func (sys *System) SetWarnings(warn func(Warning)) {
+	sys.warn = warn
+}
+
+// SetStrict sets whether to warn when the program executes or reads memory
+// that was never written by the program load, the font or a store. It
+// takes effect at the next Reset, which loads the program twice to find the
+// bytes that belong to it.
+func (sys *System) SetStrict(enable bool) {
+	sys.strict = enable
+}
+
+// SetRandomFill sets whether Reset fills memory with random bytes instead
+// of zeros before the font and program are loaded. It takes effect at the
+// next Reset.
+func (sys *System) SetRandomFill(enable bool) {
+	sys.randomFill = enable
+}
+
+func (sys *System) warning(kind warningKind, addr uint16, format string, args ...interface{}) {
+	key := warningKey{sys.pc, kind}
+	if sys.warn == nil || sys.warned[key] {
+		return
+	}
+	if sys.warned == nil {
+		sys.warned = make(map[warningKey]bool)
+	}
+	sys.warned[key] = true
+	sys.warn(Warning{sys.pc, addr, fmt.Sprintf(format, args...)})
+}
+
+// load loads the program. In strict mode it is loaded over zeros and over
+// $FF, the bytes that are the same both times are the program.
+func (sys *System) load() {
+	sys.warned = nil
+	program := sys.memory[512:]
+	if !sys.strict {
+		sys.io.Load(program)
+		return
+	}
+
+	zeros := make([]byte, len(program))
+	ones := make([]byte, len(program))
+	for i := range ones {
+		ones[i] = 0xFF
+	}
+	sys.io.Load(zeros)
+	sys.io.Load(ones)
+
+	for i, x := range zeros {
+		if x == ones[i] {
+			program[i] = x
+			sys.initialized[512+i] = true
+		}
+	}
+}
+
+func (sys *System) checkInitialized(addr uint16, access string) {
+	if addr &= 0xFFF; !sys.initialized[addr] {
+		sys.warning(warnUninitialized, addr, "%s uninitialized memory at $%03X", access, addr)
+	}
+}
@@ -0,0 +1,100 @@
+/*
+Copyright (C) 2016 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package chip8
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Symbol is a named address, usually a label from the assembler.
+type Symbol struct {
+	Name string
+	Addr uint16
+}
+
+// Symbols is a list of symbols sorted by address.
+type Symbols []Symbol
+
+// ReadSymbols reads a symbol file. Every line holds a hexadecimal address
+// followed by a name, everything after ';' is a comment.
+func ReadSymbols(reader io.Reader) (Symbols, error) {
+	var symbols Symbols
+
+	scanner := bufio.NewScanner(reader)
+	for line := 1; scanner.Scan(); line++ {
+		text := scanner.Text()
+		if i := strings.IndexByte(text, ';'); i >= 0 {
+			text = text[:i]
+		}
+
+		fields := strings.Fields(text)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("invalid symbol, line %d", line)
+		}
+
+		addr, err := strconv.ParseUint(fields[0], 16, 16)
+		if err != nil {
+			return nil, fmt.Errorf("invalid symbol address, line %d", line)
+		}
+		symbols = append(symbols, Symbol{fields[1], uint16(addr)})
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	sort.SliceStable(symbols, func(i, j int) bool {
+		return symbols[i].Addr < symbols[j].Addr
+	})
+	return symbols, nil
+}
+
+// WriteSymbols writes symbols in the format read by ReadSymbols.
+func WriteSymbols(writer io.Writer, symbols Symbols) error {
+	w := bufio.NewWriter(writer)
+	fmt.Fprintln(w, "; chip8 symbols")
+	for _, sym := range symbols {
+		fmt.Fprintf(w, "%04X %s\n", sym.Addr, sym.Name)
+	}
+	return w.Flush()
+}
+
+// Lookup returns the closest symbol at or below addr formatted as name or
+// name+offset.
+func (symbols Symbols) Lookup(addr uint16) (string, bool) {
+	i := sort.Search(len(symbols), func(i int) bool {
+		return symbols[i].Addr > addr
+	})
+	if i == 0 {
+		return "", false
+	}
+
+	sym := symbols[i-1]
+	if sym.Addr == addr {
+		return sym.Name, true
+	}
+	return fmt.Sprintf("%s+%d", sym.Name, addr-sym.Addr), true
+}
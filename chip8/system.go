@@ -83,11 +83,97 @@ type System struct {
 	fgColor, bgColor byte
 	screenWidth      uint16
 	draw             bool
+
+	symbols   Symbols
+	sourceMap *SourceMap
+	coverage  *Coverage
+	profile   *Profile
+
+	warn        func(Warning)
+	warned      map[warningKey]bool
+	strict      bool
+	randomFill  bool
+	initialized [4096]bool
+	executed    [4096]bool
+	protected   [4096]bool
+
+	watch progressWatch
+}
+
+// SetSymbols sets the symbols used to annotate addresses in dumps.
+func (sys *System) SetSymbols(symbols Symbols) {
+	sys.symbols = symbols
+}
+
+// SetSourceMap sets the source map used to annotate addresses in dumps.
+func (sys *System) SetSourceMap(sourceMap *SourceMap) {
+	sys.sourceMap = sourceMap
+}
+
+// SetCoverage sets the coverage that memory accesses are counted in, nil
+// disables coverage. The coverage is kept across resets.
+func (sys *System) SetCoverage(coverage *Coverage) {
+	sys.coverage = coverage
+}
+
+// Coverage returns the coverage set with SetCoverage.
+func (sys *System) Coverage() *Coverage {
+	return sys.coverage
+}
+
+// noteExecute records the execution of the opcode at pc.
+func (sys *System) noteExecute() {
+	if sys.coverage != nil {
+		sys.coverage.Executed[sys.pc&0xFFF]++
+		sys.coverage.Executed[(sys.pc+1)&0xFFF]++
+	}
+	if sys.strict {
+		sys.checkInitialized(sys.pc, "executes")
+		sys.checkInitialized(sys.pc+1, "executes")
+	}
+	sys.executed[sys.pc&0xFFF] = true
+	sys.executed[(sys.pc+1)&0xFFF] = true
+}
+
+// noteRead records a read of addr as data.
+func (sys *System) noteRead(addr uint16) {
+	if sys.coverage != nil {
+		sys.coverage.Read[addr&0xFFF]++
+	}
+	if sys.strict {
+		sys.checkInitialized(addr, "reads")
+	}
+}
+
+// noteWrite records a write to addr.
+func (sys *System) noteWrite(addr uint16) {
+	if sys.coverage != nil {
+		sys.coverage.Written[addr&0xFFF]++
+	}
+	sys.initialized[addr&0xFFF] = true
+	if sys.executed[addr&0xFFF] {
+		sys.warning(warnSelfModifying, addr&0xFFF, "self-modifying code, writes to $%03X, which was executed", addr&0xFFF)
+	}
+}
+
+func (sys *System) addrName(addr uint16) string {
+	if name, ok := sys.symbols.Lookup(addr); ok {
+		return fmt.Sprintf(" <%s>", name)
+	}
+	return ""
 }
 
 func (sys *System) Dump(writer io.Writer, name string) error {
 	fmt.Fprintf(writer, "%v\n%s\n\n", time.Now(), name)
-	fmt.Fprintf(writer, "PC: 0x%X, SP: 0x%X, I: 0x%X\n\n", sys.pc, sys.sp, sys.i)
+	fmt.Fprintf(writer, "PC: 0x%X%s, SP: 0x%X, I: 0x%X%s\n\n", sys.pc, sys.addrName(sys.pc), sys.sp, sys.i, sys.addrName(sys.i))
+
+	if loc, ok := sys.sourceMap.Lookup(sys.pc); ok {
+		fmt.Fprintf(writer, "Source: %v\n", loc)
+		for _, exp := range loc.ExpandedFrom {
+			fmt.Fprintf(writer, "Expanded from: %v\n", exp)
+		}
+		fmt.Fprintln(writer)
+	}
 
 	for i, v := range sys.v {
 		fmt.Fprintf(writer, "V%d: 0x%X\n", i, v)
@@ -96,6 +182,13 @@ func (sys *System) Dump(writer io.Writer, name string) error {
 	stackDumper := hex.Dumper(writer)
 	defer stackDumper.Close()
 
+	if sys.symbols != nil {
+		fmt.Fprintln(writer)
+		for i := uint16(0); i < sys.sp&0xF; i++ {
+			fmt.Fprintf(writer, "Stack %d: 0x%X%s\n", i, sys.stack[i], sys.addrName(sys.stack[i]))
+		}
+	}
+
 	fmt.Fprintln(writer)
 	if err := binary.Write(stackDumper, binary.BigEndian, sys.stack[:]); err != nil {
 		return err
@@ -146,14 +239,23 @@ func (sys *System) Reset() {
 
 	for i := range sys.memory {
 		sys.memory[i] = 0
+		if sys.randomFill {
+			sys.memory[i] = byte(sys.rnd.Intn(256))
+		}
+		sys.initialized[i] = false
+		sys.executed[i] = false
 	}
 
 	for i, x := range fontset {
 		sys.memory[i] = x
+		sys.initialized[i] = true
 	}
 
 	sys.clearScreen()
-	sys.io.Load(sys.memory[512:])
+	sys.load()
+
+	sys.resetWatch()
+	sys.setState(Running)
 }
 
 func (sys *System) clearScreen() {
@@ -196,6 +298,9 @@ func (sys *System) tickTimers() {
 		return
 	}
 	sys.lastTick = time.Now()
+	if sys.profile != nil {
+		sys.profile.endFrame()
+	}
 
 	if sys.delayTimer > 0 {
 		sys.delayTimer--
@@ -353,16 +458,27 @@ func (sys *System) opF(opcode uint16) error {
 	case 0x30:
 		return ErrSuperChipNotSupported
 	case 0x33:
+		if err := sys.checkStore(opcode, 3); err != nil {
+			return err
+		}
 		sys.memory[sys.i&0xFFF] = sys.v[(opcode&0xF00)>>8] / 100
 		sys.memory[(sys.i+1)&0xFFF] = (sys.v[(opcode&0xF00)>>8] / 10) % 10
 		sys.memory[(sys.i+2)&0xFFF] = sys.v[(opcode&0xF00)>>8] % 10
+		for i := uint16(0); i < 3; i++ {
+			sys.noteWrite(sys.i + i)
+		}
 	case 0x55:
+		if err := sys.checkStore(opcode, (opcode&0xF00)>>8+1); err != nil {
+			return err
+		}
 		for i := uint16(0); i <= ((opcode & 0xF00) >> 8); i++ {
 			sys.memory[(sys.i+i)&0xFFF] = sys.v[i]
+			sys.noteWrite(sys.i + i)
 		}
 	case 0x65:
 		for i := uint16(0); i <= ((opcode & 0xF00) >> 8); i++ {
 			sys.v[i] = sys.memory[(sys.i+i)&0xFFF]
+			sys.noteRead(sys.i + i)
 		}
 	case 0x75, 0x85:
 		return ErrSuperChipNotSupported
@@ -378,6 +494,11 @@ func (sys *System) opF(opcode uint16) error {
 
 func (sys *System) Step() error {
 	opcode := uint16(sys.memory[sys.pc&0xFFF])<<8 | uint16(sys.memory[(sys.pc+1)&0xFFF])
+	sys.noteExecute()
+	sys.watchProgress(opcode)
+	if sys.profile != nil {
+		sys.profileStep(opcode)
+	}
 
 	switch opcode & 0xF000 {
 	case 0x0:
@@ -443,6 +564,7 @@ func (sys *System) Step() error {
 		sys.v[0xF] = 0
 		for yline := uint16(0); yline < height; yline++ {
 			pixel := sys.memory[(sys.i+yline)&0xFFF]
+			sys.noteRead(sys.i + yline)
 			for xline := uint16(0); xline < 8; xline++ {
 				if (pixel & (0x80 >> xline)) != 0 {
 					offset := x + xline + ((y + yline) * sys.screenWidth)
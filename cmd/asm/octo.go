@@ -0,0 +1,95 @@
+/*
+Copyright (C) 2016 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"sort"
+
+	"github.com/andreas-jonsson/chip8/chip8"
+	"github.com/andreas-jonsson/chip8/chip8/asm"
+	"github.com/andreas-jonsson/chip8/chip8/octo"
+	"github.com/andreas-jonsson/chip8/cmd/internal/cli"
+)
+
+// compileOcto compiles an Octo source file. Errors are returned as
+// diagnostics in the same way as for assembly source.
+func compileOcto(fileName string) ([]byte, *chip8.SourceMap, chip8.Symbols, []asm.Diagnostic, error) {
+	src, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return nil, nil, nil, nil, err
+	}
+
+	prog, err := octo.Compile(string(src))
+	if err != nil {
+		e, ok := err.(*octo.Error)
+		if !ok {
+			return nil, nil, nil, nil, err
+		}
+		d := asm.Diagnostic{File: fileName, Line: e.Line, Column: e.Column, Severity: asm.SeverityError, Message: e.Msg}
+		return nil, nil, nil, []asm.Diagnostic{d}, nil
+	}
+
+	var symbols chip8.Symbols
+	for name, addr := range prog.Labels {
+		symbols = append(symbols, chip8.Symbol{Name: name, Addr: addr})
+	}
+	sort.Slice(symbols, func(i, j int) bool {
+		if symbols[i].Addr == symbols[j].Addr {
+			return symbols[i].Name < symbols[j].Name
+		}
+		return symbols[i].Addr < symbols[j].Addr
+	})
+
+	return prog.Data, octoSourceMap(fileName, prog.Source), symbols, nil, nil
+}
+
+// octoSourceMap merges the source position of every byte of the program
+// into address ranges.
+func octoSourceMap(fileName string, source []octo.Pos) *chip8.SourceMap {
+	m := &chip8.SourceMap{Files: []string{fileName}}
+	for i := 0; i < len(source); {
+		end := i + 1
+		for end < len(source) && source[end] == source[i] {
+			end++
+		}
+
+		if pos := source[i]; pos.Line > 0 {
+			m.Ranges = append(m.Ranges, chip8.SourceRange{
+				Start:     programStart + i,
+				End:       programStart + end,
+				SourcePos: chip8.SourcePos{Line: pos.Line, Column: pos.Column},
+			})
+		}
+		i = end
+	}
+	return m
+}
+
+func writeOctoOutput(outFile string, program []byte, source *chip8.SourceMap, symbols chip8.Symbols) error {
+	if err := ioutil.WriteFile(outFile, program, 0644); err != nil {
+		return err
+	}
+	if err := cli.CreateFile(outFile+".srcmap", source.Write); err != nil {
+		return err
+	}
+	return cli.CreateFile(outFile+".sym", func(w io.Writer) error {
+		return chip8.WriteSymbols(w, symbols)
+	})
+}
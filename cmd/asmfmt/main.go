@@ -0,0 +1,140 @@
+/*
+Copyright (C) 2016 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/andreas-jonsson/chip8/chip8/asm"
+)
+
+var (
+	list  = flag.Bool("l", false, "list files whose formatting differs from asmfmt's")
+	write = flag.Bool("w", false, "write result to the source file instead of stdout")
+)
+
+var exitCode = 0
+
+func init() {
+	flag.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: asmfmt [-l] [-w] [path ...]")
+		flag.PrintDefaults()
+	}
+}
+
+func report(err error) {
+	fmt.Fprintln(os.Stderr, err)
+	exitCode = 2
+}
+
+func processFile(fileName string, src []byte, stdin bool) error {
+	res, err := asm.Format(src)
+	if err != nil {
+		return fmt.Errorf("%s:%v", fileName, err)
+	}
+
+	if bytes.Equal(src, res) {
+		if !*list && !*write {
+			_, err = os.Stdout.Write(res)
+		}
+		return err
+	}
+
+	if *list {
+		fmt.Println(fileName)
+	}
+	if *write && !stdin {
+		info, err := os.Stat(fileName)
+		if err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(fileName, res, info.Mode().Perm()); err != nil {
+			return err
+		}
+	}
+	if !*list && !*write {
+		_, err = os.Stdout.Write(res)
+	}
+	return err
+}
+
+func isSourceFile(info os.FileInfo) bool {
+	name := info.Name()
+	return !info.IsDir() && !strings.HasPrefix(name, ".") && strings.ToLower(filepath.Ext(name)) == ".asm"
+}
+
+func walkDir(root string) {
+	filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			report(err)
+		} else if isSourceFile(info) {
+			src, err := ioutil.ReadFile(path)
+			if err == nil {
+				err = processFile(path, src, false)
+			}
+			if err != nil {
+				report(err)
+			}
+		}
+		return nil
+	})
+}
+
+func main() {
+	flag.Parse()
+
+	if flag.NArg() == 0 {
+		if *write {
+			report(fmt.Errorf("asmfmt: cannot use -w with standard input"))
+			os.Exit(exitCode)
+		}
+		src, err := ioutil.ReadAll(os.Stdin)
+		if err == nil {
+			err = processFile("<standard input>", src, true)
+		}
+		if err != nil {
+			report(err)
+		}
+		os.Exit(exitCode)
+	}
+
+	for _, path := range flag.Args() {
+		info, err := os.Stat(path)
+		switch {
+		case err != nil:
+			report(err)
+		case info.IsDir():
+			walkDir(path)
+		default:
+			src, err := ioutil.ReadFile(path)
+			if err == nil {
+				err = processFile(path, src, false)
+			}
+			if err != nil {
+				report(err)
+			}
+		}
+	}
+	os.Exit(exitCode)
+}
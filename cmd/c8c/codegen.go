@@ -0,0 +1,885 @@
+/*
+Copyright (C) 2016 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Register use. v0 is scratch for memory access and return values, v1 to
+// v4 hold temporaries while evaluating expressions and the rest are
+// variables. vf is the flag register.
+const (
+	firstTemp = 1
+	lastTemp  = 4
+	firstVar  = 5
+	lastVar   = 14
+)
+
+type (
+	// variable is a byte stored in a register, or in memory at lable if reg
+	// is -1. All variables are allocated statically, which is why
+	// functions can not be recursive.
+	variable struct {
+		reg   int
+		lable string
+	}
+
+	funcInfo struct {
+		*function
+		lable  string
+		params []*variable
+		locals map[string]*variable
+		calls  []*exprCall
+
+		// save is where the temporaries live across calls.
+		save string
+	}
+
+	loop struct {
+		start, end string
+	}
+
+	compiler struct {
+		prog    *program
+		src     []string
+		globals map[string]*variable
+		funcs   map[string]*funcInfo
+		data    map[string]*data
+
+		fn        *funcInfo
+		loops     []loop
+		nextReg   int
+		memVars   []string
+		saves     []string
+		numLables int
+
+		// lines holds the generated source, sourceLines the c8 source line
+		// each generated line came from or 0.
+		lines       []string
+		sourceLines []int
+		line        int
+	}
+)
+
+// compile translates c8 source into assembler source. The second result
+// holds the c8 line of every line of output, or 0 for generated lines.
+func compile(fileName, src string) (out string, lines []int, err *compileError) {
+	defer func() {
+		if r := recover(); r != nil {
+			e, ok := r.(*compileError)
+			if !ok {
+				panic(r)
+			}
+			out, lines, err = "", nil, e
+		}
+	}()
+
+	c := &compiler{
+		prog:    parse(src),
+		src:     strings.Split(src, "\n"),
+		globals: make(map[string]*variable),
+		funcs:   make(map[string]*funcInfo),
+		data:    make(map[string]*data),
+		nextReg: firstVar,
+	}
+	c.declare()
+	c.checkRecursion()
+
+	c.emitLine(fmt.Sprintf("; Generated by c8c from %s, do not edit.", fileName))
+	c.emitLine("")
+	c.generate()
+	return strings.Join(c.lines, "\n") + "\n", c.sourceLines, nil
+}
+
+func (c *compiler) emitLine(s string) {
+	c.lines = append(c.lines, s)
+	c.sourceLines = append(c.sourceLines, c.line)
+}
+
+func (c *compiler) emit(format string, a ...interface{}) {
+	c.emitLine("    " + fmt.Sprintf(format, a...))
+}
+
+func (c *compiler) lable(name string) {
+	c.emitLine(name + ":")
+}
+
+func (c *compiler) newLable() string {
+	c.numLables++
+	return fmt.Sprintf("L%d", c.numLables)
+}
+
+func (c *compiler) alloc(lable string) *variable {
+	if c.nextReg <= lastVar {
+		c.nextReg++
+		return &variable{reg: c.nextReg - 1}
+	}
+	c.memVars = append(c.memVars, lable)
+	return &variable{reg: -1, lable: lable}
+}
+
+func (c *compiler) checkName(p pos, name string) {
+	_, isConst := c.prog.consts[name]
+	_, isGlobal := c.globals[name]
+	_, isFunc := c.funcs[name]
+	_, isData := c.data[name]
+	if isConst || isGlobal || isFunc || isData || builtins[name] {
+		panic(errorf(p, "'%s' is already defined", name))
+	}
+}
+
+// declare allocates storage for all globals, parameters and locals.
+func (c *compiler) declare() {
+	for _, d := range c.prog.data {
+		c.checkName(d.pos, d.name)
+		c.data[d.name] = d
+	}
+	for _, f := range c.prog.funcs {
+		c.checkName(f.pos, f.name)
+		c.funcs[f.name] = &funcInfo{function: f, lable: "fn_" + f.name, locals: make(map[string]*variable)}
+	}
+	for _, v := range c.prog.globals {
+		c.checkName(v.pos, v.name)
+		c.globals[v.name] = c.alloc("var_" + v.name)
+	}
+
+	main, ok := c.funcs["main"]
+	if !ok {
+		panic(errorf(pos{1, 1}, "missing function 'main'"))
+	}
+	if len(main.params) > 0 {
+		panic(errorf(main.pos, "'main' does not take any parameters"))
+	}
+
+	for _, f := range c.prog.funcs {
+		info := c.funcs[f.name]
+		if len(f.params) > lastTemp-firstTemp+1 {
+			panic(errorf(f.pos, "'%s' has more than %d parameters", f.name, lastTemp-firstTemp+1))
+		}
+
+		for _, name := range f.params {
+			if _, ok := info.locals[name]; ok {
+				panic(errorf(f.pos, "duplicate parameter '%s'", name))
+			}
+			v := c.alloc(fmt.Sprintf("var_%s_%s", f.name, name))
+			info.locals[name] = v
+			info.params = append(info.params, v)
+		}
+		c.declareLocals(info, f.body)
+	}
+}
+
+func (c *compiler) declareLocals(info *funcInfo, body []stmt) {
+	for _, s := range body {
+		walkExprs(s, func(e expr) {
+			if call, ok := e.(*exprCall); ok {
+				info.calls = append(info.calls, call)
+			}
+		})
+
+		switch s := s.(type) {
+		case *stmtVar:
+			if _, ok := info.locals[s.name]; ok {
+				panic(errorf(s.pos, "'%s' is already declared in '%s'", s.name, info.name))
+			}
+			info.locals[s.name] = c.alloc(fmt.Sprintf("var_%s_%s", info.name, s.name))
+		case *stmtIf:
+			c.declareLocals(info, s.then)
+			c.declareLocals(info, s.els)
+		case *stmtWhile:
+			c.declareLocals(info, s.body)
+		}
+	}
+}
+
+// walkExprs calls fn for every expression directly in s, not counting
+// nested statements.
+func walkExprs(s stmt, fn func(expr)) {
+	var walk func(e expr)
+	walk = func(e expr) {
+		if e == nil {
+			return
+		}
+		fn(e)
+
+		switch e := e.(type) {
+		case *exprIndex:
+			walk(e.index)
+		case *exprCall:
+			for _, arg := range e.args {
+				walk(arg)
+			}
+		case *exprUnary:
+			walk(e.x)
+		case *exprBinary:
+			walk(e.x)
+			walk(e.y)
+		}
+	}
+
+	switch s := s.(type) {
+	case *stmtVar:
+		walk(s.init)
+	case *stmtAssign:
+		walk(s.target)
+		walk(s.value)
+	case *stmtIf:
+		walk(s.cond)
+	case *stmtWhile:
+		walk(s.cond)
+	case *stmtReturn:
+		walk(s.value)
+	case *stmtExpr:
+		walk(s.x)
+	}
+}
+
+func (c *compiler) checkRecursion() {
+	const (
+		unvisited = iota
+		visiting
+		done
+	)
+	state := make(map[string]int)
+
+	var visit func(f *funcInfo)
+	visit = func(f *funcInfo) {
+		state[f.name] = visiting
+		for _, call := range f.calls {
+			callee, ok := c.funcs[call.name]
+			if !ok {
+				continue
+			}
+			switch state[callee.name] {
+			case visiting:
+				panic(errorf(call.pos, "recursive call to '%s', recursion is not supported", callee.name))
+			case unvisited:
+				visit(callee)
+			}
+		}
+		state[f.name] = done
+	}
+
+	for _, f := range c.prog.funcs {
+		if state[f.name] == unvisited {
+			visit(c.funcs[f.name])
+		}
+	}
+}
+
+func (c *compiler) lookup(e *exprName) *variable {
+	if c.fn != nil {
+		if v, ok := c.fn.locals[e.name]; ok {
+			return v
+		}
+	}
+	if v, ok := c.globals[e.name]; ok {
+		return v
+	}
+
+	switch {
+	case c.funcs[e.name] != nil:
+		panic(errorf(e.pos, "function '%s' used as a value", e.name))
+	case c.data[e.name] != nil:
+		panic(errorf(e.pos, "'%s' must be indexed", e.name))
+	}
+	panic(errorf(e.pos, "undefined name '%s'", e.name))
+}
+
+func (c *compiler) generate() {
+	init := &funcInfo{function: &function{name: "init"}, lable: "start"}
+	c.fn = init
+
+	c.lable("start")
+	for _, v := range c.prog.globals {
+		c.line = v.pos.line
+		c.initVar(c.globals[v.name], v.init)
+	}
+	c.line = 0
+	c.emit("call fn_main")
+	c.lable("exit")
+	c.emit("jump exit")
+
+	for _, f := range c.prog.funcs {
+		c.function(c.funcs[f.name])
+	}
+	c.fn = nil
+
+	c.line = 0
+	c.emitLine("")
+	for _, d := range c.prog.data {
+		if len(d.bytes) == 0 {
+			continue
+		}
+		c.line = d.pos.line
+		c.lable("data_" + d.name)
+
+		values := make([]string, d.size)
+		for i := range values {
+			values[i] = "0"
+			if i < len(d.bytes) {
+				values[i] = fmt.Sprint(d.bytes[i])
+			}
+		}
+		for len(values) > 0 {
+			n := len(values)
+			if n > 16 {
+				n = 16
+			}
+			c.emit(". %s", strings.Join(values[:n], ", "))
+			values = values[n:]
+		}
+	}
+
+	// Memory that does not need to be initialized goes last, so it is
+	// not written to the program file.
+	c.line = 0
+	for _, d := range c.prog.data {
+		if len(d.bytes) == 0 {
+			c.lable("data_" + d.name)
+			c.emit("reserve %d", d.size)
+		}
+	}
+	for _, lable := range c.memVars {
+		c.lable(lable)
+		c.emit("reserve 1")
+	}
+	for _, lable := range c.saves {
+		c.lable(lable)
+		c.emit("reserve %d", lastTemp+1)
+	}
+}
+
+func (c *compiler) function(f *funcInfo) {
+	c.fn = f
+	c.line = f.pos.line
+	c.emitLine("")
+	c.emitLine(fmt.Sprintf("; %s", strings.TrimSpace(c.src[f.pos.line-1])))
+	c.lable(f.lable)
+	c.block(f.body)
+	c.line = 0
+	c.emit("rts")
+}
+
+func (c *compiler) block(body []stmt) {
+	for _, s := range body {
+		c.statement(s)
+	}
+}
+
+func (c *compiler) statement(s stmt) {
+	c.line = s.position().line
+
+	switch s := s.(type) {
+	case *stmtVar:
+		c.initVar(c.fn.locals[s.name], s.init)
+	case *stmtAssign:
+		c.assign(s)
+	case *stmtIf:
+		els := c.newLable()
+		c.cond(s.cond, els, false, firstTemp)
+		c.block(s.then)
+		if len(s.els) == 0 {
+			c.lable(els)
+			break
+		}
+
+		end := c.newLable()
+		c.emit("jump %s", end)
+		c.lable(els)
+		c.block(s.els)
+		c.lable(end)
+	case *stmtWhile:
+		l := loop{c.newLable(), c.newLable()}
+		c.lable(l.start)
+		c.cond(s.cond, l.end, false, firstTemp)
+
+		c.loops = append(c.loops, l)
+		c.block(s.body)
+		c.loops = c.loops[:len(c.loops)-1]
+
+		c.emit("jump %s", l.start)
+		c.lable(l.end)
+	case *stmtBreak:
+		c.emit("jump %s", c.innerLoop(s.pos, "break").end)
+	case *stmtContinue:
+		c.emit("jump %s", c.innerLoop(s.pos, "continue").start)
+	case *stmtReturn:
+		if s.value != nil {
+			if k, ok := c.prog.constValue(s.value); ok {
+				c.emit("load v0, %d", k&0xFF)
+			} else {
+				c.emit("move v0, v%x", c.value(s.value, firstTemp))
+			}
+		}
+		c.emit("rts")
+	case *stmtExpr:
+		c.call(s.x.(*exprCall), firstTemp, false)
+	}
+}
+
+func (c *compiler) innerLoop(p pos, keyword string) loop {
+	if len(c.loops) == 0 {
+		panic(errorf(p, "'%s' outside loop", keyword))
+	}
+	return c.loops[len(c.loops)-1]
+}
+
+func (c *compiler) initVar(v *variable, init expr) {
+	if init == nil {
+		init = &exprNumber{value: 0}
+	}
+	c.store(v, init)
+}
+
+// store assigns the value of e to v.
+func (c *compiler) store(v *variable, e expr) {
+	if k, ok := c.prog.constValue(e); ok && v.reg >= 0 {
+		c.emit("load v%x, %d", v.reg, k&0xFF)
+		return
+	}
+	c.expr(e, firstTemp)
+	c.storeReg(v, firstTemp)
+}
+
+func (c *compiler) storeReg(v *variable, reg int) {
+	if v.reg >= 0 {
+		c.emit("move v%x, v%x", v.reg, reg)
+		return
+	}
+	c.emit("move v0, v%x", reg)
+	c.emit("loadi %s", v.lable)
+	c.emit("stor v0")
+}
+
+func (c *compiler) assign(s *stmtAssign) {
+	value := s.value
+	if s.op != "=" {
+		op := strings.TrimSuffix(s.op, "=")
+		if name, ok := s.target.(*exprName); ok {
+			v := c.lookup(name)
+			if k, ok := c.prog.constValue(value); ok && v.reg >= 0 && (op == "+" || op == "-") {
+				if op == "-" {
+					k = -k
+				}
+				c.emit("add v%x, %d", v.reg, k&0xFF)
+				return
+			}
+		}
+		value = &exprBinary{s.pos, op, s.target, value}
+	}
+
+	switch target := s.target.(type) {
+	case *exprName:
+		c.store(c.lookup(target), value)
+	case *exprIndex:
+		c.expr(value, firstTemp)
+		c.index(target, firstTemp+1)
+		c.emit("move v0, v%x", firstTemp)
+		c.emit("stor v0")
+	}
+}
+
+// index points I at an array element, using temporaries from t.
+func (c *compiler) index(e *exprIndex, t int) {
+	d, ok := c.data[e.name]
+	if !ok {
+		panic(errorf(e.pos, "'%s' is not an array or sprite", e.name))
+	}
+
+	if k, ok := c.prog.constValue(e.index); ok {
+		if k < 0 || k >= d.size {
+			panic(errorf(e.index.position(), "index %d out of range for '%s' of %d bytes", k, e.name, d.size))
+		}
+		c.emit("loadi data_%s + %d", e.name, k)
+		return
+	}
+
+	reg := c.value(e.index, t)
+	c.emit("loadi data_%s", e.name)
+	c.emit("addi v%x", reg)
+}
+
+func (c *compiler) checkTemp(e expr, t int) {
+	if t > lastTemp {
+		panic(errorf(e.position(), "expression is too complex, split it into several statements"))
+	}
+}
+
+// value returns the register holding the value of e. Register variables
+// are used directly, everything else is evaluated into v(t).
+func (c *compiler) value(e expr, t int) int {
+	if name, ok := e.(*exprName); ok {
+		if v := c.lookup(name); v.reg >= 0 {
+			return v.reg
+		}
+	}
+	c.expr(e, t)
+	return t
+}
+
+// expr evaluates e into register v(t). Registers above t may be changed.
+func (c *compiler) expr(e expr, t int) {
+	c.checkTemp(e, t)
+
+	if k, ok := c.prog.constValue(e); ok {
+		c.emit("load v%x, %d", t, k&0xFF)
+		return
+	}
+
+	switch e := e.(type) {
+	case *exprName:
+		v := c.lookup(e)
+		if v.reg >= 0 {
+			c.emit("move v%x, v%x", t, v.reg)
+			return
+		}
+		c.emit("loadi %s", v.lable)
+		c.emit("read v0")
+		c.emit("move v%x, v0", t)
+	case *exprIndex:
+		c.index(e, t)
+		c.emit("read v0")
+		c.emit("move v%x, v0", t)
+	case *exprCall:
+		c.call(e, t, true)
+	case *exprUnary:
+		switch e.op {
+		case "-":
+			c.expr(e.x, t)
+			c.emit("load v0, 0")
+			c.emit("sub v0, v%x", t)
+			c.emit("move v%x, v0", t)
+		case "~":
+			c.expr(e.x, t)
+			c.emit("load v0, 255")
+			c.emit("xor v%x, v0", t)
+		default:
+			c.condValue(e, t)
+		}
+	case *exprBinary:
+		c.binary(e, t)
+	}
+}
+
+var mnemonics = map[string]string{"+": "addr", "-": "sub", "&": "and", "|": "or", "^": "xor"}
+
+func (c *compiler) binary(e *exprBinary, t int) {
+	switch e.op {
+	case "<<", ">>":
+		k, ok := c.prog.constValue(e.y)
+		if !ok {
+			panic(errorf(e.y.position(), "shift count must be a constant"))
+		}
+		c.expr(e.x, t)
+		if k >= 8 {
+			c.emit("load v%x, 0", t)
+			return
+		}
+		for i := 0; i < k; i++ {
+			if e.op == "<<" {
+				c.emit("shl v%x", t)
+			} else {
+				c.emit("shr v%x", t)
+			}
+		}
+		return
+	case "+", "-", "&", "|", "^":
+	default:
+		c.condValue(e, t)
+		return
+	}
+
+	c.expr(e.x, t)
+	if k, ok := c.prog.constValue(e.y); ok {
+		switch e.op {
+		case "+":
+			c.emit("add v%x, %d", t, k&0xFF)
+			return
+		case "-":
+			c.emit("add v%x, %d", t, -k&0xFF)
+			return
+		}
+		c.emit("load v0, %d", k&0xFF)
+		c.emit("%s v%x, v0", mnemonics[e.op], t)
+		return
+	}
+
+	reg := c.value(e.y, t+1)
+	c.emit("%s v%x, v%x", mnemonics[e.op], t, reg)
+}
+
+// condValue evaluates a condition into v(t) as 0 or 1.
+func (c *compiler) condValue(e expr, t int) {
+	f, end := c.newLable(), c.newLable()
+	c.cond(e, f, false, t)
+	c.emit("load v%x, 1", t)
+	c.emit("jump %s", end)
+	c.lable(f)
+	c.emit("load v%x, 0", t)
+	c.lable(end)
+}
+
+// cond jumps to target if the truth of e equals jumpIf, using temporaries
+// from t.
+func (c *compiler) cond(e expr, target string, jumpIf bool, t int) {
+	if k, ok := c.prog.constValue(e); ok {
+		if (k&0xFF != 0) == jumpIf {
+			c.emit("jump %s", target)
+		}
+		return
+	}
+
+	switch e := e.(type) {
+	case *exprUnary:
+		if e.op == "!" {
+			c.cond(e.x, target, !jumpIf, t)
+			return
+		}
+	case *exprCall:
+		if e.name == "key" {
+			c.checkArgs(e, 1)
+			reg := c.value(e.args[0], t)
+			if jumpIf {
+				c.emit("sknp v%x", reg)
+			} else {
+				c.emit("skp v%x", reg)
+			}
+			c.emit("jump %s", target)
+			return
+		}
+	case *exprBinary:
+		switch e.op {
+		case "&&", "||":
+			// Jump when both are true for '&&' or either is false, and the
+			// other way around for '||'.
+			and := e.op == "&&"
+			if jumpIf != and {
+				c.cond(e.x, target, jumpIf, t)
+				c.cond(e.y, target, jumpIf, t)
+				return
+			}
+			skip := c.newLable()
+			c.cond(e.x, skip, !jumpIf, t)
+			c.cond(e.y, target, jumpIf, t)
+			c.lable(skip)
+			return
+		case "==", "!=":
+			c.compareEqual(e, target, jumpIf, t)
+			return
+		case "<", "<=", ">", ">=":
+			c.compareOrder(e, target, jumpIf, t)
+			return
+		}
+	}
+
+	reg := c.value(e, t)
+	if jumpIf {
+		c.emit("ske v%x, 0", reg)
+	} else {
+		c.emit("skne v%x, 0", reg)
+	}
+	c.emit("jump %s", target)
+}
+
+func (c *compiler) compareEqual(e *exprBinary, target string, jumpIf bool, t int) {
+	// Skip the jump when the values are (not) equal.
+	jumpIfEqual := (e.op == "==") == jumpIf
+
+	x := c.value(e.x, t)
+	if k, ok := c.prog.constValue(e.y); ok {
+		if jumpIfEqual {
+			c.emit("skne v%x, %d", x, k&0xFF)
+		} else {
+			c.emit("ske v%x, %d", x, k&0xFF)
+		}
+	} else {
+		y := c.value(e.y, t+1)
+		if jumpIfEqual {
+			c.emit("sknre v%x, v%x", x, y)
+		} else {
+			c.emit("skre v%x, v%x", x, y)
+		}
+	}
+	c.emit("jump %s", target)
+}
+
+// compareOrder subtracts the operands and tests the borrow flag, vf is 1
+// after 'sub' if nothing was borrowed. '>' and '<=' subtract x from a copy
+// of y in v0 rather than use 'subr', which not all interpreters get right.
+func (c *compiler) compareOrder(e *exprBinary, target string, jumpIf bool, t int) {
+	c.expr(e.x, t)
+
+	var y int
+	if k, ok := c.prog.constValue(e.y); ok {
+		y = t + 1
+		c.checkTemp(e.y, y)
+		c.emit("load v%x, %d", y, k&0xFF)
+	} else {
+		y = c.value(e.y, t+1)
+	}
+
+	// The condition holds when vf equals flag.
+	flag := 0
+	switch e.op {
+	case "<", ">=":
+		c.emit("sub v%x, v%x", t, y)
+	case ">", "<=":
+		c.emit("move v0, v%x", y)
+		c.emit("sub v0, v%x", t)
+	}
+	if e.op == ">=" || e.op == "<=" {
+		flag = 1
+	}
+
+	if !jumpIf {
+		flag = 1 - flag
+	}
+	c.emit("skne vf, %d", flag)
+	c.emit("jump %s", target)
+}
+
+var builtins = map[string]bool{
+	"cls": true, "draw": true, "digit": true, "key": true, "getkey": true,
+	"timer": true, "settimer": true, "sound": true, "random": true,
+}
+
+func (c *compiler) checkArgs(e *exprCall, n int) {
+	if len(e.args) != n {
+		panic(errorf(e.pos, "'%s' expects %d argument(s), got %d", e.name, n, len(e.args)))
+	}
+}
+
+// call calls a function or built-in with the result in v(t) if used.
+func (c *compiler) call(e *exprCall, t int, used bool) {
+	c.checkTemp(e, t)
+
+	f, ok := c.funcs[e.name]
+	if !ok {
+		c.builtin(e, t, used)
+		return
+	}
+
+	c.checkArgs(e, len(f.params))
+	for i, arg := range e.args {
+		c.checkTemp(arg, t+i)
+		c.expr(arg, t+i)
+	}
+	for i, v := range f.params {
+		c.storeReg(v, t+i)
+	}
+
+	// The temporaries below t are in use and saved across the call.
+	live := t - 1
+	if live >= firstTemp {
+		if c.fn.save == "" {
+			c.fn.save = "save_" + c.fn.lable
+			c.saves = append(c.saves, c.fn.save)
+		}
+		c.emit("loadi %s", c.fn.save)
+		c.emit("stor v%x", live)
+	}
+	c.emit("call %s", f.lable)
+	if used {
+		c.emit("move v%x, v0", t)
+	}
+	if live >= firstTemp {
+		c.emit("loadi %s", c.fn.save)
+		c.emit("read v%x", live)
+	}
+}
+
+func (c *compiler) builtin(e *exprCall, t int, used bool) {
+	noValue := func() {
+		if used {
+			panic(errorf(e.pos, "'%s' does not return a value", e.name))
+		}
+	}
+
+	switch e.name {
+	case "cls":
+		noValue()
+		c.checkArgs(e, 0)
+		c.emit("clr")
+	case "draw":
+		c.checkArgs(e, 3)
+		x := c.value(e.args[1], t)
+		y := c.value(e.args[2], t+1)
+
+		height := 5
+		switch sprite := e.args[0].(type) {
+		case *exprName:
+			d, ok := c.data[sprite.name]
+			if !ok || !d.sprite {
+				panic(errorf(sprite.pos, "'%s' is not a sprite", sprite.name))
+			}
+			c.emit("loadi data_%s", sprite.name)
+			height = d.size
+		case *exprCall:
+			if sprite.name != "digit" {
+				panic(errorf(sprite.pos, "expected sprite or digit()"))
+			}
+			c.checkArgs(sprite, 1)
+			c.emit("ldspr v%x", c.value(sprite.args[0], t+2))
+		default:
+			panic(errorf(sprite.position(), "expected sprite or digit()"))
+		}
+
+		c.emit("draw v%x, v%x, %d", x, y, height)
+		if used {
+			c.emit("move v%x, vf", t)
+		}
+	case "key":
+		c.checkArgs(e, 1)
+		if used {
+			c.condValue(e, t)
+		}
+	case "getkey":
+		c.checkArgs(e, 0)
+		c.emit("keyd v%x", t)
+	case "timer":
+		c.checkArgs(e, 0)
+		c.emit("moved v%x", t)
+	case "settimer", "sound":
+		noValue()
+		c.checkArgs(e, 1)
+		reg := c.value(e.args[0], t)
+		if e.name == "sound" {
+			c.emit("loads v%x", reg)
+		} else {
+			c.emit("loadd v%x", reg)
+		}
+	case "random":
+		mask := 255
+		if len(e.args) > 0 {
+			c.checkArgs(e, 1)
+			k, ok := c.prog.constValue(e.args[0])
+			if !ok {
+				panic(errorf(e.args[0].position(), "random mask must be a constant"))
+			}
+			mask = k & 0xFF
+		}
+		c.emit("rand v%x, %d", t, mask)
+	case "digit":
+		panic(errorf(e.pos, "digit() can only be drawn"))
+	default:
+		panic(errorf(e.pos, "undefined function '%s'", e.name))
+	}
+}
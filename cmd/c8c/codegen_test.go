@@ -0,0 +1,116 @@
+/*
+Copyright (C) 2016 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"io/ioutil"
+	"math/rand"
+	"testing"
+
+	"github.com/andreas-jonsson/chip8/chip8"
+	"github.com/andreas-jonsson/chip8/chip8/asm"
+)
+
+// machine is an InputOutput that keeps the memory it loads the program
+// into, so the test can read it.
+type machine struct {
+	program []byte
+	memory  []byte
+}
+
+func (m *machine) Load(memory []byte) {
+	m.memory = memory
+	copy(memory, m.program)
+}
+
+func (m *machine) Draw(video []byte)        {}
+func (m *machine) Key(code int) bool        { return false }
+func (m *machine) Rand() *rand.Rand         { return rand.New(rand.NewSource(1)) }
+func (m *machine) BeginTone()               {}
+func (m *machine) EndTone()                 {}
+func (m *machine) SetCPUFrequency(freq int) {}
+func (m *machine) ResizeVideo(width int)    {}
+
+func TestCompare(t *testing.T) {
+	const fileName = "tests/compare.c8"
+	src, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	source, _, cerr := compile(fileName, string(src))
+	if cerr != nil {
+		t.Fatalf("%d:%d: %s", cerr.pos.line, cerr.pos.col, cerr.msg)
+	}
+	prog, err := asm.Assemble(fileName+".asm", []byte(source), asm.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := prog.NumErrors(); n > 0 {
+		t.Fatalf("%d error(s) in generated code: %v", n, prog.Diagnostics)
+	}
+
+	program, _ := prog.Image()
+	m := &machine{program: program}
+	sys := chip8.NewSystem(m)
+	for i := 0; i < 10000 && sys.State() != chip8.Finished; i++ {
+		if err := sys.Step(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if sys.State() != chip8.Finished {
+		t.Fatal("program did not finish")
+	}
+
+	var addr int
+	for _, sym := range prog.Symbols() {
+		if sym.Name == "data_results" {
+			addr = int(sym.Addr) - 0x200
+		}
+	}
+	if addr <= 0 {
+		t.Fatal("no symbol data_results")
+	}
+
+	want := []struct {
+		expr  string
+		value byte
+	}{
+		{"x > y", 1},
+		{"y > x", 0},
+		{"x < y", 0},
+		{"y < x", 1},
+		{"x <= y", 0},
+		{"y <= x", 1},
+		{"x >= y", 1},
+		{"y >= x", 0},
+		{"x > x", 0},
+		{"x <= x", 1},
+		{"x > 5", 1},
+		{"-x", 6},
+		{"-y", 253},
+		{"loop count", 5},
+		{"clamp(70, 0, 60)", 60},
+		{"clamp(3, 5, 10)", 5},
+	}
+	for i, w := range want {
+		if got := m.memory[addr+i]; got != w.value {
+			t.Errorf("results[%d] = %s = %d, want %d", i, w.expr, got, w.value)
+		}
+	}
+}
@@ -0,0 +1,152 @@
+/*
+Copyright (C) 2016 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+type tokenKind int
+
+const (
+	tokEOF tokenKind = iota
+	tokIdent
+	tokNumber
+	tokString
+	tokPunct
+)
+
+type (
+	pos struct {
+		line, col int
+	}
+
+	token struct {
+		kind  tokenKind
+		text  string
+		value int
+		pos   pos
+	}
+
+	// compileError is raised with panic and recovered by compile.
+	compileError struct {
+		pos pos
+		msg string
+	}
+)
+
+func (err *compileError) Error() string {
+	return fmt.Sprintf("%d:%d: %s", err.pos.line, err.pos.col, err.msg)
+}
+
+func errorf(p pos, format string, a ...interface{}) *compileError {
+	return &compileError{p, fmt.Sprintf(format, a...)}
+}
+
+// Longest first, so '<=' is not read as '<' followed by '='.
+var punctuation = []string{
+	"<<=", ">>=",
+	"==", "!=", "<=", ">=", "&&", "||", "<<", ">>", "+=", "-=", "&=", "|=", "^=",
+	"+", "-", "&", "|", "^", "~", "!", "<", ">", "=", "(", ")", "{", "}", "[", "]", ",",
+}
+
+func isIdentStart(c byte) bool {
+	return c == '_' || unicode.IsLetter(rune(c))
+}
+
+func isIdentChar(c byte) bool {
+	return isIdentStart(c) || unicode.IsDigit(rune(c))
+}
+
+func parseNumber(s string) (int, error) {
+	var (
+		n   uint64
+		err error
+	)
+
+	switch {
+	case strings.HasPrefix(s, "0x") || strings.HasPrefix(s, "0X"):
+		n, err = strconv.ParseUint(s[2:], 16, 16)
+	case strings.HasPrefix(s, "0b") || strings.HasPrefix(s, "0B"):
+		n, err = strconv.ParseUint(s[2:], 2, 16)
+	default:
+		n, err = strconv.ParseUint(s, 10, 16)
+	}
+	return int(n), err
+}
+
+// lex splits the source into tokens. Comments start with '//' and run to
+// the end of the line.
+func lex(src string) []token {
+	var tokens []token
+
+	for n, line := range strings.Split(src, "\n") {
+		for i := 0; i < len(line); {
+			c := line[i]
+			p := pos{n + 1, i + 1}
+
+			switch {
+			case c == ' ' || c == '\t' || c == '\r':
+				i++
+			case strings.HasPrefix(line[i:], "//"):
+				i = len(line)
+			case isIdentStart(c):
+				start := i
+				for i < len(line) && isIdentChar(line[i]) {
+					i++
+				}
+				tokens = append(tokens, token{kind: tokIdent, text: line[start:i], pos: p})
+			case unicode.IsDigit(rune(c)):
+				start := i
+				for i < len(line) && isIdentChar(line[i]) {
+					i++
+				}
+				value, err := parseNumber(line[start:i])
+				if err != nil {
+					panic(errorf(p, "invalid number '%s'", line[start:i]))
+				}
+				tokens = append(tokens, token{kind: tokNumber, text: line[start:i], value: value, pos: p})
+			case c == '"':
+				end := strings.IndexByte(line[i+1:], '"')
+				if end < 0 {
+					panic(errorf(p, "unterminated string"))
+				}
+				tokens = append(tokens, token{kind: tokString, text: line[i+1 : i+1+end], pos: p})
+				i += end + 2
+			default:
+				found := false
+				for _, punct := range punctuation {
+					if strings.HasPrefix(line[i:], punct) {
+						tokens = append(tokens, token{kind: tokPunct, text: punct, pos: p})
+						i += len(punct)
+						found = true
+						break
+					}
+				}
+				if !found {
+					panic(errorf(p, "unexpected character '%c'", c))
+				}
+			}
+		}
+	}
+
+	return tokens
+}
@@ -0,0 +1,134 @@
+/*
+Copyright (C) 2016 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/andreas-jonsson/chip8/chip8"
+	"github.com/andreas-jonsson/chip8/chip8/asm"
+	"github.com/andreas-jonsson/chip8/cmd/internal/cli"
+)
+
+const version = "0.1.0"
+
+var (
+	assembly = flag.Bool("S", false, "write assembler source instead of a program")
+	optimize = flag.Bool("O", false, "optimize the program")
+	outFile  = flag.String("o", "", "output file, default is the input file with the extension .ch8 or .asm")
+)
+
+// remapSource points the source map of the generated assembler source back
+// at the c8 source.
+func remapSource(m *chip8.SourceMap, fileName string, lines []int) *chip8.SourceMap {
+	out := &chip8.SourceMap{Files: []string{fileName}}
+	for _, r := range m.Ranges {
+		if r.Line < 1 || r.Line > len(lines) || lines[r.Line-1] == 0 {
+			continue
+		}
+
+		line := lines[r.Line-1]
+		if n := len(out.Ranges); n > 0 && out.Ranges[n-1].End == r.Start && out.Ranges[n-1].Line == line {
+			out.Ranges[n-1].End = r.End
+			continue
+		}
+		out.Ranges = append(out.Ranges, chip8.SourceRange{
+			Start:     r.Start,
+			End:       r.End,
+			SourcePos: chip8.SourcePos{Line: line, Column: 1},
+		})
+	}
+	return out
+}
+
+func main() {
+	fmt.Println("CHIP8 C8 Compiler")
+	fmt.Println("Copyright (C) 2016 Andreas T Jonsson")
+	fmt.Printf("Version: %v\n\n", version)
+
+	flag.Parse()
+	if flag.NArg() != 1 {
+		fmt.Println("usage: c8c [-S] [-O] [-o output] <input.c8>")
+		return
+	}
+
+	fileName := flag.Arg(0)
+	src, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	output := *outFile
+	if output == "" {
+		ext := ".ch8"
+		if *assembly {
+			ext = ".asm"
+		}
+		output = strings.TrimSuffix(fileName, filepath.Ext(fileName)) + ext
+	}
+
+	source, lines, cerr := compile(fileName, string(src))
+	if cerr != nil {
+		fmt.Fprintf(os.Stderr, "%s:%d:%d: error: %s\n", fileName, cerr.pos.line, cerr.pos.col, cerr.msg)
+		log.Fatalln("1 error(s), no output written")
+	}
+
+	if *assembly {
+		if err := ioutil.WriteFile(output, []byte(source), 0644); err != nil {
+			log.Fatalln(err)
+		}
+		fmt.Printf("assembler source: %d lines\n", len(lines))
+		return
+	}
+
+	// Problems found by the assembler are bugs in the compiler and refer
+	// to the generated source, which is not written.
+	prog, err := asm.Assemble(fileName+".asm", []byte(source), asm.Options{Optimize: *optimize, Log: os.Stdout})
+	if err != nil {
+		log.Fatalln(err)
+	}
+	if err := asm.WriteDiagnostics(os.Stderr, "gcc", prog.Diagnostics); err != nil {
+		log.Fatalln(err)
+	}
+	if n := prog.NumErrors(); n > 0 {
+		log.Fatalf("%d error(s) in generated code, no output written\n", n)
+	}
+
+	program, m := prog.Image()
+	if err := ioutil.WriteFile(output, program, 0644); err != nil {
+		log.Fatalln(err)
+	}
+	if err := cli.CreateFile(output+".srcmap", remapSource(m, fileName, lines).Write); err != nil {
+		log.Fatalln(err)
+	}
+	if err := cli.CreateFile(output+".sym", func(w io.Writer) error {
+		return chip8.WriteSymbols(w, prog.Symbols())
+	}); err != nil {
+		log.Fatalln(err)
+	}
+
+	fmt.Printf("program size: %d bytes\n\n", len(program))
+	prog.WriteMemoryMap(os.Stdout)
+}
@@ -0,0 +1,563 @@
+/*
+Copyright (C) 2016 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import "strings"
+
+type (
+	expr interface {
+		position() pos
+	}
+
+	exprNumber struct {
+		pos   pos
+		value int
+	}
+
+	exprName struct {
+		pos  pos
+		name string
+	}
+
+	exprIndex struct {
+		pos   pos
+		name  string
+		index expr
+	}
+
+	exprCall struct {
+		pos  pos
+		name string
+		args []expr
+	}
+
+	exprUnary struct {
+		pos pos
+		op  string
+		x   expr
+	}
+
+	exprBinary struct {
+		pos  pos
+		op   string
+		x, y expr
+	}
+)
+
+func (e *exprNumber) position() pos { return e.pos }
+func (e *exprName) position() pos   { return e.pos }
+func (e *exprIndex) position() pos  { return e.pos }
+func (e *exprCall) position() pos   { return e.pos }
+func (e *exprUnary) position() pos  { return e.pos }
+func (e *exprBinary) position() pos { return e.pos }
+
+type (
+	stmt interface {
+		position() pos
+	}
+
+	stmtVar struct {
+		pos  pos
+		name string
+		init expr
+	}
+
+	// stmtAssign is 'target op value' where op is '=' or a compound
+	// assignment like '+='. target is an exprName or exprIndex.
+	stmtAssign struct {
+		pos    pos
+		target expr
+		op     string
+		value  expr
+	}
+
+	stmtIf struct {
+		pos  pos
+		cond expr
+		then []stmt
+		els  []stmt
+	}
+
+	stmtWhile struct {
+		pos  pos
+		cond expr
+		body []stmt
+	}
+
+	stmtBreak struct {
+		pos pos
+	}
+
+	stmtContinue struct {
+		pos pos
+	}
+
+	stmtReturn struct {
+		pos   pos
+		value expr
+	}
+
+	stmtExpr struct {
+		pos pos
+		x   expr
+	}
+)
+
+func (s *stmtVar) position() pos      { return s.pos }
+func (s *stmtAssign) position() pos   { return s.pos }
+func (s *stmtIf) position() pos       { return s.pos }
+func (s *stmtWhile) position() pos    { return s.pos }
+func (s *stmtBreak) position() pos    { return s.pos }
+func (s *stmtContinue) position() pos { return s.pos }
+func (s *stmtReturn) position() pos   { return s.pos }
+func (s *stmtExpr) position() pos     { return s.pos }
+
+type (
+	function struct {
+		pos    pos
+		name   string
+		params []string
+		body   []stmt
+	}
+
+	// data is an array or a sprite. Arrays without initializer are only
+	// reserved.
+	data struct {
+		pos    pos
+		name   string
+		size   int
+		bytes  []int
+		sprite bool
+	}
+
+	program struct {
+		globals []*stmtVar
+		data    []*data
+		funcs   []*function
+		consts  map[string]int
+	}
+)
+
+type parser struct {
+	tokens []token
+	index  int
+	prog   *program
+}
+
+// Binary operator precedence, higher binds tighter.
+var precedence = map[string]int{
+	"||": 1,
+	"&&": 2,
+	"==": 3, "!=": 3, "<": 3, "<=": 3, ">": 3, ">=": 3,
+	"|":  4,
+	"^":  5,
+	"&":  6,
+	"<<": 7, ">>": 7,
+	"+": 8, "-": 8,
+}
+
+func (p *parser) peek() token {
+	if p.index < len(p.tokens) {
+		return p.tokens[p.index]
+	}
+
+	var end pos
+	if n := len(p.tokens); n > 0 {
+		end = p.tokens[n-1].pos
+	}
+	return token{kind: tokEOF, text: "end of file", pos: end}
+}
+
+func (p *parser) next() token {
+	tok := p.peek()
+	if tok.kind != tokEOF {
+		p.index++
+	}
+	return tok
+}
+
+func (p *parser) is(text string) bool {
+	tok := p.peek()
+	return (tok.kind == tokPunct || tok.kind == tokIdent) && tok.text == text
+}
+
+func (p *parser) accept(text string) bool {
+	if p.is(text) {
+		p.index++
+		return true
+	}
+	return false
+}
+
+func (p *parser) expect(text string) token {
+	tok := p.next()
+	if (tok.kind != tokPunct && tok.kind != tokIdent) || tok.text != text {
+		panic(errorf(tok.pos, "expected '%s', got '%s'", text, tok.text))
+	}
+	return tok
+}
+
+func (p *parser) name() token {
+	tok := p.next()
+	if tok.kind != tokIdent {
+		panic(errorf(tok.pos, "expected name, got '%s'", tok.text))
+	}
+	if keywords[tok.text] {
+		panic(errorf(tok.pos, "'%s' is a keyword", tok.text))
+	}
+	return tok
+}
+
+var keywords = map[string]bool{
+	"const": true, "var": true, "array": true, "sprite": true, "func": true,
+	"if": true, "else": true, "while": true, "break": true, "continue": true, "return": true,
+}
+
+func parse(src string) *program {
+	p := &parser{tokens: lex(src), prog: &program{consts: make(map[string]int)}}
+	for p.peek().kind != tokEOF {
+		p.declaration()
+	}
+	return p.prog
+}
+
+func (p *parser) declaration() {
+	tok := p.next()
+	switch tok.text {
+	case "const":
+		name := p.name()
+		p.expect("=")
+		value := p.expr()
+		v, ok := p.prog.constValue(value)
+		if !ok {
+			panic(errorf(value.position(), "constant expression expected"))
+		}
+		p.prog.consts[name.text] = v
+	case "var":
+		p.prog.globals = append(p.prog.globals, p.varList()...)
+	case "array":
+		d := &data{pos: tok.pos, name: p.name().text, size: -1}
+		if p.accept("[") {
+			e := p.expr()
+			size, ok := p.prog.constValue(e)
+			if !ok || size < 1 {
+				panic(errorf(e.position(), "array size must be a positive constant"))
+			}
+			d.size = size
+			p.expect("]")
+		}
+		if d.size < 0 || p.is("=") {
+			p.expect("=")
+			d.bytes = p.initializer(false)
+		}
+		if d.size < 0 {
+			d.size = len(d.bytes)
+		}
+		if len(d.bytes) > d.size {
+			panic(errorf(tok.pos, "too many values for array '%s' of %d bytes", d.name, d.size))
+		}
+		p.prog.data = append(p.prog.data, d)
+	case "sprite":
+		d := &data{pos: tok.pos, name: p.name().text, sprite: true}
+		p.expect("=")
+		d.bytes = p.initializer(true)
+		d.size = len(d.bytes)
+		if d.size < 1 || d.size > 15 {
+			panic(errorf(tok.pos, "sprite '%s' must be 1 to 15 rows high", d.name))
+		}
+		p.prog.data = append(p.prog.data, d)
+	case "func":
+		f := &function{pos: tok.pos, name: p.name().text}
+		p.expect("(")
+		for !p.is(")") {
+			if len(f.params) > 0 {
+				p.expect(",")
+			}
+			f.params = append(f.params, p.name().text)
+		}
+		p.expect(")")
+		f.body = p.block()
+		p.prog.funcs = append(p.prog.funcs, f)
+	default:
+		panic(errorf(tok.pos, "expected declaration, got '%s'", tok.text))
+	}
+}
+
+// varList reads 'name [= expr] {, name [= expr]}'.
+func (p *parser) varList() []*stmtVar {
+	var vars []*stmtVar
+	for {
+		name := p.name()
+		v := &stmtVar{pos: name.pos, name: name.text}
+		if p.accept("=") {
+			v.init = p.expr()
+		}
+		vars = append(vars, v)
+
+		if !p.accept(",") {
+			return vars
+		}
+	}
+}
+
+// initializer reads '{ value, ... }'. Sprite rows can also be written as
+// strings where '#' or 'X' is a set pixel.
+func (p *parser) initializer(sprite bool) []int {
+	var values []int
+	p.expect("{")
+	for !p.accept("}") {
+		if tok := p.peek(); tok.kind == tokString {
+			if !sprite {
+				panic(errorf(tok.pos, "strings are only allowed in sprites"))
+			}
+			p.next()
+			if len(tok.text) > 8 {
+				panic(errorf(tok.pos, "sprite rows are at most 8 pixels wide"))
+			}
+
+			row := 0
+			for i, c := range tok.text {
+				if strings.ContainsRune("#Xx1", c) {
+					row |= 0x80 >> uint(i)
+				}
+			}
+			values = append(values, row)
+		} else {
+			e := p.expr()
+			v, ok := p.prog.constValue(e)
+			if !ok {
+				panic(errorf(e.position(), "constant expression expected"))
+			}
+			if v < -128 || v > 255 {
+				panic(errorf(e.position(), "value %d does not fit in a byte", v))
+			}
+			values = append(values, v&0xFF)
+		}
+
+		if !p.accept(",") {
+			p.expect("}")
+			break
+		}
+	}
+	return values
+}
+
+func (p *parser) block() []stmt {
+	var stmts []stmt
+	p.expect("{")
+	for !p.accept("}") {
+		if p.peek().kind == tokEOF {
+			panic(errorf(p.peek().pos, "unexpected end of file, missing '}'"))
+		}
+		stmts = append(stmts, p.statement()...)
+	}
+	return stmts
+}
+
+func (p *parser) statement() []stmt {
+	tok := p.peek()
+	switch tok.text {
+	case "var":
+		p.next()
+		var stmts []stmt
+		for _, v := range p.varList() {
+			stmts = append(stmts, v)
+		}
+		return stmts
+	case "if":
+		return []stmt{p.ifStatement()}
+	case "while":
+		p.next()
+		cond := p.expr()
+		return []stmt{&stmtWhile{tok.pos, cond, p.block()}}
+	case "break":
+		p.next()
+		return []stmt{&stmtBreak{tok.pos}}
+	case "continue":
+		p.next()
+		return []stmt{&stmtContinue{tok.pos}}
+	case "return":
+		p.next()
+		s := &stmtReturn{pos: tok.pos}
+		// The value must start on the same line as 'return'.
+		if next := p.peek(); next.kind != tokEOF && next.pos.line == tok.pos.line && next.text != "}" {
+			s.value = p.expr()
+		}
+		return []stmt{s}
+	}
+
+	x := p.expr()
+	if op := p.peek(); op.kind == tokPunct && strings.HasSuffix(op.text, "=") && precedence[op.text] == 0 {
+		p.next()
+		switch x.(type) {
+		case *exprName, *exprIndex:
+		default:
+			panic(errorf(x.position(), "cannot assign to expression"))
+		}
+		return []stmt{&stmtAssign{tok.pos, x, op.text, p.expr()}}
+	}
+
+	if _, ok := x.(*exprCall); !ok {
+		panic(errorf(x.position(), "expression is not used"))
+	}
+	return []stmt{&stmtExpr{tok.pos, x}}
+}
+
+func (p *parser) ifStatement() stmt {
+	tok := p.expect("if")
+	s := &stmtIf{pos: tok.pos, cond: p.expr()}
+	s.then = p.block()
+	if p.accept("else") {
+		if p.is("if") {
+			s.els = []stmt{p.ifStatement()}
+		} else {
+			s.els = p.block()
+		}
+	}
+	return s
+}
+
+func (p *parser) expr() expr {
+	return p.binary(1)
+}
+
+func (p *parser) binary(minPrec int) expr {
+	x := p.unary()
+	for {
+		op := p.peek()
+		prec := precedence[op.text]
+		if op.kind != tokPunct || prec < minPrec {
+			return x
+		}
+		p.next()
+		x = &exprBinary{op.pos, op.text, x, p.binary(prec + 1)}
+	}
+}
+
+func (p *parser) unary() expr {
+	tok := p.peek()
+	if tok.kind == tokPunct && (tok.text == "-" || tok.text == "~" || tok.text == "!") {
+		p.next()
+		return &exprUnary{tok.pos, tok.text, p.unary()}
+	}
+	return p.primary()
+}
+
+func (p *parser) primary() expr {
+	tok := p.next()
+	switch {
+	case tok.kind == tokNumber:
+		return &exprNumber{tok.pos, tok.value}
+	case tok.kind == tokPunct && tok.text == "(":
+		x := p.expr()
+		p.expect(")")
+		return x
+	case tok.kind == tokIdent && !keywords[tok.text]:
+		if p.accept("(") {
+			call := &exprCall{pos: tok.pos, name: tok.text}
+			for !p.is(")") {
+				if len(call.args) > 0 {
+					p.expect(",")
+				}
+				call.args = append(call.args, p.expr())
+			}
+			p.expect(")")
+			return call
+		}
+		if p.accept("[") {
+			index := p.expr()
+			p.expect("]")
+			return &exprIndex{tok.pos, tok.text, index}
+		}
+		return &exprName{tok.pos, tok.text}
+	}
+	panic(errorf(tok.pos, "expected expression, got '%s'", tok.text))
+}
+
+// constValue evaluates e if it only uses numbers and constants.
+func (prog *program) constValue(e expr) (int, bool) {
+	switch e := e.(type) {
+	case *exprNumber:
+		return e.value, true
+	case *exprName:
+		v, ok := prog.consts[e.name]
+		return v, ok
+	case *exprUnary:
+		x, ok := prog.constValue(e.x)
+		if !ok {
+			return 0, false
+		}
+		switch e.op {
+		case "-":
+			return -x, true
+		case "~":
+			return ^x, true
+		}
+		return boolValue(x == 0), true
+	case *exprBinary:
+		x, ok := prog.constValue(e.x)
+		if !ok {
+			return 0, false
+		}
+		y, ok := prog.constValue(e.y)
+		if !ok {
+			return 0, false
+		}
+
+		switch e.op {
+		case "+":
+			return x + y, true
+		case "-":
+			return x - y, true
+		case "&":
+			return x & y, true
+		case "|":
+			return x | y, true
+		case "^":
+			return x ^ y, true
+		case "<<":
+			return x << uint(y&15), true
+		case ">>":
+			return x >> uint(y&15), true
+		case "==":
+			return boolValue(x == y), true
+		case "!=":
+			return boolValue(x != y), true
+		case "<":
+			return boolValue(x < y), true
+		case "<=":
+			return boolValue(x <= y), true
+		case ">":
+			return boolValue(x > y), true
+		case ">=":
+			return boolValue(x >= y), true
+		case "&&":
+			return boolValue(x != 0 && y != 0), true
+		case "||":
+			return boolValue(x != 0 || y != 0), true
+		}
+	}
+	return 0, false
+}
+
+func boolValue(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
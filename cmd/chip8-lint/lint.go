@@ -0,0 +1,469 @@
+/*
+Copyright (C) 2016 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/andreas-jonsson/chip8/chip8"
+	"github.com/andreas-jonsson/chip8/chip8/analysis"
+	"github.com/andreas-jonsson/chip8/chip8/asm"
+)
+
+const stackSize = 16
+
+// Finding severities.
+const (
+	severityError   = "error"
+	severityWarning = "warning"
+	severityNote    = "note"
+)
+
+type (
+	finding struct {
+		addr     int
+		severity string
+		msg      string
+	}
+
+	value struct {
+		known bool
+		n     int
+	}
+
+	// state is what is known about the registers before an instruction.
+	// iSet is false if the index register may not have been set on some
+	// path leading here.
+	state struct {
+		v    [16]value
+		i    value
+		iSet bool
+	}
+
+	program struct {
+		*analysis.Program
+
+		name      string
+		code      map[int]bool
+		symbols   chip8.Symbols
+		sourceMap *chip8.SourceMap
+
+		states   map[int]*state
+		findings map[finding]bool
+	}
+)
+
+func newProgram(name string, image []byte, start int, target string) (*program, error) {
+	a, err := analysis.Analyze(image, start, target)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &program{
+		Program:  a,
+		name:     name,
+		states:   make(map[int]*state),
+		findings: make(map[finding]bool),
+	}
+	return p, nil
+}
+
+func (p *program) report(addr int, severity, format string, a ...interface{}) {
+	p.findings[finding{addr, severity, fmt.Sprintf(format, a...)}] = true
+}
+
+func (p *program) addrName(addr int) string {
+	if name, ok := p.symbols.Lookup(uint16(addr)); ok && !strings.ContainsRune(name, '+') {
+		return fmt.Sprintf("%s ($%04X)", name, addr)
+	}
+	return fmt.Sprintf("$%04X", addr)
+}
+
+// lint runs all checks and returns the findings sorted by address.
+func (p *program) lint() []finding {
+	p.checkDecoded()
+	// Without instructions there is nothing to follow.
+	if len(p.Instructions()) > 0 {
+		p.flow()
+		p.checkInstructions()
+		p.checkFunctions()
+		p.checkStack()
+		p.checkCode()
+	}
+
+	var findings []finding
+	for f := range p.findings {
+		findings = append(findings, f)
+	}
+	sort.Slice(findings, func(i, j int) bool {
+		a, b := findings[i], findings[j]
+		if a.addr != b.addr {
+			return a.addr < b.addr
+		}
+		return a.msg < b.msg
+	})
+	return findings
+}
+
+// checkDecoded reports invalid and unsupported instructions and execution
+// outside of the program.
+func (p *program) checkDecoded() {
+	for _, pc := range p.Invalid {
+		p.report(pc, severityError, "invalid opcode $%04X", p.Opcode(pc))
+	}
+	for _, pc := range p.Outside {
+		p.report(pc, severityError, "execution reaches $%04X, outside of the program", pc)
+	}
+	for _, pc := range p.Instructions() {
+		inst, _ := p.Instruction(pc)
+		if !supported(inst.Mnemonic, p.Target) {
+			p.report(pc, severityError, "'%s' ($%04X) is not supported by target %s, only by %s", inst.Mnemonic, p.Opcode(pc), p.Target, strings.Join(asm.Targets(inst.Mnemonic), ", "))
+		}
+	}
+}
+
+func supported(mnemonic, target string) bool {
+	for _, t := range asm.Targets(mnemonic) {
+		if t == target {
+			return true
+		}
+	}
+	return false
+}
+
+func (a value) merge(b value) value {
+	if a.known && b.known && a.n == b.n {
+		return a
+	}
+	return value{}
+}
+
+func (s *state) merge(o *state) *state {
+	m := &state{i: s.i.merge(o.i), iSet: s.iSet && o.iSet}
+	for r := range s.v {
+		m.v[r] = s.v[r].merge(o.v[r])
+	}
+	return m
+}
+
+// flow computes the register state before every reached instruction.
+func (p *program) flow() {
+	var work []int
+	propagate := func(pc int, s *state) {
+		if !p.IsInstruction(pc) {
+			return
+		}
+		if old, ok := p.states[pc]; ok {
+			if s = old.merge(s); *s == *old {
+				return
+			}
+		}
+		p.states[pc] = s
+		work = append(work, pc)
+	}
+
+	propagate(p.Start, new(state))
+	for len(work) > 0 {
+		pc := work[len(work)-1]
+		work = work[:len(work)-1]
+
+		next, call := p.Successors(pc)
+		s := p.transfer(pc, *p.states[pc])
+		if call >= 0 {
+			propagate(call, s)
+
+			// Nothing is known about the state after a call returns.
+			s = &state{iSet: true}
+		}
+		for _, n := range next {
+			propagate(n, s)
+		}
+	}
+}
+
+// transfer returns the state after executing the instruction at pc.
+func (p *program) transfer(pc int, s state) *state {
+	op := p.Opcode(pc)
+	x, y := (op>>8)&0xF, (op>>4)&0xF
+	nn := int(op & 0xFF)
+
+	switch op & 0xF000 {
+	case 0x5000:
+		if op&0xF == 3 {
+			p.forRange(x, y, func(r uint16) { s.v[r] = value{} })
+		}
+	case 0x6000:
+		s.v[x] = value{true, nn}
+	case 0x7000:
+		if s.v[x].known {
+			s.v[x].n = (s.v[x].n + nn) & 0xFF
+		}
+	case 0x8000:
+		a, b := s.v[x], s.v[y]
+		res := value{}
+		if op&0xF == 0 {
+			res = b
+		} else if a.known && b.known {
+			switch op & 0xF {
+			case 1:
+				res = value{true, a.n | b.n}
+			case 2:
+				res = value{true, a.n & b.n}
+			case 3:
+				res = value{true, a.n ^ b.n}
+			case 4:
+				res = value{true, (a.n + b.n) & 0xFF}
+			case 5:
+				res = value{true, (a.n - b.n) & 0xFF}
+			case 7:
+				res = value{true, (b.n - a.n) & 0xFF}
+			}
+		}
+		if op&0xF != 0 {
+			s.v[0xF] = value{}
+		}
+		s.v[x] = res
+	case 0xA000:
+		s.i, s.iSet = value{true, int(op & 0xFFF)}, true
+	case 0xC000:
+		s.v[x] = value{}
+	case 0xD000:
+		s.v[0xF] = value{}
+	case 0xF000:
+		switch {
+		case op == 0xF000 && p.Size(pc) == 4:
+			s.i, s.iSet = value{true, int(p.Opcode(pc + 2))}, true
+		case nn == 0x07, nn == 0x0A:
+			s.v[x] = value{}
+		case nn == 0x1E:
+			if s.i.known && s.v[x].known {
+				s.i.n += s.v[x].n
+			} else {
+				s.i = value{}
+			}
+		case nn == 0x29, nn == 0x30:
+			s.i, s.iSet = value{}, true
+		case nn == 0x55, nn == 0x65:
+			if nn == 0x65 {
+				for r := uint16(0); r <= x; r++ {
+					s.v[r] = value{}
+				}
+			}
+			// The original interpreter increments the index, later ones do not.
+			if p.Target == "chip8" {
+				s.i = value{}
+			}
+		case nn == 0x85:
+			for r := uint16(0); r <= x && r < 8; r++ {
+				s.v[r] = value{}
+			}
+		}
+	}
+	return &s
+}
+
+func (p *program) forRange(x, y uint16, f func(r uint16)) {
+	if x > y {
+		x, y = y, x
+	}
+	for r := x; r <= y; r++ {
+		f(r)
+	}
+}
+
+// access returns the number of bytes the instruction at pc reads or writes
+// at the index register.
+func (p *program) access(pc int) (n int, write bool) {
+	op := p.Opcode(pc)
+	x, y := int(op>>8)&0xF, int(op>>4)&0xF
+	switch {
+	case op&0xF000 == 0xD000:
+		n = int(op & 0xF)
+		if n == 0 && p.Target != "chip8" {
+			n = 32
+		}
+		return n, false
+	case op&0xF00F == 0x5002, op&0xF00F == 0x5003:
+		if x > y {
+			x, y = y, x
+		}
+		return y - x + 1, op&0xF == 2
+	case op == 0xF002:
+		return 16, false
+	case op&0xF000 == 0xF000:
+		switch op & 0xFF {
+		case 0x33:
+			return 3, true
+		case 0x55:
+			return x + 1, true
+		case 0x65:
+			return x + 1, false
+		}
+	}
+	return 0, false
+}
+
+// checkInstructions checks the memory accesses of every reached
+// instruction.
+func (p *program) checkInstructions() {
+	for pc, s := range p.states {
+		op := p.Opcode(pc)
+		inst, _ := asm.Decode(op)
+
+		if op&0xF000 == 0xD000 && !s.iSet {
+			p.report(pc, severityWarning, "the index register may be unset at this draw")
+		}
+
+		n, write := p.access(pc)
+		if n == 0 || !s.i.known {
+			continue
+		}
+		start, end := s.i.n, s.i.n+n
+		if end > len(p.Memory) {
+			p.report(pc, severityError, "'%s' accesses $%04X-$%04X, past the end of memory at $%04X", inst.Mnemonic, start, end-1, len(p.Memory))
+			end = len(p.Memory)
+		}
+		if !write {
+			continue
+		}
+		for addr := start; addr < end; addr++ {
+			if code := p.CodeAt(addr); code >= 0 {
+				p.report(pc, severityWarning, "'%s' writes to $%04X, which is executed as code at %s", inst.Mnemonic, addr, p.addrName(code))
+				break
+			}
+		}
+	}
+}
+
+// checkFunctions checks that subroutines return and that the main program
+// does not.
+func (p *program) checkFunctions() {
+	for _, fn := range p.Funcs {
+		if fn.Entry == p.Start {
+			for _, b := range fn.Blocks {
+				if pc := p.Last(b); p.Opcode(pc) == 0x00EE {
+					p.report(pc, severityError, "'rts' outside of a subroutine, the stack is empty")
+				}
+			}
+			continue
+		}
+		if !fn.Returns && !fn.Halts && !p.hasJumpTable(fn) {
+			p.report(fn.Entry, severityWarning, "subroutine %s never returns, every call leaves an entry on the stack", p.addrName(fn.Entry))
+		}
+	}
+}
+
+func (p *program) hasJumpTable(fn *analysis.Function) bool {
+	for _, b := range fn.Blocks {
+		if p.JumpTable(p.Last(b)) != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// checkStack reports recursion and call chains deeper than the stack.
+func (p *program) checkStack() {
+	if p.Func(p.Start) == nil {
+		return
+	}
+
+	const (
+		unvisited = iota
+		visiting
+		done
+	)
+
+	var (
+		mark  = make(map[int]int)
+		depth = make(map[int]int)
+		next  = make(map[int]analysis.CallSite)
+		visit func(entry int)
+	)
+
+	visit = func(entry int) {
+		mark[entry] = visiting
+		for _, c := range p.Func(entry).Calls {
+			if p.Func(c.Target) == nil {
+				continue
+			}
+			switch mark[c.Target] {
+			case visiting:
+				p.report(c.PC, severityWarning, "recursive call to %s, the stack may overflow", p.addrName(c.Target))
+				continue
+			case unvisited:
+				visit(c.Target)
+			}
+			if d := depth[c.Target] + 1; d > depth[entry] {
+				depth[entry], next[entry] = d, c
+			}
+		}
+		mark[entry] = done
+	}
+	visit(p.Start)
+
+	if depth[p.Start] <= stackSize {
+		return
+	}
+
+	chain := []string{p.addrName(p.Start)}
+	entry := p.Start
+	for n := 1; ; n++ {
+		c := next[entry]
+		chain = append(chain, p.addrName(c.Target))
+		if n > stackSize {
+			p.report(c.PC, severityError, "call depth reaches %d, the stack holds %d return addresses: %s", depth[p.Start], stackSize, strings.Join(chain, " -> "))
+			return
+		}
+		entry = c.Target
+	}
+}
+
+// checkCode compares the reached instructions with the code written by
+// the assembler, if known.
+func (p *program) checkCode() {
+	if p.code == nil {
+		return
+	}
+
+	for _, pc := range p.Instructions() {
+		if !p.code[pc] {
+			p.report(pc, severityWarning, "data at $%04X is executed as code", pc)
+		}
+	}
+
+	var addrs []int
+	for pc := range p.code {
+		if !p.IsInstruction(pc) {
+			addrs = append(addrs, pc)
+		}
+	}
+	sort.Ints(addrs)
+	for i, pc := range addrs {
+		if i == 0 || !p.code[pc-2] || p.IsInstruction(pc-2) {
+			p.report(pc, severityWarning, "unreachable code")
+		}
+	}
+	if len(addrs) > 0 {
+		for _, t := range p.JumpTables {
+			p.report(t.PC, severityNote, "the targets of this jump0 are guessed, code reported as unreachable may be reached through it")
+		}
+	}
+}
@@ -0,0 +1,188 @@
+/*
+Copyright (C) 2016 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/andreas-jonsson/chip8/chip8/analysis"
+	"github.com/andreas-jonsson/chip8/chip8/asm"
+	"github.com/andreas-jonsson/chip8/cmd/internal/cli"
+)
+
+const programStart = 0x200
+
+var (
+	target      = flag.String("target", "", "target platform, default the target of the source or the one a ROM needs")
+	includeDirs cli.IncludePaths
+)
+
+func init() {
+	flag.Var(&includeDirs, "I", "add directory to the include search path")
+	flag.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: chip8-lint [-target chip8|schip|xochip|chippy] [-I dir] <input.asm|input.ch8|dir> ...")
+		flag.PrintDefaults()
+	}
+}
+
+// loadSource assembles a source file, problems in the source are reported
+// and no program is returned.
+func loadSource(fileName string) (*program, error) {
+	prog, err := asm.AssembleFile(fileName, asm.Options{IncludeDirs: includeDirs})
+	if err != nil {
+		return nil, err
+	}
+	if prog.NumErrors() > 0 {
+		asm.WriteDiagnostics(os.Stderr, "gcc", prog.Diagnostics)
+		return nil, fmt.Errorf("%s: %d error(s), not linted", fileName, prog.NumErrors())
+	}
+
+	name := prog.Target()
+	if *target != "" {
+		name = *target
+	}
+
+	image, sourceMap := prog.Image()
+	p, err := newProgram(fileName, image, prog.Start(), name)
+	if err != nil {
+		return nil, err
+	}
+
+	p.code = make(map[int]bool)
+	for _, addr := range prog.Code() {
+		p.code[addr] = true
+	}
+	p.symbols = prog.Symbols()
+	p.sourceMap = sourceMap
+	return p, nil
+}
+
+// loadROM loads a program and the symbol file and source map written next
+// to it by the assembler, if there are any.
+func loadROM(fileName string) (*program, error) {
+	image, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+
+	name := *target
+	if name == "" {
+		name = romTarget(image)
+	}
+	p, err := newProgram(fileName, image, programStart, name)
+	if err != nil {
+		return nil, err
+	}
+
+	if p.symbols, p.sourceMap, err = cli.ReadDebugInfo(fileName); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// romTarget returns the first of the targets that supports every
+// instruction reached in a ROM, or else the one with the fewest invalid and
+// unsupported instructions.
+func romTarget(image []byte) string {
+	best, fewest := "chip8", -1
+	for _, name := range []string{"chip8", "schip", "xochip", "chippy"} {
+		p, err := analysis.Analyze(image, programStart, name)
+		if err != nil {
+			continue
+		}
+
+		n := len(p.Invalid)
+		for _, pc := range p.Instructions() {
+			if inst, _ := p.Instruction(pc); !supported(inst.Mnemonic, name) {
+				n++
+			}
+		}
+		if n == 0 {
+			return name
+		}
+		if fewest < 0 || n < fewest {
+			best, fewest = name, n
+		}
+	}
+	return best
+}
+
+func lintFile(fileName string) (int, error) {
+	var (
+		p   *program
+		err error
+	)
+	if strings.ToLower(filepath.Ext(fileName)) == ".ch8" {
+		p, err = loadROM(fileName)
+	} else {
+		p, err = loadSource(fileName)
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	findings := p.lint()
+	for _, f := range findings {
+		if loc, ok := p.sourceMap.Lookup(uint16(f.addr)); ok {
+			fmt.Printf("%s: %s: %s\n", loc, f.severity, f.msg)
+		} else {
+			fmt.Printf("%s:$%04X: %s: %s\n", fileName, f.addr, f.severity, f.msg)
+		}
+	}
+	return len(findings), nil
+}
+
+func main() {
+	flag.Parse()
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	var files []string
+	for _, path := range flag.Args() {
+		info, err := os.Stat(path)
+		if err != nil || !info.IsDir() {
+			files = append(files, path)
+			continue
+		}
+		filepath.Walk(path, func(path string, info os.FileInfo, err error) error {
+			if err == nil && !info.IsDir() && strings.ToLower(filepath.Ext(path)) == ".ch8" {
+				files = append(files, path)
+			}
+			return nil
+		})
+	}
+
+	exitCode := 0
+	for _, fileName := range files {
+		n, err := lintFile(fileName)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			exitCode = 2
+		} else if n > 0 && exitCode == 0 {
+			exitCode = 1
+		}
+	}
+	os.Exit(exitCode)
+}
@@ -0,0 +1,48 @@
+/*
+Copyright (C) 2016 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/andreas-jonsson/chip8/cmd/internal/cli"
+)
+
+const version = "0.1.0"
+
+var includeDirs cli.IncludePaths
+
+func init() {
+	flag.Var(&includeDirs, "I", "add directory to the include search path")
+	flag.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: chip8-lsp [-I dir]")
+		flag.PrintDefaults()
+	}
+}
+
+func main() {
+	flag.Parse()
+	log.SetFlags(0)
+	log.SetPrefix("chip8-lsp: ")
+
+	srv := newServer(os.Stdin, os.Stdout, includeDirs)
+	os.Exit(srv.run())
+}
@@ -0,0 +1,39 @@
+/*
+Copyright (C) 2016 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+// Timing and compatibility notes shown when hovering a mnemonic. Every
+// instruction takes one cycle at the CPU frequency unless noted here.
+var timingNotes = map[string]string{
+	"draw":   "On the COSMAC VIP the interpreter waits for the vertical blank before drawing, limiting a program to 60 sprites per second. Emulators with the display wait quirk do the same.",
+	"keyd":   "Blocks until a key is pressed, the timers keep counting.",
+	"moved":  "The delay timer counts down at 60 hz independent of the CPU frequency.",
+	"loadd":  "The delay timer counts down at 60 hz independent of the CPU frequency.",
+	"loads":  "The sound timer counts down at 60 hz, a tone plays while it is non-zero.",
+	"stor":   "The original interpreter increments index past the stored registers, SCHIP leaves it unchanged.",
+	"read":   "The original interpreter increments index past the read registers, SCHIP leaves it unchanged.",
+	"shr":    "The original interpreter shifts register t into s, SCHIP shifts s in place.",
+	"shl":    "The original interpreter shifts register t into s, SCHIP shifts s in place.",
+	"jump0":  "SCHIP adds register vX, where X is the high nibble of the address, instead of v0.",
+	"and":    "The original interpreter resets vf.",
+	"or":     "The original interpreter resets vf.",
+	"xor":    "The original interpreter resets vf.",
+	"call":   "The stack holds 16 return addresses.",
+	"clr":    "On the COSMAC VIP the interpreter waits for the vertical blank.",
+	"loadil": "Takes two words, skip instructions skip both on XO-CHIP.",
+}
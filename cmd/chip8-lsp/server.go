@@ -0,0 +1,539 @@
+/*
+Copyright (C) 2016 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/url"
+	"path/filepath"
+	"strings"
+
+	"github.com/andreas-jonsson/chip8/chip8/asm"
+)
+
+type (
+	document struct {
+		path      string
+		text      string
+		prog      *asm.Program
+		published []string
+	}
+
+	server struct {
+		conn        *conn
+		includeDirs []string
+		docs        map[string]*document
+
+		initialized, shutdown bool
+	}
+
+	handler func(s *server, params json.RawMessage) (interface{}, error)
+)
+
+var handlers = map[string]handler{
+	"initialize":                  (*server).initialize,
+	"shutdown":                    (*server).handleShutdown,
+	"textDocument/didOpen":        (*server).didOpen,
+	"textDocument/didChange":      (*server).didChange,
+	"textDocument/didClose":       (*server).didClose,
+	"textDocument/hover":          (*server).hover,
+	"textDocument/definition":     (*server).definition,
+	"textDocument/references":     (*server).references,
+	"textDocument/completion":     (*server).completion,
+	"textDocument/documentSymbol": (*server).documentSymbol,
+}
+
+func newServer(reader io.Reader, writer io.Writer, includeDirs []string) *server {
+	return &server{
+		conn:        &conn{reader: bufio.NewReader(reader), writer: writer},
+		includeDirs: includeDirs,
+		docs:        make(map[string]*document),
+	}
+}
+
+// run serves requests until the client sends exit. The exit code follows
+// the protocol, 0 if shutdown was requested first.
+func (s *server) run() int {
+	for {
+		msg, err := s.conn.read()
+		if err != nil {
+			if rerr, ok := err.(*responseError); ok {
+				s.conn.write(&message{ID: nullID(), Error: rerr})
+				continue
+			}
+			if err != io.EOF {
+				log.Println(err)
+			}
+			return 1
+		}
+
+		if msg.Method == "exit" {
+			if s.shutdown {
+				return 0
+			}
+			return 1
+		}
+
+		result, err := s.dispatch(msg)
+		if msg.ID == nil {
+			if err != nil {
+				log.Printf("%s: %v\n", msg.Method, err)
+			}
+			continue
+		}
+
+		resp := &message{ID: msg.ID, Result: result}
+		if err != nil {
+			rerr, ok := err.(*responseError)
+			if !ok {
+				rerr = &responseError{errInvalidParams, err.Error()}
+			}
+			resp.Result, resp.Error = nil, rerr
+		} else if result == nil {
+			resp.Result = json.RawMessage("null")
+		}
+		if err := s.conn.write(resp); err != nil {
+			log.Println(err)
+			return 1
+		}
+	}
+}
+
+func (s *server) dispatch(msg *message) (interface{}, error) {
+	h, ok := handlers[msg.Method]
+	if !ok {
+		if msg.ID == nil || strings.HasPrefix(msg.Method, "$/") {
+			return nil, nil
+		}
+		return nil, &responseError{errMethodNotFound, fmt.Sprintf("method not found: %s", msg.Method)}
+	}
+	if !s.initialized && msg.Method != "initialize" {
+		return nil, &responseError{errNotInitialized, "server not initialized"}
+	}
+	return h(s, msg.Params)
+}
+
+func nullID() *json.RawMessage {
+	id := json.RawMessage("null")
+	return &id
+}
+
+func (s *server) initialize(params json.RawMessage) (interface{}, error) {
+	s.initialized = true
+	return map[string]interface{}{
+		"capabilities": map[string]interface{}{
+			"textDocumentSync":       1,
+			"hoverProvider":          true,
+			"definitionProvider":     true,
+			"referencesProvider":     true,
+			"documentSymbolProvider": true,
+			"completionProvider":     map[string]interface{}{},
+		},
+		"serverInfo": map[string]string{"name": "chip8-lsp", "version": version},
+	}, nil
+}
+
+func (s *server) handleShutdown(params json.RawMessage) (interface{}, error) {
+	s.shutdown = true
+	return nil, nil
+}
+
+func (s *server) didOpen(params json.RawMessage) (interface{}, error) {
+	var p didOpenParams
+	if err := json.Unmarshal(params, &p); err != nil {
+		return nil, err
+	}
+
+	path, err := uriToPath(p.TextDocument.URI)
+	if err != nil {
+		return nil, err
+	}
+
+	doc := &document{path: path, text: p.TextDocument.Text}
+	s.docs[p.TextDocument.URI] = doc
+	return nil, s.update(doc)
+}
+
+func (s *server) didChange(params json.RawMessage) (interface{}, error) {
+	var p didChangeParams
+	if err := json.Unmarshal(params, &p); err != nil {
+		return nil, err
+	}
+
+	doc, ok := s.docs[p.TextDocument.URI]
+	if !ok || len(p.ContentChanges) == 0 {
+		return nil, nil
+	}
+	doc.text = p.ContentChanges[len(p.ContentChanges)-1].Text
+	return nil, s.update(doc)
+}
+
+func (s *server) didClose(params json.RawMessage) (interface{}, error) {
+	var p didCloseParams
+	if err := json.Unmarshal(params, &p); err != nil {
+		return nil, err
+	}
+
+	doc, ok := s.docs[p.TextDocument.URI]
+	if !ok {
+		return nil, nil
+	}
+	delete(s.docs, p.TextDocument.URI)
+	return nil, s.publish(doc, nil)
+}
+
+// update assembles the document and publishes its diagnostics.
+func (s *server) update(doc *document) error {
+	opts := asm.Options{IncludeDirs: s.includeDirs, Chipper: strings.ToLower(filepath.Ext(doc.path)) == ".chp"}
+	prog, err := asm.Assemble(doc.path, []byte(doc.text), opts)
+	if err != nil {
+		doc.prog = nil
+		return s.publish(doc, []asm.Diagnostic{{File: doc.path, Line: 1, Column: 1, Severity: asm.SeverityError, Message: err.Error()}})
+	}
+	doc.prog = prog
+	return s.publish(doc, prog.Diagnostics)
+}
+
+// publish sends diags grouped by file, files that had diagnostics from the
+// last update are cleared.
+func (s *server) publish(doc *document, diags []asm.Diagnostic) error {
+	files := make(map[string][]lspDiagnostic)
+	for _, uri := range doc.published {
+		files[uri] = []lspDiagnostic{}
+	}
+
+	for _, d := range diags {
+		uri := pathToURI(d.File)
+		severity := severityError
+		if d.Severity == asm.SeverityWarning {
+			severity = severityWarning
+		}
+		files[uri] = append(files[uri], lspDiagnostic{
+			Range:    s.diagnosticRange(d),
+			Severity: severity,
+			Source:   "chip8-asm",
+			Message:  d.Message,
+		})
+	}
+	doc.published = nil
+	for uri, list := range files {
+		if len(list) > 0 {
+			doc.published = append(doc.published, uri)
+		}
+		if err := s.conn.notify("textDocument/publishDiagnostics", publishDiagnosticsParams{uri, list}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// diagnosticRange returns the range of the word d points at, or of the
+// text up to the next space if it is not at a word.
+func (s *server) diagnosticRange(d asm.Diagnostic) lspRange {
+	pos := toLSPPosition(asm.Position{Line: d.Line, Column: d.Column})
+	text := s.fileText(d.File)
+	if word, rng := wordAt(text, pos); word != "" {
+		return rng
+	}
+
+	end := pos
+	end.Character++
+	lines := strings.Split(text, "\n")
+	if pos.Line < len(lines) {
+		line := strings.TrimRight(lines[pos.Line], "\r")
+		for end.Character < len(line) && line[end.Character] != ' ' && line[end.Character] != '\t' {
+			end.Character++
+		}
+	}
+	return lspRange{pos, end}
+}
+
+// fileText returns the text of the open document at path, or else of the
+// file.
+func (s *server) fileText(path string) string {
+	for _, doc := range s.docs {
+		if doc.path == path {
+			return doc.text
+		}
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return ""
+	}
+	return string(data)
+}
+
+func (s *server) hover(params json.RawMessage) (interface{}, error) {
+	var p textDocumentPositionParams
+	if err := json.Unmarshal(params, &p); err != nil {
+		return nil, err
+	}
+
+	doc, ok := s.docs[p.TextDocument.URI]
+	if !ok {
+		return nil, nil
+	}
+	word, rng := wordAt(doc.text, p.Position)
+	if word == "" {
+		return nil, nil
+	}
+
+	var text string
+	if sym, ok := doc.symbolAt(word, p.Position); ok {
+		if sym.Label {
+			text = fmt.Sprintf("```\n%s:\n```\nLabel at 0x%X", sym.Name, sym.Value)
+		} else {
+			text = fmt.Sprintf("```\n%s = %d\n```\nConstant, 0x%X", sym.Name, sym.Value, sym.Value)
+		}
+	} else if inst, ok := asm.FindInstruction(strings.ToLower(word)); ok {
+		text = instructionDoc(inst)
+	} else if isRegister(word) {
+		text = fmt.Sprintf("Register %s", strings.ToLower(word))
+		if strings.ToLower(word) == "vf" {
+			text += ", used as flag by arithmetic, shifts and draw"
+		}
+	} else if isDirective(strings.ToLower(word)) {
+		text = fmt.Sprintf("Assembler directive `%s`", strings.ToLower(word))
+	} else {
+		return nil, nil
+	}
+	return &hover{Contents: markupContent{"markdown", text}, Range: &rng}, nil
+}
+
+func instructionDoc(inst asm.Instruction) string {
+	text := fmt.Sprintf("```\n%s  ; %s\n```\n%s\n\nTargets: %s", inst.Mnemonic, inst.Opcode, inst.Description, strings.Join(asm.Targets(inst.Mnemonic), ", "))
+	if note, ok := timingNotes[inst.Mnemonic]; ok {
+		return text + "\n\n" + note
+	}
+	return text + "\n\nOne cycle at the CPU frequency."
+}
+
+func (s *server) definition(params json.RawMessage) (interface{}, error) {
+	var p textDocumentPositionParams
+	if err := json.Unmarshal(params, &p); err != nil {
+		return nil, err
+	}
+
+	doc, ok := s.docs[p.TextDocument.URI]
+	if !ok {
+		return nil, nil
+	}
+	word, _ := wordAt(doc.text, p.Position)
+	sym, ok := doc.symbolAt(word, p.Position)
+	if !ok {
+		return nil, nil
+	}
+	return []location{symbolLocation(sym.Name, sym.Pos)}, nil
+}
+
+func (s *server) references(params json.RawMessage) (interface{}, error) {
+	var p referenceParams
+	if err := json.Unmarshal(params, &p); err != nil {
+		return nil, err
+	}
+
+	doc, ok := s.docs[p.TextDocument.URI]
+	if !ok {
+		return nil, nil
+	}
+	word, _ := wordAt(doc.text, p.Position)
+	sym, ok := doc.symbolAt(word, p.Position)
+	if !ok {
+		return nil, nil
+	}
+
+	locs := []location{}
+	if p.Context.IncludeDeclaration {
+		locs = append(locs, symbolLocation(sym.Name, sym.Pos))
+	}
+	for _, ref := range sym.Refs {
+		locs = append(locs, symbolLocation(sym.Name, ref))
+	}
+	return locs, nil
+}
+
+func (s *server) completion(params json.RawMessage) (interface{}, error) {
+	var p textDocumentPositionParams
+	if err := json.Unmarshal(params, &p); err != nil {
+		return nil, err
+	}
+
+	var items []completionItem
+	for _, inst := range asm.Instructions {
+		items = append(items, completionItem{
+			Label:         inst.Mnemonic,
+			Kind:          completionKeyword,
+			Detail:        inst.Opcode,
+			Documentation: &markupContent{"markdown", inst.Description},
+		})
+	}
+	for _, dir := range asm.Directives {
+		items = append(items, completionItem{Label: dir, Kind: completionKeyword, Detail: "directive"})
+	}
+	for r := 0; r < 16; r++ {
+		items = append(items, completionItem{Label: fmt.Sprintf("v%x", r), Kind: completionVariable})
+	}
+
+	if doc, ok := s.docs[p.TextDocument.URI]; ok && doc.prog != nil {
+		for _, sym := range doc.prog.SymbolInfo() {
+			if sym.Label {
+				items = append(items, completionItem{Label: sym.Name, Kind: completionFunction, Detail: fmt.Sprintf("0x%X", sym.Value)})
+			} else {
+				items = append(items, completionItem{Label: sym.Name, Kind: completionConstant, Detail: fmt.Sprint(sym.Value)})
+			}
+		}
+	}
+	return items, nil
+}
+
+func (s *server) documentSymbol(params json.RawMessage) (interface{}, error) {
+	var p documentSymbolParams
+	if err := json.Unmarshal(params, &p); err != nil {
+		return nil, err
+	}
+
+	symbols := []symbolInformation{}
+	doc, ok := s.docs[p.TextDocument.URI]
+	if !ok || doc.prog == nil {
+		return symbols, nil
+	}
+
+	for _, sym := range doc.prog.SymbolInfo() {
+		if sym.Pos.File != doc.path {
+			continue
+		}
+		kind := symbolConstant
+		if sym.Label {
+			kind = symbolFunction
+		}
+		symbols = append(symbols, symbolInformation{sym.Name, kind, symbolLocation(sym.Name, sym.Pos)})
+	}
+	return symbols, nil
+}
+
+// symbolAt returns the symbol defined or referenced at pos, or else the
+// symbol called name.
+func (doc *document) symbolAt(name string, pos lspPosition) (asm.SymbolInfo, bool) {
+	if doc.prog == nil || name == "" {
+		return asm.SymbolInfo{}, false
+	}
+
+	symbols := doc.prog.SymbolInfo()
+	covers := func(sym asm.SymbolInfo, p asm.Position) bool {
+		start := toLSPPosition(p)
+		return p.File == doc.path && start.Line == pos.Line && pos.Character >= start.Character && pos.Character <= start.Character+len(sym.Name)
+	}
+
+	for _, sym := range symbols {
+		if covers(sym, sym.Pos) {
+			return sym, true
+		}
+		for _, ref := range sym.Refs {
+			if covers(sym, ref) {
+				return sym, true
+			}
+		}
+	}
+
+	for _, sym := range symbols {
+		if sym.Name == name {
+			return sym, true
+		}
+	}
+	return asm.SymbolInfo{}, false
+}
+
+func symbolLocation(name string, pos asm.Position) location {
+	start := toLSPPosition(pos)
+	end := lspPosition{start.Line, start.Character + len(name)}
+	return location{pathToURI(pos.File), lspRange{start, end}}
+}
+
+func toLSPPosition(pos asm.Position) lspPosition {
+	p := lspPosition{pos.Line - 1, pos.Column - 1}
+	if p.Line < 0 {
+		p.Line = 0
+	}
+	if p.Character < 0 {
+		p.Character = 0
+	}
+	return p
+}
+
+// wordAt returns the identifier, mnemonic or register under pos.
+func wordAt(text string, pos lspPosition) (string, lspRange) {
+	lines := strings.Split(text, "\n")
+	if pos.Line < 0 || pos.Line >= len(lines) {
+		return "", lspRange{}
+	}
+
+	line := strings.TrimRight(lines[pos.Line], "\r")
+	start, end := pos.Character, pos.Character
+	if start > len(line) {
+		return "", lspRange{}
+	}
+	for start > 0 && isWordChar(line[start-1]) {
+		start--
+	}
+	for end < len(line) && isWordChar(line[end]) {
+		end++
+	}
+	return line[start:end], lspRange{lspPosition{pos.Line, start}, lspPosition{pos.Line, end}}
+}
+
+func isWordChar(c byte) bool {
+	return c == '_' || c == '.' || c == '@' || c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+}
+
+func isRegister(word string) bool {
+	word = strings.ToLower(word)
+	return len(word) == 2 && word[0] == 'v' && strings.IndexByte("0123456789abcdef", word[1]) >= 0
+}
+
+func isDirective(word string) bool {
+	for _, dir := range asm.Directives {
+		if dir == word {
+			return true
+		}
+	}
+	return false
+}
+
+func uriToPath(uri string) (string, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return "", err
+	}
+	if u.Scheme != "file" {
+		return "", fmt.Errorf("unsupported uri '%s'", uri)
+	}
+	return filepath.FromSlash(u.Path), nil
+}
+
+func pathToURI(path string) string {
+	if abs, err := filepath.Abs(path); err == nil {
+		path = abs
+	}
+	u := url.URL{Scheme: "file", Path: filepath.ToSlash(path)}
+	return u.String()
+}
@@ -0,0 +1,126 @@
+/*
+Copyright (C) 2016 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"testing"
+)
+
+const (
+	testURI  = "file:///test.asm"
+	testText = "start:\n    load v0, 1\n    call sub\n    load v1, missing\n    jump start\n\nsub:\n    rts\n"
+)
+
+// request frames a JSON-RPC request, or a notification if id is 0.
+func request(w io.Writer, id int, method string, params interface{}) {
+	msg := map[string]interface{}{"jsonrpc": "2.0", "method": method, "params": params}
+	if id != 0 {
+		msg["id"] = id
+	}
+	body, _ := json.Marshal(msg)
+	fmt.Fprintf(w, "Content-Length: %d\r\n\r\n%s", len(body), body)
+}
+
+func position(line, character int) map[string]interface{} {
+	return map[string]interface{}{
+		"textDocument": map[string]string{"uri": testURI},
+		"position":     map[string]int{"line": line, "character": character},
+	}
+}
+
+// session runs the server on a client session and returns the responses
+// by id and the notifications sent.
+func session(t *testing.T) (map[int]json.RawMessage, []*message) {
+	var in, out bytes.Buffer
+	request(&in, 1, "initialize", map[string]interface{}{})
+	request(&in, 0, "initialized", map[string]interface{}{})
+	request(&in, 0, "textDocument/didOpen", map[string]interface{}{
+		"textDocument": map[string]interface{}{"uri": testURI, "languageId": "chip8", "version": 1, "text": testText},
+	})
+	request(&in, 2, "textDocument/hover", position(2, 10))
+	request(&in, 3, "textDocument/definition", position(4, 11))
+	request(&in, 4, "shutdown", nil)
+	request(&in, 0, "exit", nil)
+
+	if code := newServer(&in, &out, nil).run(); code != 0 {
+		t.Fatalf("exit code %d", code)
+	}
+
+	responses := make(map[int]json.RawMessage)
+	var notifications []*message
+	c := &conn{reader: bufio.NewReader(&out)}
+	for {
+		msg, err := c.read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if msg.ID == nil {
+			notifications = append(notifications, msg)
+			continue
+		}
+
+		var id int
+		if err := json.Unmarshal(*msg.ID, &id); err != nil {
+			t.Fatal(err)
+		}
+		if msg.Error != nil {
+			t.Fatalf("request %d: %v", id, msg.Error)
+		}
+		result, _ := json.Marshal(msg.Result)
+		responses[id] = result
+	}
+	return responses, notifications
+}
+
+func TestServer(t *testing.T) {
+	responses, notifications := session(t)
+
+	var diags []lspDiagnostic
+	for _, msg := range notifications {
+		var p publishDiagnosticsParams
+		if msg.Method != "textDocument/publishDiagnostics" || json.Unmarshal(msg.Params, &p) != nil {
+			continue
+		}
+		if p.URI == testURI {
+			diags = append(diags, p.Diagnostics...)
+		}
+	}
+	want := lspRange{lspPosition{3, 13}, lspPosition{3, 20}}
+	if len(diags) != 1 || diags[0].Range != want || diags[0].Severity != severityError {
+		t.Errorf("diagnostics = %+v, want an error at %+v", diags, want)
+	}
+
+	var h hover
+	if err := json.Unmarshal(responses[2], &h); err != nil || !bytes.Contains([]byte(h.Contents.Value), []byte("sub:")) {
+		t.Errorf("hover = %s, want label sub", responses[2])
+	}
+
+	var locs []location
+	want = lspRange{lspPosition{0, 0}, lspPosition{0, 5}}
+	if err := json.Unmarshal(responses[3], &locs); err != nil || len(locs) != 1 || locs[0].URI != testURI || locs[0].Range != want {
+		t.Errorf("definition = %s, want start at %+v", responses[3], want)
+	}
+}
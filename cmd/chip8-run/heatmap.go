@@ -0,0 +1,125 @@
+/*
+Copyright (C) 2016 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"image"
+	"image/color"
+	"image/color/palette"
+	"image/draw"
+	"image/gif"
+	"image/png"
+	"io"
+	"math"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/andreas-jonsson/chip8/chip8"
+	"github.com/andreas-jonsson/chip8/cmd/internal/cli"
+)
+
+// heatmapWidth is the number of addresses in a row of the heatmap, which
+// makes 4 KiB of memory a square.
+const heatmapWidth = 64
+
+// heatmap renders memory accesses as an image with one cell per address.
+// Executed cells are green, read cells blue and written cells red, brighter
+// the more often they were accessed. With animation a frame is rendered
+// with the accesses made since the previous one.
+type heatmap struct {
+	scale  int
+	delay  time.Duration
+	last   chip8.Coverage
+	frames []*image.Paletted
+}
+
+// animated reports whether fileName is written as an animated GIF.
+func animated(fileName string) bool {
+	return strings.EqualFold(filepath.Ext(fileName), ".gif")
+}
+
+// maxCount returns the largest count in counts.
+func maxCount(counts *[4096]uint32) uint32 {
+	var max uint32
+	for _, c := range counts {
+		if c > max {
+			max = c
+		}
+	}
+	return max
+}
+
+// intensity scales count logarithmically to the range 0 to 255. Accessed
+// addresses are at least 64, so they are visible.
+func intensity(count, max uint32) uint8 {
+	if count == 0 {
+		return 0
+	}
+	v := math.Log1p(float64(count)) / math.Log1p(float64(max))
+	return uint8(64 + 191*v)
+}
+
+func (h *heatmap) render(c *chip8.Coverage) *image.RGBA {
+	size := heatmapWidth * h.scale
+	img := image.NewRGBA(image.Rect(0, 0, size, size))
+
+	maxExec, maxRead, maxWrite := maxCount(&c.Executed), maxCount(&c.Read), maxCount(&c.Written)
+	for addr := range c.Executed {
+		cell := color.RGBA{
+			R: intensity(c.Written[addr], maxWrite),
+			G: intensity(c.Executed[addr], maxExec),
+			B: intensity(c.Read[addr], maxRead),
+			A: 0xFF,
+		}
+		x, y := addr%heatmapWidth*h.scale, addr/heatmapWidth*h.scale
+		draw.Draw(img, image.Rect(x, y, x+h.scale, y+h.scale), &image.Uniform{cell}, image.ZP, draw.Src)
+	}
+	return img
+}
+
+// snapshot adds a frame with the accesses made since the last snapshot.
+func (h *heatmap) snapshot(c *chip8.Coverage) {
+	var delta chip8.Coverage
+	for addr := range c.Executed {
+		delta.Executed[addr] = c.Executed[addr] - h.last.Executed[addr]
+		delta.Read[addr] = c.Read[addr] - h.last.Read[addr]
+		delta.Written[addr] = c.Written[addr] - h.last.Written[addr]
+	}
+	h.last = *c
+
+	img := h.render(&delta)
+	frame := image.NewPaletted(img.Bounds(), palette.WebSafe)
+	draw.Draw(frame, frame.Bounds(), img, image.ZP, draw.Src)
+	h.frames = append(h.frames, frame)
+}
+
+// write writes the heatmap of c as a PNG, or the frames as an animated GIF.
+func (h *heatmap) write(fileName string, c *chip8.Coverage) error {
+	return cli.CreateFile(fileName, func(w io.Writer) error {
+		if !animated(fileName) {
+			return png.Encode(w, h.render(c))
+		}
+
+		anim := &gif.GIF{Image: h.frames}
+		for range h.frames {
+			anim.Delay = append(anim.Delay, int(h.delay/(10*time.Millisecond)))
+		}
+		return gif.EncodeAll(w, anim)
+	})
+}
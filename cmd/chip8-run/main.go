@@ -0,0 +1,247 @@
+/*
+Copyright (C) 2016 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/andreas-jonsson/chip8/chip8"
+	"github.com/andreas-jonsson/chip8/cmd/internal/cli"
+)
+
+const defaultCPUSpeed = 500
+
+var (
+	runTime      = flag.Duration("time", 10*time.Second, "stop after running for this long")
+	maxCycles    = flag.Int("cycles", 0, "stop after this many instructions, 0 for no limit")
+	cpuSpeed     = flag.Int("hz", defaultCPUSpeed, "instructions per second")
+	seed         = flag.Int64("seed", 0, "random seed, 0 for the current time")
+	keys         = flag.String("keys", "", "hexadecimal keys to press in turn")
+	keyTime      = flag.Duration("keytime", 100*time.Millisecond, "time every key is held and released")
+	coverageFile = flag.String("coverage", "", "write a coverage map to file")
+	profileFile  = flag.String("profile", "", "write a pprof profile to file")
+	heatmapFile  = flag.String("heatmap", "", "write a memory heatmap to file, animated if it is a .gif")
+	heatmapScale = flag.Int("scale", 8, "size in pixels of an address in the heatmap")
+	frameTime    = flag.Duration("frametime", 250*time.Millisecond, "time covered by every frame of an animated heatmap")
+	strict       = flag.Bool("strict", false, "warn when uninitialized memory is executed or read")
+	randomFill   = flag.Bool("fill", false, "fill memory with random bytes instead of zeros")
+	warnings     = flag.Bool("warn", false, "warn about self-modifying code")
+	protect      = flag.String("protect", "", "make memory read-only, a list of system and code")
+)
+
+// machine is an InputOutput without video or sound. Keys are pressed from
+// the -keys script.
+type machine struct {
+	program    []byte
+	cpuSpeedHz int
+	start      time.Time
+	event      chip8.Event
+}
+
+func (m *machine) Load(memory []byte) {
+	copy(memory, m.program)
+}
+
+func (m *machine) Rand() *rand.Rand {
+	if *seed != 0 {
+		return rand.New(rand.NewSource(*seed))
+	}
+	return rand.New(rand.NewSource(time.Now().UnixNano()))
+}
+
+func (m *machine) BeginTone() {}
+
+func (m *machine) EndTone() {}
+
+func (m *machine) Key(code int) bool {
+	n := int(time.Since(m.start) / *keyTime)
+	if n%2 != 0 || n/2 >= len(*keys) {
+		return false
+	}
+	key, _ := strconv.ParseUint((*keys)[n/2:n/2+1], 16, 4)
+	return int(key) == code
+}
+
+// keysDone reports whether the -keys script has ended.
+func (m *machine) keysDone() bool {
+	return time.Since(m.start) >= 2*time.Duration(len(*keys))**keyTime
+}
+
+// stopped reports whether the program can not make progress anymore, it
+// has finished or waits for a key after the -keys script has ended.
+func (m *machine) stopped() bool {
+	return m.event.State == chip8.Finished || m.event.State == chip8.WaitingKey && m.keysDone()
+}
+
+func (m *machine) Draw(video []byte) {}
+
+func (m *machine) SetCPUFrequency(freq int) {
+	m.cpuSpeedHz = freq
+}
+
+func (m *machine) ResizeVideo(width int) {}
+
+func init() {
+	flag.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: chip8-run [-time duration] [-cycles n] [-hz n] [-seed n] [-keys hex] [-keytime duration] [-coverage file] [-profile file] [-heatmap file] [-scale n] [-frametime duration] [-strict] [-fill] [-warn] [-protect system,code] <program.ch8>")
+		flag.PrintDefaults()
+	}
+}
+
+// run steps the system until the time or cycle limit is reached, the
+// program exits or it stops making progress. It returns the number of
+// instructions executed. If h is not nil it is animated with the coverage
+// of the system.
+func run(sys *chip8.System, m *machine, h *heatmap) (int, error) {
+	deadline := time.After(*runTime)
+	cpuSpeedHz := m.cpuSpeedHz
+	tickCPU := time.Tick(time.Second / time.Duration(cpuSpeedHz))
+
+	var tickFrame <-chan time.Time
+	if h != nil {
+		tickFrame = time.Tick(h.delay)
+	}
+
+	cycles := 0
+	for *maxCycles == 0 || cycles < *maxCycles {
+		select {
+		case <-deadline:
+			return cycles, nil
+		case <-tickFrame:
+			h.snapshot(sys.Coverage())
+		case <-tickCPU:
+			err := sys.Step()
+			if err != nil && err != chip8.ErrExit {
+				return cycles, err
+			}
+			cycles++
+			if err == chip8.ErrExit || m.stopped() {
+				return cycles, nil
+			}
+
+			if cpuSpeedHz != m.cpuSpeedHz {
+				cpuSpeedHz = m.cpuSpeedHz
+				tickCPU = time.Tick(time.Second / time.Duration(cpuSpeedHz))
+			}
+		}
+	}
+	return cycles, nil
+}
+
+func main() {
+	flag.Parse()
+	log.SetFlags(0)
+	if flag.NArg() != 1 || *cpuSpeed <= 0 || *heatmapScale <= 0 || *frameTime <= 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	for _, k := range *keys {
+		if _, err := strconv.ParseUint(string(k), 16, 4); err != nil {
+			log.Fatalf("invalid key '%c'\n", k)
+		}
+	}
+
+	fileName := flag.Arg(0)
+	program, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	m := &machine{program: program, cpuSpeedHz: *cpuSpeed}
+	sys := chip8.NewSystem(m)
+	sys.SetEvents(func(e chip8.Event) {
+		m.event = e
+	})
+	symbols, sourceMap := cli.LoadDebugInfo(sys, fileName)
+	if *strict || *warnings {
+		sys.SetWarnings(func(w chip8.Warning) {
+			if loc, ok := sourceMap.Lookup(w.PC); ok {
+				log.Printf("%v: %v\n", loc, w)
+			} else {
+				log.Printf("%s: %v\n", fileName, w)
+			}
+		})
+	}
+	if *strict || *randomFill {
+		sys.SetStrict(*strict)
+		sys.SetRandomFill(*randomFill)
+		sys.Reset()
+	}
+	if err := protectMemory(sys, program, *protect); err != nil {
+		log.Fatalln(err)
+	}
+	if *coverageFile != "" || *heatmapFile != "" {
+		sys.SetCoverage(new(chip8.Coverage))
+	}
+	if *profileFile != "" {
+		sys.SetProfile(chip8.NewProfile())
+	}
+
+	h := &heatmap{scale: *heatmapScale, delay: *frameTime}
+	var anim *heatmap
+	if animated(*heatmapFile) {
+		anim = h
+	}
+
+	m.start = time.Now()
+	cycles, runErr := run(sys, m, anim)
+	fmt.Printf("%d instructions in %v\n", cycles, time.Since(m.start).Round(time.Millisecond))
+	if m.stopped() {
+		fmt.Printf("%v at $%03X\n", m.event.State, m.event.PC)
+	}
+
+	if *coverageFile != "" {
+		if err := cli.CreateFile(*coverageFile, sys.Coverage().Write); err != nil {
+			log.Fatalln(err)
+		}
+	}
+
+	if *heatmapFile != "" {
+		if anim != nil {
+			anim.snapshot(sys.Coverage())
+		}
+		if err := h.write(*heatmapFile, sys.Coverage()); err != nil {
+			log.Fatalln(err)
+		}
+	}
+
+	if *profileFile != "" {
+		if err := cli.CreateFile(*profileFile, func(w io.Writer) error {
+			return sys.Profile().WritePprof(w, symbols, sourceMap)
+		}); err != nil {
+			log.Fatalln(err)
+		}
+	}
+
+	if runErr != nil {
+		if err := cli.CreateFile(fileName+".dump", func(w io.Writer) error {
+			return sys.Dump(w, fileName)
+		}); err != nil {
+			log.Println(err)
+		}
+		log.Fatalln(runErr)
+	}
+}
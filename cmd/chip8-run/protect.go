@@ -0,0 +1,55 @@
+/*
+Copyright (C) 2016 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/andreas-jonsson/chip8/chip8"
+	"github.com/andreas-jonsson/chip8/chip8/analysis"
+)
+
+const programStart = 0x200
+
+// protectMemory protects the regions in the comma separated list modes,
+// system for the memory below the program and code for the instructions
+// the analysis finds in program.
+func protectMemory(sys *chip8.System, program []byte, modes string) error {
+	if modes == "" {
+		return nil
+	}
+
+	for _, mode := range strings.Split(modes, ",") {
+		switch mode {
+		case "system":
+			sys.Protect(0, programStart)
+		case "code":
+			prog, err := analysis.Analyze(program, programStart, "chippy")
+			if err != nil {
+				return err
+			}
+			for _, pc := range prog.Instructions() {
+				sys.Protect(uint16(pc), uint16(pc+prog.Size(pc)))
+			}
+		default:
+			return fmt.Errorf("unknown protection '%s'", mode)
+		}
+	}
+	return nil
+}
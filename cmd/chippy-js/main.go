@@ -61,7 +61,8 @@ var (
 
 var kb struct {
 	sync.Mutex
-	keys map[int]bool
+	keys    map[int]bool
+	changed bool
 }
 
 type machine struct {
@@ -71,6 +72,7 @@ type machine struct {
 	video       [64 * 4 * 32 * 4 * 3]byte
 	muteAudio   func(bool)
 	canvas      *js.Object
+	state       chip8.State
 }
 
 func (m *machine) Load(memory []byte) {
@@ -164,6 +166,9 @@ func updateScreen(canvas *js.Object, video []byte) {
 
 func updateTitle(m *machine) {
 	title := fmt.Sprintf("Chippy - %dHz - %s", m.cpuSpeedHz, m.programName)
+	if m.state != chip8.Running {
+		title += " - " + m.state.String()
+	}
 	js.Global.Get("document").Set("title", title)
 }
 
@@ -201,12 +206,14 @@ func start() {
 	document.Set("onkeydown", func(e *js.Object) {
 		kb.Lock()
 		kb.keys[e.Get("keyCode").Int()] = true
+		kb.changed = true
 		kb.Unlock()
 	})
 
 	document.Set("onkeyup", func(e *js.Object) {
 		kb.Lock()
 		kb.keys[e.Get("keyCode").Int()] = false
+		kb.changed = true
 		kb.Unlock()
 	})
 
@@ -254,17 +261,53 @@ func start() {
 
 	go func() {
 		sys := chip8.NewSystem(&m)
+		sys.SetEvents(func(e chip8.Event) {
+			m.state = e.State
+			if e.State == chip8.Finished {
+				m.EndTone()
+			}
+			updateTitle(&m)
+		})
+
 		tickRender := time.Tick(time.Second / 32)
 		tickCPU := time.Tick(time.Second / m.cpuSpeedHz)
+		tickTimer := time.Tick(time.Second / 60)
+
+		step := func() {
+			if err := sys.Step(); err != nil {
+				js.Global.Call("alert", err.Error())
+			}
+		}
 
 		for {
+			// As in chippy-sdl a program waiting for the timer is stepped
+			// once per timer tick, one waiting for a key only after a key
+			// event and a finished program not at all.
+			cpu, timer := tickCPU, (<-chan time.Time)(nil)
+			switch m.state {
+			case chip8.WaitingTimer:
+				cpu, timer = nil, tickTimer
+			case chip8.WaitingKey, chip8.Finished:
+				cpu = nil
+			}
+
 			select {
 			case <-tickRender:
-				sys.Refresh()
-			case <-tickCPU:
-				if err := sys.Step(); err != nil {
-					js.Global.Call("alert", err.Error())
+				kb.Lock()
+				keyEvent := kb.changed
+				kb.changed = false
+				kb.Unlock()
+
+				if m.state == chip8.WaitingKey && keyEvent {
+					for n := 0; n < int(m.cpuSpeedHz)/32 && m.state == chip8.WaitingKey; n++ {
+						step()
+					}
 				}
+				sys.Refresh()
+			case <-cpu:
+				step()
+			case <-timer:
+				step()
 			}
 		}
 	}()
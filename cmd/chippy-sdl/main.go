@@ -35,6 +35,7 @@ import (
 	"flag"
 	"fmt"
 	"image/color/palette"
+	"io"
 	"io/ioutil"
 	"log"
 	"math/rand"
@@ -45,6 +46,7 @@ import (
 	"unsafe"
 
 	"github.com/andreas-jonsson/chip8/chip8"
+	"github.com/andreas-jonsson/chip8/cmd/internal/cli"
 	"github.com/veandco/go-sdl2/sdl"
 )
 
@@ -69,6 +71,15 @@ var keymap = [16]string{
 
 const defaultCPUSpeed = 500
 
+var (
+	coverageFile = flag.String("coverage", "", "write a coverage map to file on exit")
+	profileFile  = flag.String("profile", "", "write a pprof profile to file on exit")
+	strict       = flag.Bool("strict", false, "warn when uninitialized memory is executed or read")
+	randomFill   = flag.Bool("fill", false, "fill memory with random bytes instead of zeros")
+	warnings     = flag.Bool("warn", false, "warn about self-modifying code")
+	protect      = flag.Bool("protect", false, "make the memory below the program read-only")
+)
+
 type machine struct {
 	programPath string
 	cpuSpeedHz  time.Duration
@@ -76,6 +87,7 @@ type machine struct {
 	videoWidth  int
 	texture     *sdl.Texture
 	renderer    *sdl.Renderer
+	state       chip8.State
 }
 
 func (m *machine) Load(memory []byte) {
@@ -132,6 +144,9 @@ func (m *machine) Draw(video []byte) {
 
 func updateTitle(window *sdl.Window, m *machine) {
 	title := fmt.Sprintf("Chippy - %dHz - %s", m.cpuSpeedHz, path.Base(m.programPath))
+	if m.state != chip8.Running {
+		title += " - " + m.state.String()
+	}
 	window.SetTitle(title)
 }
 
@@ -154,6 +169,23 @@ func dumpSystem(sys *chip8.System, name string) {
 	}
 }
 
+func writeStats(sys *chip8.System, symbols chip8.Symbols, sourceMap *chip8.SourceMap) {
+	if *coverageFile != "" {
+		fmt.Println("writing coverage...")
+		if err := cli.CreateFile(*coverageFile, sys.Coverage().Write); err != nil {
+			log.Println(err)
+		}
+	}
+	if *profileFile != "" {
+		fmt.Println("writing profile...")
+		if err := cli.CreateFile(*profileFile, func(w io.Writer) error {
+			return sys.Profile().WritePprof(w, symbols, sourceMap)
+		}); err != nil {
+			log.Println(err)
+		}
+	}
+}
+
 func init() {
 	flag.Parse()
 	runtime.LockOSThread()
@@ -165,7 +197,7 @@ func main() {
 		fmt.Println("Chippy - CHIP8 Emulator")
 		fmt.Println("Copyright (C) 2016 Andreas T Jonsson")
 		fmt.Printf("Version: %v\n\n", chip8.Version)
-		fmt.Printf("usage: chippy [program]\n\n")
+		fmt.Printf("usage: chippy [-coverage file] [-profile file] [-strict] [-fill] [-warn] [-protect] [program]\n\n")
 		return
 	}
 
@@ -219,19 +251,72 @@ func main() {
 
 	updateTitle(window, m)
 	sys := chip8.NewSystem(m)
+	sys.SetEvents(func(e chip8.Event) {
+		m.state = e.State
+		if e.State == chip8.Finished {
+			m.EndTone()
+		}
+		updateTitle(window, m)
+	})
+	symbols, sourceMap := cli.LoadDebugInfo(sys, flags[0])
+	if *strict || *warnings {
+		sys.SetWarnings(func(w chip8.Warning) {
+			log.Println(w)
+		})
+	}
+	if *strict || *randomFill {
+		sys.SetStrict(*strict)
+		sys.SetRandomFill(*randomFill)
+		sys.Reset()
+	}
+	if *protect {
+		sys.Protect(0, 0x200)
+	}
+	if *coverageFile != "" {
+		sys.SetCoverage(new(chip8.Coverage))
+	}
+	if *profileFile != "" {
+		sys.SetProfile(chip8.NewProfile())
+	}
+	defer writeStats(sys, symbols, sourceMap)
 
 	cpuSpeedHz := m.cpuSpeedHz
 	tickRender := time.Tick(time.Second / 65)
 	tickCPU := time.Tick(time.Second / cpuSpeedHz)
+	tickTimer := time.Tick(time.Second / 60)
+
+	step := func() {
+		if err := sys.Step(); err != nil {
+			dumpSystem(sys, flags[0])
+			writeStats(sys, symbols, sourceMap)
+			log.Fatalln(err)
+		}
+	}
 
 	for {
+		// The CPU ticker is only used while the program makes progress. A
+		// program waiting for the timer is stepped once per timer tick, one
+		// waiting for a key only after a key event and a finished program
+		// not until it is reset.
+		cpu, timer := tickCPU, (<-chan time.Time)(nil)
+		switch m.state {
+		case chip8.WaitingTimer:
+			cpu, timer = nil, tickTimer
+		case chip8.WaitingKey, chip8.Finished:
+			cpu = nil
+		}
+
 		select {
 		case <-tickRender:
+			keyEvent := false
 			for event := sdl.PollEvent(); event != nil; event = sdl.PollEvent() {
 				switch t := event.(type) {
 				case *sdl.QuitEvent:
 					return
+				case *sdl.KeyDownEvent:
+					keyEvent = true
 				case *sdl.KeyUpEvent:
+					keyEvent = true
 					switch t.Keysym.Sym {
 					case sdl.K_ESCAPE:
 						return
@@ -261,17 +346,23 @@ func main() {
 				tickCPU = time.Tick(time.Second / m.cpuSpeedHz)
 			}
 
+			// Give a program waiting for a key a frame to see it.
+			if m.state == chip8.WaitingKey && keyEvent {
+				for n := 0; n < int(m.cpuSpeedHz)/65 && m.state == chip8.WaitingKey; n++ {
+					step()
+				}
+			}
+
 			sys.Refresh()
 
 			renderer.Clear()
 			texture.Update(nil, unsafe.Pointer(&m.video[0]), m.videoWidth*3)
 			renderer.Copy(m.texture, nil, nil)
 			renderer.Present()
-		case <-tickCPU:
-			if err := sys.Step(); err != nil {
-				dumpSystem(sys, flags[0])
-				log.Fatalln(err)
-			}
+		case <-cpu:
+			step()
+		case <-timer:
+			step()
 		}
 	}
 }
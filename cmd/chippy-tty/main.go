@@ -55,6 +55,7 @@ const defaultCPUSpeed = 500
 type machine struct {
 	programPath string
 	cpuSpeedHz  time.Duration
+	state       chip8.State
 }
 
 func (m *machine) Load(memory []byte) {
@@ -91,9 +92,24 @@ func (m *machine) Draw(video []byte) {
 		}
 	}
 
+	m.drawStatus()
 	termbox.Flush()
 }
 
+// drawStatus writes the state of the program below the screen.
+func (m *machine) drawStatus() {
+	w, _ := termbox.Size()
+	for x := 0; x < w; x++ {
+		termbox.SetCell(x, 32, ' ', termbox.ColorDefault, termbox.ColorDefault)
+	}
+	if m.state == chip8.Running {
+		return
+	}
+	for x, c := range m.state.String() {
+		termbox.SetCell(x, 32, c, termbox.ColorDefault, termbox.ColorDefault)
+	}
+}
+
 func init() {
 	flag.Parse()
 }
@@ -119,6 +135,11 @@ func main() {
 
 	m := machine{programPath: flags[0], cpuSpeedHz: defaultCPUSpeed}
 	sys := chip8.NewSystem(&m)
+	sys.SetEvents(func(e chip8.Event) {
+		m.state = e.State
+		m.drawStatus()
+		termbox.Flush()
+	})
 
 	go func() {
 		for _ = range time.Tick(time.Second / m.cpuSpeedHz) {
@@ -135,6 +156,12 @@ func main() {
 			}
 		case termbox.EventInterrupt:
 			sys.Refresh()
+
+			// Keys are not read from the terminal, so a program waiting
+			// for one will not continue either.
+			if m.state == chip8.Finished || m.state == chip8.WaitingKey {
+				continue
+			}
 			if err := sys.Step(); err != nil {
 				panic(err)
 			}
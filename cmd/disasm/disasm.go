@@ -0,0 +1,426 @@
+/*
+Copyright (C) 2016 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/andreas-jonsson/chip8/chip8"
+	"github.com/andreas-jonsson/chip8/chip8/analysis"
+	"github.com/andreas-jonsson/chip8/chip8/asm"
+)
+
+const (
+	dataPerLine   = 8
+	maxSpriteRows = 32
+)
+
+type (
+	// item is a line of output, an instruction or a run of data bytes.
+	item struct {
+		start, end int
+		code       bool
+	}
+
+	disassembler struct {
+		name    string
+		prog    *analysis.Program
+		symbols chip8.Symbols
+
+		items  []item
+		labels map[int]string
+		refs   map[int]bool
+	}
+)
+
+func newDisassembler(name string, prog *analysis.Program, symbols chip8.Symbols) *disassembler {
+	d := &disassembler{
+		name:    name,
+		prog:    prog,
+		symbols: symbols,
+		labels:  make(map[int]string),
+		refs:    make(map[int]bool),
+	}
+	d.collectRefs()
+	d.layout()
+	d.nameLabels()
+	return d
+}
+
+// operandAddr returns the address operand of the instruction at pc, or -1.
+func (d *disassembler) operandAddr(pc int) int {
+	op := d.prog.Opcode(pc)
+	switch op & 0xF000 {
+	case 0x1000, 0x2000, 0xA000, 0xB000:
+		return int(op & 0xFFF)
+	}
+	if op == 0xF000 && d.prog.Size(pc) == 4 {
+		return int(d.prog.Opcode(pc + 2))
+	}
+	return -1
+}
+
+func (d *disassembler) collectRefs() {
+	for _, pc := range d.prog.Instructions() {
+		if addr := d.operandAddr(pc); addr >= 0 {
+			d.refs[addr] = true
+		}
+	}
+	for _, t := range d.prog.JumpTables {
+		for _, target := range t.Targets {
+			d.refs[target] = true
+		}
+	}
+	for _, addr := range d.prog.Entries {
+		d.refs[addr] = true
+	}
+}
+
+// encodable reports whether the instruction at pc is reached and
+// assembles back to the same bytes.
+func (d *disassembler) encodable(pc int) bool {
+	if !d.prog.IsInstruction(pc) || pc+d.prog.Size(pc) > d.prog.End {
+		return false
+	}
+	inst, ok := d.prog.Instruction(pc)
+	if !ok || !supported(inst.Mnemonic, d.prog.Target) {
+		return false
+	}
+	_, op := d.operands(pc, inst)
+	return op == d.prog.Opcode(pc)
+}
+
+// layout splits the program into lines. Data runs end where an address is
+// referenced and start with one byte per line after a loadi target, as
+// that is usually a sprite.
+func (d *disassembler) layout() {
+	p := d.prog
+	for addr := p.Start; addr < p.End; {
+		if d.encodable(addr) {
+			d.items = append(d.items, item{addr, addr + p.Size(addr), true})
+			addr += p.Size(addr)
+			continue
+		}
+
+		start := addr
+		for addr++; addr < p.End && addr-start < dataPerLine && !d.refs[addr] && !d.encodable(addr); addr++ {
+		}
+		d.items = append(d.items, item{start, addr, false})
+	}
+
+	// Split the data after loadi targets into rows.
+	var items []item
+	rows := 0
+	for _, it := range d.items {
+		if it.code {
+			rows = 0
+		} else if d.refs[it.start] {
+			rows = maxSpriteRows
+		}
+		if it.code || rows == 0 {
+			items = append(items, it)
+			continue
+		}
+		for a := it.start; a < it.end; a++ {
+			if rows > 0 {
+				items = append(items, item{a, a + 1, false})
+				rows--
+			} else {
+				items = append(items, item{a, it.end, false})
+				break
+			}
+		}
+	}
+	d.items = items
+}
+
+func (d *disassembler) nameLabels() {
+	starts := make(map[int]bool)
+	for _, it := range d.items {
+		starts[it.start] = true
+	}
+
+	for _, sym := range d.symbols {
+		if starts[int(sym.Addr)] {
+			d.labels[int(sym.Addr)] = sym.Name
+		}
+	}
+
+	named := func(addr int, prefix string) {
+		if _, ok := d.labels[addr]; !ok && starts[addr] {
+			d.labels[addr] = fmt.Sprintf("%s%03X", prefix, addr)
+		}
+	}
+	for _, fn := range d.prog.Funcs {
+		if fn.Entry != d.prog.Start {
+			named(fn.Entry, "sub_")
+		}
+	}
+	for _, t := range d.prog.JumpTables {
+		named(t.Base, "table_")
+	}
+	for _, addr := range d.prog.DataRefs {
+		if !d.prog.IsInstruction(addr) {
+			named(addr, "data_")
+		}
+	}
+	for addr := range d.refs {
+		named(addr, "L")
+	}
+	if d.refs[d.prog.Start] {
+		if _, ok := d.labels[d.prog.Start]; !ok {
+			d.labels[d.prog.Start] = "start"
+		}
+	}
+}
+
+func (d *disassembler) addrOperand(addr int) string {
+	if name, ok := d.labels[addr]; ok {
+		return name
+	}
+	return fmt.Sprintf("$%03X", addr)
+}
+
+// operands formats the operands of the instruction at pc from the fields
+// of its opcode pattern and returns the opcode they encode.
+func (d *disassembler) operands(pc int, inst asm.Instruction) ([]string, uint16) {
+	op := d.prog.Opcode(pc)
+	if len(inst.Opcode) > 4 {
+		return []string{d.addrOperand(int(d.prog.Opcode(pc + 2)))}, op
+	}
+
+	var (
+		args []string
+		enc  uint16
+	)
+	pattern := inst.Opcode
+	for i := 0; i < 4; {
+		c := pattern[i]
+		shift := uint(12 - 4*i)
+		if c < 'a' || c > 'z' {
+			enc |= uint16(strings.IndexByte("0123456789ABCDEF", c)) << shift
+			i++
+			continue
+		}
+
+		n := 1
+		for i+n < 4 && pattern[i+n] == c {
+			n++
+		}
+		mask := uint16(1)<<uint(4*n) - 1
+		low := uint(4 * (4 - i - n))
+		field := (op >> low) & mask
+		enc |= field << low
+
+		switch {
+		case c != 'n':
+			args = append(args, fmt.Sprintf("v%x", field))
+		case n == 3 && inst.Mnemonic != "sys":
+			args = append(args, d.addrOperand(int(field)))
+		case n == 1:
+			args = append(args, fmt.Sprint(field))
+		default:
+			args = append(args, fmt.Sprintf("$%0*X", n, field))
+		}
+		i += n
+	}
+	return args, enc
+}
+
+func (d *disassembler) instText(pc int) string {
+	inst, _ := d.prog.Instruction(pc)
+	args, _ := d.operands(pc, inst)
+	if len(args) == 0 {
+		return inst.Mnemonic
+	}
+	return fmt.Sprintf("%-7s %s", inst.Mnemonic, strings.Join(args, " "))
+}
+
+func (d *disassembler) bytesText(it item) string {
+	var parts []string
+	for a := it.start; a < it.end; a++ {
+		parts = append(parts, fmt.Sprintf("%02X", d.prog.Memory[a]))
+	}
+	return strings.Join(parts, " ")
+}
+
+// notes returns the comment lines written before the item.
+func (d *disassembler) notes(it item) []string {
+	var notes []string
+	p := d.prog
+	if fn := p.Func(it.start); fn != nil && fn.Entry != p.Start {
+		note := "subroutine"
+		if len(fn.Callers) > 0 {
+			note += ", called from " + d.addrList(fn.Callers)
+		}
+		if !fn.Returns {
+			note += ", does not return"
+		}
+		notes = append(notes, note)
+	}
+	for _, t := range p.JumpTables {
+		if t.Base == it.start {
+			notes = append(notes, fmt.Sprintf("jump table of the jump0 at $%03X", t.PC))
+		}
+	}
+	for _, addr := range p.Entries {
+		if addr == it.start {
+			notes = append(notes, "executed, but not reached by the analysis")
+		}
+	}
+	return notes
+}
+
+// comment returns the trailing comment of the item.
+func (d *disassembler) comment(it item) string {
+	text := fmt.Sprintf("%03X: %s", it.start, d.bytesText(it))
+	p := d.prog
+	if !it.code {
+		if it.end-it.start == 1 {
+			row := p.Memory[it.start]
+			pixels := make([]byte, 8)
+			for i := range pixels {
+				pixels[i] = '.'
+				if row&(0x80>>uint(i)) != 0 {
+					pixels[i] = '#'
+				}
+			}
+			text += "  " + string(pixels)
+		}
+		for a := it.start; a < it.end; a++ {
+			if p.IsInstruction(a) {
+				inst, _ := p.Instruction(a)
+				text += fmt.Sprintf("  executed at $%03X as %s", a, inst.Mnemonic)
+				break
+			}
+		}
+		for _, a := range p.Invalid {
+			if a >= it.start && a < it.end {
+				text += fmt.Sprintf("  invalid opcode reached at $%03X", a)
+			}
+		}
+		return text + d.accessText(it)
+	}
+
+	if t := p.JumpTable(it.start); t != nil && len(t.Targets) > 0 {
+		text += "  targets " + d.addrList(t.Targets)
+	} else if t != nil {
+		text += "  targets unknown"
+	}
+	for a := it.start + 1; a < it.end; a++ {
+		if p.IsInstruction(a) {
+			text += fmt.Sprintf("  also executed at $%03X", a)
+		}
+	}
+	if p.Coverage != nil && !p.Executed(it.start) {
+		text += "  not executed"
+	}
+	return text
+}
+
+// accessText returns how the data of the item was accessed in the
+// coverage.
+func (d *disassembler) accessText(it item) string {
+	cov := d.prog.Coverage
+	if cov == nil {
+		return ""
+	}
+
+	var read, written bool
+	for a := it.start; a < it.end && a < len(cov.Read); a++ {
+		read = read || cov.Read[a] > 0
+		written = written || cov.Written[a] > 0
+	}
+	switch {
+	case read && written:
+		return "  read, written"
+	case read:
+		return "  read"
+	case written:
+		return "  written"
+	}
+	return ""
+}
+
+func (d *disassembler) addrList(addrs []int) string {
+	var names []string
+	for _, a := range addrs {
+		names = append(names, d.addrOperand(a))
+	}
+	return strings.Join(names, ", ")
+}
+
+// writeListing writes the program as source for cmd/asm, which assembles
+// to the same bytes.
+func (d *disassembler) writeListing(writer io.Writer) error {
+	w := bufio.NewWriter(writer)
+	p := d.prog
+
+	fmt.Fprintf(w, "; %s, %d bytes at $%03X\n", d.name, p.End-p.Start, p.Start)
+	subs := 0
+	for _, fn := range p.Funcs {
+		if fn.Entry != p.Start {
+			subs++
+		}
+	}
+	fmt.Fprintf(w, "; %d instructions, %d subroutines, %d jump tables\n\n", len(p.Instructions()), subs, len(p.JumpTables))
+	fmt.Fprintf(w, "    target  %s\n", p.Target)
+	if p.Start != programStart {
+		fmt.Fprintf(w, "    start   $%03X\n", p.Start)
+	}
+	fmt.Fprintln(w)
+
+	for i, it := range d.items {
+		notes := d.notes(it)
+		label, hasLabel := d.labels[it.start]
+		if i > 0 && (len(notes) > 0 || hasLabel && d.items[i-1].code) {
+			fmt.Fprintln(w)
+		}
+		for _, note := range notes {
+			fmt.Fprintf(w, "; %s\n", note)
+		}
+		if hasLabel {
+			fmt.Fprintf(w, "%s:\n", label)
+		}
+
+		var text string
+		if it.code {
+			text = d.instText(it.start)
+		} else {
+			var values []string
+			for a := it.start; a < it.end; a++ {
+				values = append(values, fmt.Sprintf("$%02X", p.Memory[a]))
+			}
+			text = ".       " + strings.Join(values, ", ")
+		}
+		fmt.Fprintf(w, "    %-36s; %s\n", text, d.comment(it))
+	}
+	return w.Flush()
+}
+
+func supported(mnemonic, target string) bool {
+	for _, t := range asm.Targets(mnemonic) {
+		if t == target {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,106 @@
+/*
+Copyright (C) 2016 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/andreas-jonsson/chip8/chip8/analysis"
+)
+
+func dotQuote(s string) string {
+	return strings.Replace(strings.Replace(s, `\`, `\\`, -1), `"`, `\"`, -1)
+}
+
+func blockID(b *analysis.Block) string {
+	return fmt.Sprintf("b%03X", b.Start)
+}
+
+// writeDot writes the control flow graph in the Graphviz DOT format. The
+// blocks of every function are grouped in a cluster, calls are dashed
+// edges to the entry of the called function.
+func (d *disassembler) writeDot(writer io.Writer) error {
+	w := bufio.NewWriter(writer)
+	p := d.prog
+
+	fmt.Fprintf(w, "digraph \"%s\" {\n", dotQuote(d.name))
+	fmt.Fprintln(w, "    node [shape=box fontname=\"monospace\"];")
+
+	owner := make(map[int]bool)
+	for _, fn := range p.Funcs {
+		fmt.Fprintf(w, "    subgraph cluster_%03X {\n", fn.Entry)
+		name := d.addrOperand(fn.Entry)
+		if fn.Entry == p.Start && name[0] == '$' {
+			name = "start"
+		}
+		fmt.Fprintf(w, "        label=\"%s\";\n", dotQuote(name))
+		for _, b := range fn.Blocks {
+			if owner[b.Start] {
+				continue
+			}
+			owner[b.Start] = true
+
+			var lines []string
+			if name, ok := d.labels[b.Start]; ok {
+				lines = append(lines, dotQuote(name+":"))
+			}
+			for pc := b.Start; pc < b.End; pc += p.Size(pc) {
+				lines = append(lines, dotQuote(fmt.Sprintf("%03X  %s", pc, d.instText(pc))))
+			}
+			fmt.Fprintf(w, "        %s [label=\"%s\\l\"];\n", blockID(b), strings.Join(lines, "\\l"))
+		}
+		fmt.Fprintln(w, "    }")
+	}
+
+	for _, b := range p.Blocks {
+		last := p.Last(b)
+		table := p.JumpTable(last) != nil
+		skip := analysis.IsSkip(p.Opcode(last))
+		for i, s := range b.Succs {
+			target := p.Block(s)
+			if target == nil {
+				continue
+			}
+			var attrs []string
+			switch {
+			case table:
+				attrs = append(attrs, "style=dotted")
+			case skip && i == 1:
+				attrs = append(attrs, "label=\"skip\"")
+			}
+			d.writeEdge(w, b, target, attrs)
+		}
+		if callee := p.Block(b.Call); b.Call >= 0 && callee != nil {
+			d.writeEdge(w, b, callee, []string{"style=dashed", "label=\"call\""})
+		}
+	}
+
+	fmt.Fprintln(w, "}")
+	return w.Flush()
+}
+
+func (d *disassembler) writeEdge(w *bufio.Writer, from, to *analysis.Block, attrs []string) {
+	if len(attrs) == 0 {
+		fmt.Fprintf(w, "    %s -> %s;\n", blockID(from), blockID(to))
+		return
+	}
+	fmt.Fprintf(w, "    %s -> %s [%s];\n", blockID(from), blockID(to), strings.Join(attrs, " "))
+}
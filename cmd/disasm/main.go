@@ -0,0 +1,108 @@
+/*
+Copyright (C) 2016 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+
+	"github.com/andreas-jonsson/chip8/chip8"
+	"github.com/andreas-jonsson/chip8/chip8/analysis"
+)
+
+const programStart = 0x200
+
+var (
+	target   = flag.String("target", "chip8", "target platform (chip8, schip, xochip or chippy)")
+	dot      = flag.Bool("dot", false, "write the control flow graph in Graphviz DOT format")
+	outFile  = flag.String("o", "", "output file, default stdout")
+	coverage = flag.String("coverage", "", "coverage map of a run of the program")
+)
+
+func init() {
+	flag.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: disasm [-target chip8|schip|xochip|chippy] [-dot] [-coverage file] [-o output] <input.ch8>")
+		flag.PrintDefaults()
+	}
+}
+
+func main() {
+	flag.Parse()
+	log.SetFlags(0)
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	fileName := flag.Arg(0)
+	image, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	var cov *chip8.Coverage
+	if *coverage != "" {
+		fp, err := os.Open(*coverage)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		cov, err = chip8.ReadCoverage(fp)
+		fp.Close()
+		if err != nil {
+			log.Fatalln(err)
+		}
+	}
+
+	prog, err := analysis.AnalyzeCoverage(image, programStart, *target, cov)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	var symbols chip8.Symbols
+	if fp, err := os.Open(fileName + ".sym"); err == nil {
+		symbols, err = chip8.ReadSymbols(fp)
+		fp.Close()
+		if err != nil {
+			log.Fatalln(err)
+		}
+	}
+
+	var writer io.Writer = os.Stdout
+	if *outFile != "" {
+		fp, err := os.Create(*outFile)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		defer fp.Close()
+		writer = fp
+	}
+
+	d := newDisassembler(fileName, prog, symbols)
+	if *dot {
+		err = d.writeDot(writer)
+	} else {
+		err = d.writeListing(writer)
+	}
+	if err != nil {
+		log.Fatalln(err)
+	}
+}
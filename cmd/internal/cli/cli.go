@@ -0,0 +1,91 @@
+/*
+Copyright (C) 2016 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+// Package cli holds the helpers shared by the command line tools.
+package cli
+
+import (
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/andreas-jonsson/chip8/chip8"
+)
+
+// IncludePaths collects the directories of repeated -I flags.
+type IncludePaths []string
+
+func (paths *IncludePaths) String() string {
+	return strings.Join(*paths, string(filepath.ListSeparator))
+}
+
+func (paths *IncludePaths) Set(dir string) error {
+	*paths = append(*paths, dir)
+	return nil
+}
+
+// CreateFile creates fileName and writes it with write.
+func CreateFile(fileName string, write func(io.Writer) error) error {
+	fp, err := os.Create(fileName)
+	if err != nil {
+		return err
+	}
+
+	if err := write(fp); err != nil {
+		fp.Close()
+		return err
+	}
+	return fp.Close()
+}
+
+// ReadDebugInfo reads the symbol file and source map written next to the
+// program name by the assembler. Missing files are not an error, and what
+// could be read is returned with the first error.
+func ReadDebugInfo(name string) (symbols chip8.Symbols, sourceMap *chip8.SourceMap, err error) {
+	if fp, e := os.Open(name + ".sym"); e == nil {
+		if symbols, e = chip8.ReadSymbols(fp); e != nil {
+			symbols, err = nil, e
+		}
+		fp.Close()
+	}
+
+	if fp, e := os.Open(name + ".srcmap"); e == nil {
+		if sourceMap, e = chip8.ReadSourceMap(fp); e != nil && err == nil {
+			err = e
+		}
+		fp.Close()
+	}
+	return symbols, sourceMap, err
+}
+
+// LoadDebugInfo reads the debug information of the program name and sets
+// it on sys. Files that can not be read are logged.
+func LoadDebugInfo(sys *chip8.System, name string) (chip8.Symbols, *chip8.SourceMap) {
+	symbols, sourceMap, err := ReadDebugInfo(name)
+	if err != nil {
+		log.Println(err)
+	}
+	if symbols != nil {
+		sys.SetSymbols(symbols)
+	}
+	if sourceMap != nil {
+		sys.SetSourceMap(sourceMap)
+	}
+	return symbols, sourceMap
+}
@@ -0,0 +1,389 @@
+/*
+Copyright (C) 2016 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"sort"
+
+	"github.com/andreas-jonsson/chip8/chip8"
+	"github.com/andreas-jonsson/chip8/cmd/internal/cli"
+)
+
+const (
+	version      = "0.1.0"
+	programStart = 0x200
+)
+
+var outFile = flag.String("o", "a.ch8", "output file")
+
+type (
+	input struct {
+		name  string
+		obj   *chip8.Object
+		bases []int
+	}
+
+	block struct {
+		start, end int
+		in         *input
+	}
+
+	global struct {
+		addr int
+		in   *input
+	}
+
+	linker struct {
+		inputs    []*input
+		blocks    []block
+		globals   map[string]global
+		platform  string
+		memSize   int
+		numErrors int
+	}
+)
+
+func (l *linker) errorf(in *input, format string, args ...interface{}) {
+	fmt.Fprintf(os.Stderr, "%s: error: %s\n", in.name, fmt.Sprintf(format, args...))
+	l.numErrors++
+}
+
+func (l *linker) read(fileName string) error {
+	fp, err := os.Open(fileName)
+	if err != nil {
+		return err
+	}
+	defer fp.Close()
+
+	obj, err := chip8.ReadObject(fp)
+	if err != nil {
+		return fmt.Errorf("%s: %v", fileName, err)
+	}
+
+	in := &input{name: fileName, obj: obj, bases: make([]int, len(obj.Sections))}
+	if len(l.inputs) == 0 {
+		l.platform, l.memSize = obj.Platform, obj.MemSize
+	} else if obj.Platform != l.platform {
+		l.errorf(in, "object is for %s, expected %s", obj.Platform, l.platform)
+	}
+	l.inputs = append(l.inputs, in)
+	return nil
+}
+
+func (l *linker) overlap(start, end int) (block, bool) {
+	for _, b := range l.blocks {
+		if start < b.end && b.start < end {
+			return b, true
+		}
+	}
+	return block{}, false
+}
+
+// layout places the absolute sections at their addresses and the
+// relocatable sections in command line order in the free memory after
+// the program start.
+func (l *linker) layout() {
+	for _, in := range l.inputs {
+		for i, s := range in.obj.Sections {
+			if s.Addr < 0 {
+				continue
+			}
+
+			end := s.Addr + len(s.Data)
+			if s.Addr < programStart {
+				l.errorf(in, "section at $%X is below the program start", s.Addr)
+			} else if b, ok := l.overlap(s.Addr, end); ok {
+				l.errorf(in, "section at $%X overlaps $%X-$%X from %s", s.Addr, b.start, b.end-1, b.in.name)
+			}
+			in.bases[i] = s.Addr
+			l.blocks = append(l.blocks, block{s.Addr, end, in})
+		}
+	}
+
+	addr := programStart
+	for _, in := range l.inputs {
+		for i, s := range in.obj.Sections {
+			if s.Addr >= 0 {
+				continue
+			}
+
+			align := s.Align
+			if align < 1 {
+				align = 1
+			}
+			for {
+				addr = (addr + align - 1) / align * align
+				b, ok := l.overlap(addr, addr+len(s.Data))
+				if !ok {
+					break
+				}
+				addr = b.end
+			}
+
+			in.bases[i] = addr
+			if len(s.Data) > 0 {
+				l.blocks = append(l.blocks, block{addr, addr + len(s.Data), in})
+			}
+			addr += len(s.Data)
+		}
+	}
+
+	sort.Slice(l.blocks, func(i, j int) bool {
+		return l.blocks[i].start < l.blocks[j].start
+	})
+	for _, b := range l.blocks {
+		if b.end > l.memSize {
+			l.errorf(b.in, "section at $%X-$%X does not fit in %d bytes of memory", b.start, b.end-1, l.memSize)
+		}
+	}
+}
+
+func (l *linker) symbolAddr(in *input, sym chip8.ObjectSymbol) int {
+	if sym.Section < 0 {
+		return sym.Value
+	}
+	return in.bases[sym.Section] + sym.Value
+}
+
+func (l *linker) collectGlobals() {
+	l.globals = make(map[string]global)
+	for _, in := range l.inputs {
+		for _, sym := range in.obj.Symbols {
+			if !sym.Exported {
+				continue
+			}
+			if g, ok := l.globals[sym.Name]; ok {
+				l.errorf(in, "symbol '%s' is already exported by %s", sym.Name, g.in.name)
+				continue
+			}
+			l.globals[sym.Name] = global{l.symbolAddr(in, sym), in}
+		}
+	}
+}
+
+// relocSection returns the relocatable section of an object.
+func relocSection(obj *chip8.Object) int {
+	for i, s := range obj.Sections {
+		if s.Addr < 0 {
+			return i
+		}
+	}
+	return -1
+}
+
+func (l *linker) relocate() {
+	for _, in := range l.inputs {
+		for i := range in.obj.Sections {
+			s := &in.obj.Sections[i]
+			for _, r := range s.Relocations {
+				value := r.Addend
+				if r.Symbol == "" {
+					n := relocSection(in.obj)
+					if n < 0 {
+						l.errorf(in, "relocation at $%X without a relocatable section", in.bases[i]+r.Offset)
+						continue
+					}
+					value += in.bases[n]
+				} else {
+					g, ok := l.globals[r.Symbol]
+					if !ok {
+						l.errorf(in, "undefined symbol '%s'", r.Symbol)
+						continue
+					}
+					value += g.addr
+				}
+
+				switch r.Func {
+				case "lo":
+					value &= 0xFF
+				case "hi":
+					value = (value >> 8) & 0xFF
+				}
+
+				if value >= 1<<r.Bits || value < -(1<<(r.Bits-1)) {
+					l.errorf(in, "relocated value %d at $%X does not fit in %d bits", value, in.bases[i]+r.Offset, r.Bits)
+					continue
+				}
+
+				v := (uint16(value) & (1<<r.Bits - 1)) << r.Shift
+				if r.Size == 1 {
+					s.Data[r.Offset] |= byte(v)
+				} else {
+					s.Data[r.Offset] |= byte(v >> 8)
+					s.Data[r.Offset+1] |= byte(v)
+				}
+			}
+		}
+	}
+}
+
+func (l *linker) image() []byte {
+	end := programStart
+	for _, b := range l.blocks {
+		if b.end > end {
+			end = b.end
+		}
+	}
+
+	program := make([]byte, end-programStart)
+	for _, in := range l.inputs {
+		for i, s := range in.obj.Sections {
+			if in.bases[i] >= programStart {
+				copy(program[in.bases[i]-programStart:], s.Data)
+			}
+		}
+	}
+	return program
+}
+
+// sourceMap merges the source maps of all sections.
+func (l *linker) sourceMap() *chip8.SourceMap {
+	m := new(chip8.SourceMap)
+	files := make(map[string]int)
+
+	for _, in := range l.inputs {
+		for i, s := range in.obj.Sections {
+			if s.Source == nil {
+				continue
+			}
+
+			fileIndex := func(pos chip8.SourcePos) chip8.SourcePos {
+				name := s.Source.Files[pos.File]
+				n, ok := files[name]
+				if !ok {
+					n = len(m.Files)
+					files[name] = n
+					m.Files = append(m.Files, name)
+				}
+				pos.File = n
+				return pos
+			}
+
+			for _, r := range s.Source.Ranges {
+				r.Start += in.bases[i]
+				r.End += in.bases[i]
+				r.SourcePos = fileIndex(r.SourcePos)
+
+				expanded := make([]chip8.SourcePos, len(r.ExpandedFrom))
+				for j, pos := range r.ExpandedFrom {
+					expanded[j] = fileIndex(pos)
+				}
+				if len(expanded) > 0 {
+					r.ExpandedFrom = expanded
+				}
+				m.Ranges = append(m.Ranges, r)
+			}
+		}
+	}
+
+	sort.SliceStable(m.Ranges, func(i, j int) bool {
+		return m.Ranges[i].Start < m.Ranges[j].Start
+	})
+	return m
+}
+
+// symbols returns the labels of all objects.
+func (l *linker) symbols() chip8.Symbols {
+	var symbols chip8.Symbols
+	for _, in := range l.inputs {
+		for _, sym := range in.obj.Symbols {
+			if sym.Label {
+				symbols = append(symbols, chip8.Symbol{Name: sym.Name, Addr: uint16(l.symbolAddr(in, sym))})
+			}
+		}
+	}
+
+	sort.SliceStable(symbols, func(i, j int) bool {
+		if symbols[i].Addr == symbols[j].Addr {
+			return symbols[i].Name < symbols[j].Name
+		}
+		return symbols[i].Addr < symbols[j].Addr
+	})
+	return symbols
+}
+
+func (l *linker) writeMemoryMap(writer io.Writer) {
+	fmt.Fprintf(writer, "memory map (%s):\n", l.platform)
+
+	addr, free := programStart, 0
+	freeBlock := func(end int) {
+		if end > addr {
+			fmt.Fprintf(writer, "  $%04X-$%04X %6d  free\n", addr, end-1, end-addr)
+			free += end - addr
+		}
+	}
+
+	for _, b := range l.blocks {
+		freeBlock(b.start)
+		fmt.Fprintf(writer, "  $%04X-$%04X %6d  %s\n", b.start, b.end-1, b.end-b.start, b.in.name)
+		if b.end > addr {
+			addr = b.end
+		}
+	}
+	freeBlock(l.memSize)
+
+	fmt.Fprintf(writer, "%d bytes free below $%X\n", free, l.memSize-1)
+}
+
+func main() {
+	fmt.Println("CHIP8 Linker")
+	fmt.Println("Copyright (C) 2016 Andreas T Jonsson")
+	fmt.Printf("Version: %v\n\n", version)
+
+	flag.Parse()
+	if flag.NArg() == 0 {
+		fmt.Println("usage: link [-o output.ch8] <input.o> ...")
+		return
+	}
+
+	l := new(linker)
+	for _, fileName := range flag.Args() {
+		if err := l.read(fileName); err != nil {
+			log.Fatalln(err)
+		}
+	}
+
+	l.layout()
+	l.collectGlobals()
+	l.relocate()
+	if l.numErrors > 0 {
+		log.Fatalf("%d error(s), no output written\n", l.numErrors)
+	}
+
+	program := l.image()
+	if err := ioutil.WriteFile(*outFile, program, 0644); err != nil {
+		log.Fatalln(err)
+	}
+	if err := cli.CreateFile(*outFile+".srcmap", l.sourceMap().Write); err != nil {
+		log.Fatalln(err)
+	}
+	if err := cli.CreateFile(*outFile+".sym", func(w io.Writer) error {
+		return chip8.WriteSymbols(w, l.symbols())
+	}); err != nil {
+		log.Fatalln(err)
+	}
+
+	fmt.Printf("program size: %d bytes\n\n", len(program))
+	l.writeMemoryMap(os.Stdout)
+}